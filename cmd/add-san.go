@@ -0,0 +1,268 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alexellis/k3sup/pkg"
+	operator "github.com/alexellis/k3sup/pkg/operator"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// MakeAddSAN creates the add-san command
+func MakeAddSAN() *cobra.Command {
+	var command = &cobra.Command{
+		Use:   "add-san",
+		Short: "Add TLS SANs to the API server of an existing cluster",
+		Long: `Add TLS SANs to the API server's certificate of an existing cluster,
+without reinstalling K3s.
+
+The SANs are added to the K3s config file on each server, then the
+serving certificate is regenerated and K3s is restarted on one server at
+a time. Each server must be ready and serving the new SANs before the
+next is restarted.
+
+` + pkg.SupportMessageShort + `
+`,
+		Example: `  # Add a load balancer's IP and DNS name to a single server
+  k3sup add-san --host HOST \
+    --tls-san 192.168.0.100 \
+    --tls-san k3s.example.com
+
+  # Add a SAN to each server in an HA cluster
+  k3sup add-san \
+    --host server-1,server-2,server-3 \
+    --user ubuntu \
+    --tls-san k3s.example.com`,
+		SilenceUsage: true,
+	}
+
+	command.Flags().StringSlice("host", []string{}, "Hostname or IP of each server, repeat the flag or give a comma-separated list")
+	addSSHFlags(command)
+
+	command.Flags().StringSlice("tls-san", []string{}, "IP or hostname to add to the API server's certificate, repeat the flag or give a comma-separated list")
+	command.Flags().String("config-path", "/etc/rancher/k3s/config.yaml", "Path to the K3s config file on each server")
+	command.Flags().String("server-data-dir", "/var/lib/rancher/k3s/", "Data directory of K3s on each server")
+	command.Flags().Int("https-listen-port", 6443, "Port of the API server, used to check the served certificate")
+
+	command.Flags().Int("attempts", 60, "Number of attempts to check if a server is ready after restarting it")
+	command.Flags().Duration("pause", time.Second*2, "Pause between checking a server for readiness")
+
+	command.PreRunE = func(command *cobra.Command, args []string) error {
+		hosts, err := command.Flags().GetStringSlice("host")
+		if err != nil {
+			return err
+		}
+		if len(hosts) == 0 {
+			return fmt.Errorf("give at least one server with --host")
+		}
+
+		sans, err := command.Flags().GetStringSlice("tls-san")
+		if err != nil {
+			return err
+		}
+		if len(sans) == 0 {
+			return fmt.Errorf("give at least one SAN with --tls-san")
+		}
+
+		return nil
+	}
+
+	command.RunE = func(command *cobra.Command, args []string) error {
+		hosts, _ := command.Flags().GetStringSlice("host")
+		sudoPrefix, printCommand := serverOptions(command)
+
+		sans, _ := command.Flags().GetStringSlice("tls-san")
+		configPath, _ := command.Flags().GetString("config-path")
+		dataDir, _ := command.Flags().GetString("server-data-dir")
+		httpsPort, _ := command.Flags().GetInt("https-listen-port")
+
+		attempts, _ := command.Flags().GetInt("attempts")
+		pause, _ := command.Flags().GetDuration("pause")
+
+		sans = makeTLSSANs("", sans)
+
+		for i, host := range hosts {
+			fmt.Printf("[%d/%d] Adding TLS SANs to %s\n", i+1, len(hosts), host)
+
+			op, done, err := connectServerHost(command, host)
+			if err != nil {
+				return fmt.Errorf("%s: %w", host, err)
+			}
+
+			err = addSANsToServer(op, sudoPrefix, configPath, dataDir, sans, i == 0, printCommand)
+			if err == nil {
+				err = waitForServerReady(op, sudoPrefix, attempts, pause, printCommand)
+			}
+			done()
+
+			if err != nil {
+				return fmt.Errorf("%s: %w", host, err)
+			}
+
+			address := net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(httpsPort))
+
+			missing, err := checkServingCertificate(address, sans)
+			if err != nil {
+				return fmt.Errorf("%s: unable to check the served certificate: %w", host, err)
+			}
+			if len(missing) > 0 {
+				return fmt.Errorf("%s: the certificate served at %s does not include: %s",
+					host, address, strings.Join(missing, ", "))
+			}
+
+			fmt.Printf("[%d/%d] %s is serving: %s\n", i+1, len(hosts), host, strings.Join(sans, ", "))
+		}
+
+		return nil
+	}
+
+	return command
+}
+
+var fileMode = regexp.MustCompile(`^[0-7]{3,4}$`)
+
+// addSANsToServer writes sans into the K3s config file, then removes the
+// dynamic listener's certificate and restarts K3s so that it is
+// regenerated. The k3s-serving secret is shared by all servers, so is
+// only deleted when deleteSecret is set.
+func addSANsToServer(op operator.CommandOperator, sudoPrefix, configPath, dataDir string, sans []string, deleteSecret, printCommand bool) error {
+	res, err := executeCommand(op, fmt.Sprintf("%scat %s 2>/dev/null || true\n", sudoPrefix, configPath), printCommand)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %w", configPath, err)
+	}
+
+	config, added, err := addTLSSANs(res.StdOut, sans)
+	if err != nil {
+		return fmt.Errorf("unable to update %s: %w", configPath, err)
+	}
+
+	if len(added) > 0 {
+		// An existing file keeps its mode, a new one is only readable
+		// by root
+		mode := "0600"
+		res, err := executeCommand(op, fmt.Sprintf("%sstat -c %%a %s 2>/dev/null || true\n", sudoPrefix, configPath), printCommand)
+		if err != nil {
+			return fmt.Errorf("unable to read the mode of %s: %w", configPath, err)
+		}
+		if existing := strings.TrimSpace(string(res.StdOut)); fileMode.MatchString(existing) {
+			mode = existing
+		}
+
+		fmt.Printf("Adding to %s: %s\n", configPath, strings.Join(added, ", "))
+		if _, err := executeCommand(op, writeFileCommand(sudoPrefix, configPath, config, mode), printCommand); err != nil {
+			return fmt.Errorf("unable to write %s: %w", configPath, err)
+		}
+	}
+
+	if deleteSecret {
+		secretCommand := fmt.Sprintf("%sk3s kubectl --namespace kube-system delete secret k3s-serving --ignore-not-found\n", sudoPrefix)
+		if _, err := executeCommand(op, secretCommand, printCommand); err != nil {
+			return fmt.Errorf("unable to delete the k3s-serving secret: %w", err)
+		}
+	}
+
+	rotateCommand := fmt.Sprintf("%srm -f %s && %ssystemctl restart k3s\n",
+		sudoPrefix, path.Join(dataDir, "/server/tls/dynamic-cert.json"), sudoPrefix)
+	if _, err := executeCommand(op, rotateCommand, printCommand); err != nil {
+		return fmt.Errorf("unable to restart k3s: %w", err)
+	}
+
+	return nil
+}
+
+// waitForServerReady polls the API server's readyz endpoint on the node
+// until it reports ready
+func waitForServerReady(op operator.CommandOperator, sudoPrefix string, attempts int, pause time.Duration, printCommand bool) error {
+	readyCommand := fmt.Sprintf("%sk3s kubectl get --raw /readyz\n", sudoPrefix)
+
+	for i := 0; i < attempts; i++ {
+		res, err := executeCommand(op, readyCommand, printCommand && i == 0)
+		if err == nil && strings.TrimSpace(string(res.StdOut)) == "ok" {
+			return nil
+		}
+
+		fmt.Printf("Waiting for K3s to be ready: %d/%d\n", i+1, attempts)
+		time.Sleep(pause)
+	}
+
+	return fmt.Errorf("K3s was not ready after %d attempts", attempts)
+}
+
+// addTLSSANs adds each of sans to the tls-san list of a K3s config
+// file, keeping its other settings and comments. The SANs which were not
+// already present are returned.
+func addTLSSANs(config []byte, sans []string) ([]byte, []string, error) {
+	doc := yaml.Node{}
+	if len(bytes.TrimSpace(config)) > 0 {
+		if err := yaml.Unmarshal(config, &doc); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{
+			Kind:    yaml.DocumentNode,
+			Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}},
+		}
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("expected a map of settings")
+	}
+
+	var list *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "tls-san" {
+			list = root.Content[i+1]
+			break
+		}
+	}
+
+	if list == nil {
+		list = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		root.Content = append(root.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "tls-san"},
+			list)
+	} else if list.Kind == yaml.ScalarNode {
+		existing := *list
+		*list = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: []*yaml.Node{&existing}}
+	}
+
+	present := map[string]bool{}
+	for _, item := range list.Content {
+		for _, value := range strings.Split(item.Value, ",") {
+			present[strings.TrimSpace(value)] = true
+		}
+	}
+
+	added := []string{}
+	for _, san := range sans {
+		if present[san] {
+			continue
+		}
+		present[san] = true
+		added = append(added, san)
+		list.Content = append(list.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: san})
+	}
+
+	buf := bytes.Buffer{}
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	return buf.Bytes(), added, nil
+}
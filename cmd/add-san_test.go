@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+)
+
+func Test_addTLSSANs_EmptyConfig(t *testing.T) {
+	got, added, err := addTLSSANs([]byte(""), []string{"192.168.0.100", "k3s.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "tls-san:\n  - 192.168.0.100\n  - k3s.example.com\n"
+	if string(got) != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, got)
+	}
+	if !reflect.DeepEqual(added, []string{"192.168.0.100", "k3s.example.com"}) {
+		t.Errorf("unexpected SANs added: %v", added)
+	}
+}
+
+func Test_addTLSSANs_ExistingConfig(t *testing.T) {
+	config := `# Managed by hand
+write-kubeconfig-mode: "0644"
+tls-san: 10.0.0.1,192.168.0.100
+disable:
+  - traefik
+`
+
+	got, added, err := addTLSSANs([]byte(config), []string{"192.168.0.100", "k3s.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# Managed by hand
+write-kubeconfig-mode: "0644"
+tls-san:
+  - 10.0.0.1,192.168.0.100
+  - k3s.example.com
+disable:
+  - traefik
+`
+	if string(got) != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, got)
+	}
+	if !reflect.DeepEqual(added, []string{"k3s.example.com"}) {
+		t.Errorf("unexpected SANs added: %v", added)
+	}
+}
+
+func Test_addTLSSANs_NothingToAdd(t *testing.T) {
+	config := "tls-san:\n  - k3s.example.com\n"
+
+	_, added, err := addTLSSANs([]byte(config), []string{"k3s.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 0 {
+		t.Errorf("want no SANs to be added, got: %v", added)
+	}
+}
+
+func Test_addSANsToServer_KeepsMode(t *testing.T) {
+	for _, tc := range []struct {
+		title string
+		stat  string
+		want  string
+	}{
+		{title: "existing file", stat: "644\n", want: "install -m 644 /dev/null /etc/rancher/k3s/config.yaml"},
+		{title: "new file", stat: "", want: "install -m 0600 /dev/null /etc/rancher/k3s/config.yaml"},
+	} {
+		t.Run(tc.title, func(t *testing.T) {
+			op := &testOperator{respond: func(command string) operator.CommandRes {
+				if strings.Contains(command, "stat -c") {
+					return operator.CommandRes{StdOut: []byte(tc.stat)}
+				}
+				return operator.CommandRes{}
+			}}
+
+			if err := addSANsToServer(op, "sudo ", "/etc/rancher/k3s/config.yaml", "/var/lib/rancher/k3s", []string{"k3s.example.com"}, false, false); err != nil {
+				t.Fatal(err)
+			}
+
+			written := false
+			for _, command := range op.commands {
+				if strings.Contains(command, "K3SUP_EOF") {
+					written = true
+					if !strings.Contains(command, tc.want) {
+						t.Errorf("want %q in %q", tc.want, command)
+					}
+				}
+			}
+			if !written {
+				t.Errorf("want the config file to be written, got %q", op.commands)
+			}
+		})
+	}
+}
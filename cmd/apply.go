@@ -0,0 +1,750 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alexellis/k3sup/pkg"
+	operator "github.com/alexellis/k3sup/pkg/operator"
+	"github.com/spf13/cobra"
+)
+
+// MakeApply creates the apply command
+func MakeApply() *cobra.Command {
+	var command = &cobra.Command{
+		Use:   "apply",
+		Short: "Install K3s on every host in a devices file",
+		Long: `Install K3s on every host in the devices file used by k3sup plan,
+without generating a script.
+
+The first host is installed as a server, then the node token is fetched
+from it once. The rest of the servers join one at a time, so that etcd
+gains one member at a time, then the agents join, up to --parallel at
+once. The output of each node is prefixed with its hostname, or its IP.
+
+A summary of each node is printed at the end, and the command exits
+non-zero if any node failed.
+
+A plan written by k3sup plan --output json or yaml can be given with
+--plan, after it has been reviewed or edited.
+
+Each node is compared with the spec first, as with k3sup diff, and only
+the nodes which differ are changed, so apply can be run again safely.
+A node without K3s is installed or joined, a node with a different
+version or settings is installed or joined again with the spec, and
+labels which differ are set on its Node. A node which is installed again
+is cordoned and drained first, then uncordoned once it is Ready, one
+node at a time, so that the servers keep quorum and the workloads of
+only one node are moved at once. A node with a different role,
+or a Node which is not in the spec, is reported but not changed. Give
+--force to install or join every node without comparing them first,
+nodes are not drained then.
+
+With --cluster-name, the cluster is recorded in ` + clusterStateDir + `
+under that name, so that later commands can target it with --cluster.
+
+` + pkg.SupportMessageShort + `
+`,
+		Example: `  # Install 3 servers and join the remaining hosts as agents
+  k3sup apply hosts.json --servers 3 --user ubuntu
+
+  # Read the hosts from the outputs of Terraform
+  terraform output -json > outputs.json
+  k3sup apply --from-terraform outputs.json \
+    --terraform-server server_ips --terraform-agent agent_ips
+
+  # Review the plan, then apply it
+  k3sup plan hosts.json --servers 3 -o yaml > plan.yaml
+  k3sup apply --plan plan.yaml
+
+  # Upgrade the cluster by changing the version in the spec, only
+  # the nodes at another version are installed again
+  k3sup apply hosts.json --servers 3 --k3s-version v1.30.2+k3s1
+
+  # Join up to 10 agents at once
+  k3sup apply hosts.json --servers 3 --parallel 10 \
+    --tls-san $SAN_IP`,
+		SilenceUsage: true,
+	}
+
+	addApplySpecFlags(command)
+	command.Flags().String("cluster-name", "", "Name to record the cluster under in "+clusterStateDir+", the cluster is only recorded when given")
+	command.Flags().Bool("save-node-token", false, "Save the node token with the cluster record, so that join --cluster does not need to fetch it")
+	command.Flags().Bool("force", false, "Install or join every node, without comparing the nodes with the spec first")
+	command.Flags().Bool("skip-drain", false, "Cordon each node which is installed again, but do not drain it")
+	command.Flags().Duration("drain-timeout", time.Minute*5, "Time to wait for a node to drain")
+	command.Flags().Int("attempts", 60, "Number of attempts to check if a node which was installed again is Ready")
+	command.Flags().Duration("pause", time.Second*5, "Pause between checking a node for readiness")
+
+	command.PreRunE = func(command *cobra.Command, args []string) error {
+		if err := validateApplySpecFlags(command); err != nil {
+			return err
+		}
+
+		if name, _ := command.Flags().GetString("cluster-name"); len(name) > 0 {
+			if _, err := clusterDir(name); err != nil {
+				return err
+			}
+		} else if saveToken, _ := command.Flags().GetBool("save-node-token"); saveToken {
+			return fmt.Errorf("--save-node-token needs --cluster-name, to save the token with the cluster record")
+		}
+
+		return nil
+	}
+
+	command.RunE = func(command *cobra.Command, args []string) error {
+		parallel, _ := command.Flags().GetInt("parallel")
+
+		steps, err := readApplySteps(command, args)
+		if err != nil {
+			return err
+		}
+
+		cluster, _ := command.Flags().GetString("cluster-name")
+
+		a := &apply{
+			steps:   steps,
+			results: make([]applyResult, len(steps)),
+			width:   stepNameWidth(steps),
+			cluster: cluster,
+		}
+
+		actions := make([]applyAction, len(steps))
+		for i := range actions {
+			actions[i].Run = true
+		}
+		var states []nodeState
+		if force, _ := command.Flags().GetBool("force"); !force {
+			fmt.Println("Comparing the nodes with the spec")
+			states = probeNodes(steps, parallel)
+			live, err := readLiveNodes(steps, states)
+			if err != nil {
+				fmt.Printf("Unable to read the nodes of the cluster, labels are not compared: %s\n", err)
+			}
+
+			drift := diffCluster(steps, states, live)
+			if len(drift) == 0 {
+				fmt.Printf("All %d nodes match the spec\n", len(steps))
+			} else {
+				printDrift(os.Stdout, drift)
+			}
+			fmt.Println()
+			actions = applyActions(steps, states, live, drift)
+		}
+		a.actions = actions
+
+		operators := map[string]operator.CommandOperator{}
+		dones := []DoneFunc{}
+		defer func() {
+			for _, done := range dones {
+				done()
+			}
+		}()
+
+		sudoPrefix := ""
+		if steps[0].Sudo {
+			sudoPrefix = "sudo "
+		}
+		a.upgrader = &rollingUpgrade{
+			sudoPrefix: sudoPrefix,
+			servers:    installedServers(steps, states),
+			connect: func(host Host) (operator.CommandOperator, error) {
+				if op, ok := operators[host.Address()]; ok {
+					return op, nil
+				}
+
+				for _, step := range steps {
+					if step.Host.Address() == host.Address() {
+						sshOperator, done, err := connectStep(step)
+						if err != nil {
+							return nil, err
+						}
+						dones = append(dones, done)
+						operators[host.Address()] = sshOperator
+						return sshOperator, nil
+					}
+				}
+				return nil, fmt.Errorf("%s is not in the plan", host.Address())
+			},
+		}
+		a.upgrader.skipDrain, _ = command.Flags().GetBool("skip-drain")
+		a.upgrader.drainTimeout, _ = command.Flags().GetDuration("drain-timeout")
+		a.upgrader.attempts, _ = command.Flags().GetInt("attempts")
+		a.upgrader.pause, _ = command.Flags().GetDuration("pause")
+
+		installArgs := []string{}
+		if len(cluster) > 0 {
+			installArgs = append(installArgs, "--cluster-name", cluster)
+		}
+		if saveToken, _ := command.Flags().GetBool("save-node-token"); saveToken {
+			installArgs = append(installArgs, "--save-node-token")
+		}
+
+		joins := []int{}
+		for i, action := range actions {
+			switch {
+			case action.Err != nil:
+				a.results[i] = applyResult{Status: "failed", Err: action.Err}
+			case !action.Run:
+				a.results[i] = applyResult{Status: "unchanged"}
+			case i > 0:
+				joins = append(joins, i)
+			}
+		}
+
+		if actions[0].Run {
+			a.runStep(0, installArgs...)
+		}
+		if a.results[0].Status != "failed" {
+			if len(joins) > 0 {
+				if tokenPath, err := a.writeNodeToken(); err != nil {
+					fmt.Printf("Unable to fetch the node token from %s: %s\n", steps[0].Name, err)
+				} else {
+					defer os.Remove(tokenPath)
+					a.join(tokenPath, joins, parallel)
+				}
+			}
+			a.setLabels(actions)
+		}
+
+		fmt.Println()
+		printApplyResults(os.Stdout, steps, a.results)
+
+		failed := 0
+		for _, result := range a.results {
+			if result.Status == "failed" || len(result.Status) == 0 {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d nodes did not install", failed, len(steps))
+		}
+
+		return nil
+	}
+
+	return command
+}
+
+// addApplySpecFlags adds the flags which describe the cluster, shared by
+// apply and diff
+func addApplySpecFlags(command *cobra.Command) {
+	command.Flags().Int("servers", 3, "Number of servers to use from the devices file")
+	command.Flags().String("local-path", "kubeconfig", "Where to save the kubeconfig file")
+	command.Flags().String("context", "default", "Name of the kubeconfig context to use")
+	command.Flags().String("user", "root", "Username for SSH login")
+	command.Flags().String("ssh-key", "~/.ssh/id_rsa", "The ssh key to use for remote login")
+	command.Flags().Bool("sudo", true, "Use sudo for installation. e.g. set to false when using the root user and no sudo is available.")
+	command.Flags().String("tls-san", "", "SAN for TLS certificates, can be a comma-separated list")
+	command.Flags().String("server-k3s-extra-args", "", "Extra arguments to be passed into the k3s server")
+	command.Flags().String("agent-k3s-extra-args", "", "Extra arguments to be passed into the k3s agent")
+	command.Flags().String("k3s-version", "", "Version of K3s to install on every host, i.e. v1.30.2+k3s1, the stable channel is used when not given")
+	addTerraformFlags(command)
+
+	command.Flags().Int("limit", 0, "Maximum number of nodes to use from the devices file, 0 to use all devices")
+	command.Flags().Bool("merge", true, `Merge the config with existing kubeconfig if it already exists.
+Provide the --local-path flag with --merge if a kubeconfig already exists in some other directory`)
+
+	command.Flags().Int("parallel", 5, "Maximum number of nodes to work on at once")
+	command.Flags().Bool("strict", false, "Fail on warnings found when validating the plan, as well as errors")
+	command.Flags().String("plan", "", "Use a plan written by k3sup plan --output json or yaml, instead of a devices file")
+}
+
+func validateApplySpecFlags(command *cobra.Command) error {
+	if parallel, _ := command.Flags().GetInt("parallel"); parallel < 1 {
+		return fmt.Errorf("--parallel must be at least 1")
+	}
+
+	if servers, _ := command.Flags().GetInt("servers"); servers < 1 {
+		return fmt.Errorf("--servers must be at least 1")
+	}
+
+	return nil
+}
+
+// readApplySteps reads the plan given by --plan, or makes one from the
+// hosts in the devices file or Terraform, then validates it
+func readApplySteps(command *cobra.Command, args []string) ([]planStep, error) {
+	strict, _ := command.Flags().GetBool("strict")
+
+	var steps []planStep
+	requestedServers := 0
+	if planFile, _ := command.Flags().GetString("plan"); len(planFile) > 0 {
+		if len(args) > 0 {
+			return nil, fmt.Errorf("give either a devices file or --plan, not both")
+		}
+		var err error
+		if steps, err = readPlanDocument(planFile); err != nil {
+			return nil, err
+		}
+	} else {
+		hosts, err := readPlanHosts(command, args)
+		if err != nil {
+			return nil, err
+		}
+		options := applyPlanOptions(command)
+		steps = makePlanSteps(hosts, options)
+		requestedServers = options.Servers
+	}
+
+	if err := reportPlanIssues(os.Stderr, validatePlan(steps, requestedServers), strict); err != nil {
+		return nil, err
+	}
+
+	return steps, nil
+}
+
+func applyPlanOptions(command *cobra.Command) planOptions {
+	options := planOptions{}
+	options.Servers, _ = command.Flags().GetInt("servers")
+	options.Limit, _ = command.Flags().GetInt("limit")
+	options.User, _ = command.Flags().GetString("user")
+	options.SSHKey, _ = command.Flags().GetString("ssh-key")
+	options.Sudo, _ = command.Flags().GetBool("sudo")
+	options.TLSSAN, _ = command.Flags().GetString("tls-san")
+	options.ServerExtraArgs, _ = command.Flags().GetString("server-k3s-extra-args")
+	options.AgentExtraArgs, _ = command.Flags().GetString("agent-k3s-extra-args")
+	options.LocalPath, _ = command.Flags().GetString("local-path")
+	options.Context, _ = command.Flags().GetString("context")
+	options.K3sVersion, _ = command.Flags().GetString("k3s-version")
+	if merge, _ := command.Flags().GetBool("merge"); merge {
+		if _, err := os.Stat(options.LocalPath); err == nil {
+			options.Merge = true
+		}
+	}
+	return options
+}
+
+type applyResult struct {
+	Status   string
+	Duration time.Duration
+	Err      error
+}
+
+// apply runs the steps of a plan with the install and join commands,
+// writing the output of each with its host as a prefix
+type apply struct {
+	steps   []planStep
+	results []applyResult
+	width   int
+	cluster string
+
+	// actions and upgrader are used to drain, then wait for, nodes
+	// which are installed again
+	actions  []applyAction
+	upgrader *rollingUpgrade
+
+	mu sync.Mutex
+}
+
+// stepCommands make the command run for each kind of step
+var stepCommands = map[string]func() *cobra.Command{
+	"install": MakeInstall,
+	"join":    MakeJoin,
+}
+
+// run runs the step at index i with extraArgs, and records its result
+func (a *apply) run(i int, extraArgs ...string) error {
+	step := a.steps[i]
+	out := &prefixWriter{
+		mu:     &a.mu,
+		out:    os.Stdout,
+		prefix: fmt.Sprintf("[%-*s] ", a.width, step.Name),
+	}
+
+	out.Write([]byte(fmt.Sprintf("Installing K3s as %s %d/%d\n", step.Role, i+1, len(a.steps))))
+
+	start := time.Now()
+	var err error
+	if makeCommand, ok := stepCommands[step.Command]; ok {
+		task := makeCommand()
+		task.SetArgs(append(step.Args()[1:], extraArgs...))
+		task.SetOut(out)
+		task.SetErr(out)
+		task.SilenceErrors = true
+		err = task.Execute()
+	} else {
+		err = fmt.Errorf("unknown command %q, want install or join", step.Command)
+	}
+	out.Flush()
+
+	result := applyResult{Status: "ok", Duration: time.Since(start).Round(time.Second), Err: err}
+	if err != nil {
+		result.Status = "failed"
+	}
+	a.results[i] = result
+
+	return err
+}
+
+// runStep runs the step at index i, draining its node first when K3s is
+// installed on it already
+func (a *apply) runStep(i int, extraArgs ...string) error {
+	if a.actions[i].Reinstall {
+		return a.reinstall(i, extraArgs...)
+	}
+	return a.run(i, extraArgs...)
+}
+
+// reinstall cordons and drains the node of the step at index i through
+// another server, runs the step, then waits for the node to be Ready at
+// the version in the step before uncordoning it. A node which fails is
+// left cordoned.
+func (a *apply) reinstall(i int, extraArgs ...string) error {
+	step := a.steps[i]
+	nodeName := a.actions[i].NodeName
+
+	u := *a.upgrader
+	u.version = flagValue(step.Flags, "k3s-version")
+
+	err := func() error {
+		control, err := u.controlServer(step.Host)
+		if err != nil {
+			return err
+		}
+		if len(nodeName) == 0 {
+			op, err := u.connect(step.Host)
+			if err != nil {
+				return err
+			}
+			res, err := executeCommand(op, "hostname\n", false)
+			if err != nil {
+				return fmt.Errorf("unable to get the hostname: %w", err)
+			}
+			nodeName = strings.TrimSpace(string(res.StdOut))
+		}
+		return u.drain(control, nodeName)
+	}()
+	if err != nil {
+		a.results[i] = applyResult{Status: "failed", Err: err}
+		return err
+	}
+
+	if err := a.run(i, extraArgs...); err != nil {
+		return err
+	}
+
+	control, err := u.controlServer(step.Host)
+	if err == nil {
+		if err = u.waitForVersion(control, nodeName); err == nil {
+			uncordonCommand := fmt.Sprintf("%sk3s kubectl uncordon %s\n", u.sudoPrefix, shellQuote(nodeName))
+			if _, err = executeCommand(control, uncordonCommand, false); err != nil {
+				err = fmt.Errorf("unable to uncordon: %w", err)
+			}
+		}
+	}
+	if err != nil {
+		a.results[i].Status = "failed"
+		a.results[i].Err = err
+	}
+	return err
+}
+
+// installedServers gives the hosts of the servers which have K3s
+// installed, which can be used to drain other nodes. The first server is
+// given when none is, as it is installed before any node is drained.
+func installedServers(steps []planStep, states []nodeState) []Host {
+	servers := []Host{}
+	for i, step := range steps {
+		if step.Role == "server" && i < len(states) && states[i].Err == nil && states[i].Role == "server" {
+			servers = append(servers, step.Host)
+		}
+	}
+	if len(servers) == 0 {
+		servers = append(servers, steps[0].Host)
+	}
+	return servers
+}
+
+// join runs the join steps at indexes once the first server is up.
+// Servers join one at a time. Agents without K3s join up to parallel at
+// once, then agents which are installed again are drained and joined one
+// at a time.
+func (a *apply) join(tokenPath string, indexes []int, parallel int) {
+	joinArgs := a.joinArgs(tokenPath)
+
+	agents := []int{}
+	reinstalls := []int{}
+	for _, i := range indexes {
+		switch {
+		case a.steps[i].Role == "server":
+			a.runStep(i, joinArgs...)
+		case a.actions[i].Reinstall:
+			reinstalls = append(reinstalls, i)
+		default:
+			agents = append(agents, i)
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	limit := make(chan struct{}, parallel)
+	for _, i := range agents {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-limit }()
+			a.run(i, joinArgs...)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, i := range reinstalls {
+		a.runStep(i, joinArgs...)
+	}
+}
+
+// joinArgs gives the arguments added to each join step. The cluster is
+// only given when it was recorded, otherwise the first server of the plan
+// is given, so that each node joins it however the plan was written.
+func (a *apply) joinArgs(tokenPath string) []string {
+	args := []string{"--node-token-path", tokenPath}
+	if len(a.cluster) > 0 {
+		if _, err := readClusterRecord(a.cluster); err == nil {
+			return append(args, "--cluster", a.cluster)
+		}
+	}
+
+	primary := a.steps[0]
+	args = append(args, "--server-host", primary.Host.Address())
+	if len(primary.User) > 0 {
+		args = append(args, "--server-user", primary.User)
+	}
+	if primary.SSHPort > 0 {
+		args = append(args, "--server-ssh-port", strconv.Itoa(primary.SSHPort))
+	}
+	return args
+}
+
+// writeNodeToken fetches the node token from the first server, and writes
+// it to a temporary file, so that it is not given on the command line of
+// each join
+func (a *apply) writeNodeToken() (string, error) {
+	primary := a.steps[0]
+
+	sudoPrefix := ""
+	if primary.Sudo {
+		sudoPrefix = "sudo "
+	}
+	dataDir := k3sExtraArg(flagValue(primary.Flags, "k3s-extra-args"), "--data-dir", "/var/lib/rancher/k3s")
+
+	sshOperator, done, err := connectStep(primary)
+	if err != nil {
+		return "", err
+	}
+	defer done()
+
+	getTokenCommand := fmt.Sprintf("%scat %s\n", sudoPrefix, path.Join(dataDir, "server/node-token"))
+	nodeToken, err := obtainNodeToken(sshOperator, getTokenCommand, primary.Host.Address())
+	if err != nil {
+		return "", err
+	}
+	if len(nodeToken) == 0 {
+		return "", fmt.Errorf("no node token found")
+	}
+
+	tokenFile, err := os.CreateTemp("", "k3sup-node-token-")
+	if err != nil {
+		return "", err
+	}
+	defer tokenFile.Close()
+
+	if _, err := tokenFile.WriteString(nodeToken); err != nil {
+		os.Remove(tokenFile.Name())
+		return "", err
+	}
+
+	return tokenFile.Name(), nil
+}
+
+// applyAction is what apply does for a step. Run installs or joins the
+// node, Reinstall drains it first as K3s is installed already, Labels are
+// set on its Node, and Err is why the node cannot be brought in line with
+// the spec.
+type applyAction struct {
+	Run       bool
+	Reinstall bool
+	NodeName  string
+	Labels    map[string]string
+	Err       error
+}
+
+// applyActions gives what to do for each step from the differences found
+// by diffCluster. A node is installed or joined again for any difference
+// other than its labels, which are only set when it registers, or its
+// role, which needs it to be uninstalled.
+func applyActions(steps []planStep, states []nodeState, live []liveNode, drift []nodeDrift) []applyAction {
+	actions := make([]applyAction, len(steps))
+	for _, d := range drift {
+		if d.Step < 0 {
+			continue
+		}
+
+		action := &actions[d.Step]
+		state := states[d.Step]
+		switch {
+		case d.Field == "role":
+			action.Err = fmt.Errorf("installed as %s, uninstall it to change its role to %s", d.Got, d.Want)
+		case strings.HasPrefix(d.Field, "label "):
+			if node := matchLiveNode(steps[d.Step], state, live); node >= 0 {
+				if action.Labels == nil {
+					action.Labels = map[string]string{}
+				}
+				action.NodeName = live[node].Name
+				action.Labels[strings.TrimPrefix(d.Field, "label ")] = d.Want
+			}
+		default:
+			action.Run = true
+			if state.Err == nil && (state.Role == "server" || state.Role == "agent") {
+				action.Reinstall = true
+				action.NodeName = state.Hostname
+				if node := matchLiveNode(steps[d.Step], state, live); node >= 0 {
+					action.NodeName = live[node].Name
+				}
+			}
+		}
+	}
+	return actions
+}
+
+// setLabels sets the labels which differ on each Node through the first
+// server, for steps which did not fail
+func (a *apply) setLabels(actions []applyAction) {
+	var op *operator.SSHOperator
+	for i, action := range actions {
+		if len(action.Labels) == 0 || a.results[i].Status == "failed" {
+			continue
+		}
+
+		if op == nil {
+			var done DoneFunc
+			var err error
+			if op, done, err = connectStep(a.steps[0]); err != nil {
+				fmt.Printf("Unable to connect to %s to set labels: %s\n", a.steps[0].Name, err)
+				return
+			}
+			defer done()
+		}
+
+		labels := []string{}
+		for key, value := range action.Labels {
+			labels = append(labels, shellQuote(key+"="+value))
+		}
+		sort.Strings(labels)
+
+		sudoPrefix := ""
+		if a.steps[0].Sudo {
+			sudoPrefix = "sudo "
+		}
+		fmt.Printf("Setting labels on %s: %s\n", action.NodeName, strings.Join(labels, " "))
+		labelCommand := fmt.Sprintf("%sk3s kubectl label node %s %s --overwrite\n", sudoPrefix, shellQuote(action.NodeName), strings.Join(labels, " "))
+		if _, err := executeCommand(op, labelCommand, false); err != nil {
+			a.results[i].Status = "failed"
+			a.results[i].Err = fmt.Errorf("unable to set labels: %w", err)
+		} else if a.results[i].Status == "unchanged" {
+			a.results[i].Status = "updated"
+		}
+	}
+}
+
+// connectStep connects to the host of step over SSH, the DoneFunc closes
+// the connection
+func connectStep(step planStep) (*operator.SSHOperator, DoneFunc, error) {
+	port := step.SSHPort
+	if port == 0 {
+		port = 22
+	}
+	address := fmt.Sprintf("%s:%d", step.Host.Address(), port)
+	sshOperator, sshOperatorDone, errored, err := connectOperator(step.User, address, expandPath(step.SSHKey))
+	if errored {
+		return nil, nil, fmt.Errorf("%s: %w", address, err)
+	}
+	if sshOperatorDone == nil {
+		sshOperatorDone = func() {}
+	}
+	return sshOperator, sshOperatorDone, nil
+}
+
+func stepNameWidth(steps []planStep) int {
+	width := 0
+	for _, step := range steps {
+		if len(step.Name) > width {
+			width = len(step.Name)
+		}
+	}
+	return width
+}
+
+func printApplyResults(w io.Writer, steps []planStep, results []applyResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "HOST\tIP\tROLE\tSTATUS\tDURATION\tERROR\n")
+	for i, step := range steps {
+		result := results[i]
+
+		duration := "-"
+		if len(result.Status) == 0 {
+			result.Status = "skipped"
+		} else if result.Status == "ok" || result.Duration > 0 {
+			duration = result.Duration.String()
+		}
+		errStr := "-"
+		if result.Err != nil {
+			errStr = result.Err.Error()
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			step.Name, step.Host.Address(), step.Role, strings.ToUpper(result.Status), duration, errStr)
+	}
+	tw.Flush()
+}
+
+// prefixWriter writes each complete line to out with a prefix, holding mu
+// so that lines from several writers, or from the stdout and stderr of
+// one command, are not interleaved
+type prefixWriter struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.writeLine(w.buf[:i+1])
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes any incomplete line left in the buffer
+func (w *prefixWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) > 0 {
+		w.writeLine(append(w.buf, '\n'))
+		w.buf = nil
+	}
+}
+
+// writeLine is called with mu held
+func (w *prefixWriter) writeLine(line []byte) {
+	fmt.Fprintf(w.out, "%s%s", w.prefix, line)
+}
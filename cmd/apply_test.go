@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_prefixWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := &prefixWriter{mu: &sync.Mutex{}, out: out, prefix: "[node-1] "}
+
+	w.Write([]byte("Running: k3sup join\nOut"))
+	w.Write([]byte("put: ok\npartial"))
+	w.Flush()
+
+	want := "[node-1] Running: k3sup join\n[node-1] Output: ok\n[node-1] partial\n"
+	if out.String() != want {
+		t.Errorf("want\n%q\ngot\n%q", want, out.String())
+	}
+}
+
+func Test_printApplyResults(t *testing.T) {
+	steps := []planStep{
+		{Name: "node-1", Host: Host{Hostname: "node-1", IP: "10.0.0.1"}, Role: "server"},
+		{Name: "10.0.0.2", Host: Host{IP: "10.0.0.2"}, Role: "agent"},
+		{Name: "10.0.0.3", Host: Host{IP: "10.0.0.3"}, Role: "agent"},
+	}
+	results := []applyResult{
+		{Status: "ok", Duration: time.Minute},
+		{Status: "failed", Duration: time.Second, Err: errors.New("exit status 1")},
+		{},
+	}
+
+	out := &bytes.Buffer{}
+	printApplyResults(out, steps, results)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("want a header and 3 rows, got %q", out.String())
+	}
+	for i, want := range []string{"OK", "FAILED", "SKIPPED"} {
+		if !strings.Contains(lines[i+1], want) {
+			t.Errorf("row %d: want %s, got %q", i+1, want, lines[i+1])
+		}
+	}
+	if !strings.Contains(lines[2], "exit status 1") {
+		t.Errorf("want the error in the row, got %q", lines[2])
+	}
+}
+
+func Test_apply_joinArgs(t *testing.T) {
+	useTempClusterStateDir(t)
+
+	a := &apply{
+		steps: []planStep{
+			{Name: "node-1", Host: Host{IP: "10.0.0.1"}, Role: "server", User: "ubuntu", SSHPort: 2222},
+			{Name: "node-2", Host: Host{IP: "10.0.0.2"}, Role: "agent", User: "pi"},
+		},
+		cluster: "prod",
+	}
+
+	// The cluster was not recorded, so the first server is given
+	got := a.joinArgs("/tmp/token")
+	want := []string{"--node-token-path", "/tmp/token", "--server-host", "10.0.0.1", "--server-user", "ubuntu", "--server-ssh-port", "2222"}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+
+	if err := updateClusterRecord("prod", func(record *clusterRecord) error {
+		record.setNode(clusterNode{Host: "10.0.0.1", Role: "server", User: "ubuntu", SSHPort: 2222})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	got = a.joinArgs("/tmp/token")
+	want = []string{"--node-token-path", "/tmp/token", "--cluster", "prod"}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
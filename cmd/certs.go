@@ -0,0 +1,479 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alexellis/k3sup/pkg"
+	operator "github.com/alexellis/k3sup/pkg/operator"
+	"github.com/spf13/cobra"
+)
+
+const (
+	certValid    = "ok"
+	certExpiring = "expiring"
+	certExpired  = "expired"
+)
+
+// certExpiry is the expiry of a certificate on a node or in a kubeconfig
+type certExpiry struct {
+	Source   string    `json:"source"`
+	File     string    `json:"file"`
+	Subject  string    `json:"subject"`
+	NotAfter time.Time `json:"notAfter"`
+	Days     int       `json:"days"`
+	Status   string    `json:"status"`
+}
+
+// MakeCerts creates the certs parent command
+func MakeCerts() *cobra.Command {
+	var command = &cobra.Command{
+		Use:   "certs",
+		Short: "Check and rotate the certificates of a cluster",
+		Long: `Check when the certificates of a cluster expire, and rotate them.
+
+K3s client and server certificates are valid for a year. The client
+certificate in a kubeconfig written by install or get-config expires
+along with them.
+
+` + pkg.SupportMessageShort + `
+`,
+		SilenceUsage: true,
+	}
+
+	return command
+}
+
+// MakeCertsCheck creates the certs check command
+func MakeCertsCheck() *cobra.Command {
+	var command = &cobra.Command{
+		Use:   "check",
+		Short: "Report when certificates expire",
+		Long: `Report when the certificates in the TLS directories of each node, and
+in local kubeconfig files, expire.
+
+The command exits non-zero when a certificate has expired.
+
+` + pkg.SupportMessageShort + `
+`,
+		Example: `  # Check the servers and agents of a cluster
+  k3sup certs check --host SERVER_1,SERVER_2,AGENT_1
+
+  # Check a local kubeconfig only
+  k3sup certs check --kubeconfig ~/.kube/config
+
+  # Warn about certificates which expire within 60 days, as JSON
+  k3sup certs check --host SERVER_1 --warn-within 1440h --output json`,
+		SilenceUsage: true,
+	}
+
+	command.Flags().StringSlice("host", []string{}, "Hostname or IP of each node, repeat the flag or give a comma-separated list")
+	command.Flags().StringSlice("kubeconfig", []string{}, "Local kubeconfig file to check, repeat the flag or give a comma-separated list")
+	command.Flags().String("user", "root", "Username for SSH login")
+	command.Flags().String("ssh-key", "~/.ssh/id_rsa", "The ssh key to use for remote login")
+	command.Flags().Int("ssh-port", 22, "The port on which to connect for ssh")
+	command.Flags().Bool("sudo", true, "Use sudo for commands. e.g. set to false when using the root user and no sudo is available.")
+	command.Flags().Bool("print-command", false, "Print the commands to be executed")
+	command.Flags().String("server-data-dir", "/var/lib/rancher/k3s/", "Data directory of K3s on each node")
+
+	command.Flags().Duration("warn-within", time.Hour*24*90, "Report certificates which expire within this time")
+	command.Flags().StringP("output", "o", "table", "Output format: table or json")
+
+	command.PreRunE = func(command *cobra.Command, args []string) error {
+		hosts, _ := command.Flags().GetStringSlice("host")
+		kubeconfigs, _ := command.Flags().GetStringSlice("kubeconfig")
+		if len(hosts) == 0 && len(kubeconfigs) == 0 {
+			return fmt.Errorf("give at least one node with --host, or a kubeconfig with --kubeconfig")
+		}
+
+		output, _ := command.Flags().GetString("output")
+		if output != "table" && output != "json" {
+			return fmt.Errorf("--output must be table or json, got: %q", output)
+		}
+
+		return nil
+	}
+
+	command.RunE = func(command *cobra.Command, args []string) error {
+		hosts, _ := command.Flags().GetStringSlice("host")
+		kubeconfigs, _ := command.Flags().GetStringSlice("kubeconfig")
+		user, _ := command.Flags().GetString("user")
+		sshKey, _ := command.Flags().GetString("ssh-key")
+		port, _ := command.Flags().GetInt("ssh-port")
+		dataDir, _ := command.Flags().GetString("server-data-dir")
+		warnWithin, _ := command.Flags().GetDuration("warn-within")
+		output, _ := command.Flags().GetString("output")
+		sudoPrefix, printCommand := serverOptions(command)
+
+		sshKeyPath := expandPath(sshKey)
+		now := time.Now()
+
+		expiries := []certExpiry{}
+		for _, host := range hosts {
+			address := fmt.Sprintf("%s:%d", host, port)
+			sshOperator, sshOperatorDone, errored, err := connectOperator(user, address, sshKeyPath)
+			if errored {
+				return fmt.Errorf("%s: %w", host, err)
+			}
+
+			res, err := executeCommand(sshOperator, makeListCertificatesCommand(sudoPrefix, dataDir), printCommand)
+			if sshOperatorDone != nil {
+				sshOperatorDone()
+			}
+			if err != nil {
+				return fmt.Errorf("%s: unable to read certificates: %w", host, err)
+			}
+
+			found := parseCertificateFiles(host, string(res.StdOut))
+			if len(found) == 0 {
+				fmt.Fprintf(os.Stderr, "No certificates found on %s in %s\n", host, dataDir)
+			}
+			expiries = append(expiries, found...)
+		}
+
+		for _, kubeconfig := range kubeconfigs {
+			kubeconfig = expandPath(kubeconfig)
+
+			data, err := os.ReadFile(kubeconfig)
+			if err != nil {
+				return err
+			}
+
+			found, err := kubeconfigCertificates(kubeconfig, data)
+			if err != nil {
+				return fmt.Errorf("%s: %w", kubeconfig, err)
+			}
+			expiries = append(expiries, found...)
+		}
+
+		expired := 0
+		for i := range expiries {
+			expiries[i].Days, expiries[i].Status = certStatus(expiries[i].NotAfter, now, warnWithin)
+			if expiries[i].Status == certExpired {
+				expired++
+			}
+		}
+
+		if output == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(expiries); err != nil {
+				return err
+			}
+		} else {
+			printCertExpiries(os.Stdout, expiries)
+		}
+
+		if expired > 0 {
+			return fmt.Errorf("%d certificates have expired, rotate them with: k3sup certs rotate", expired)
+		}
+
+		return nil
+	}
+
+	return command
+}
+
+// MakeCertsRotate creates the certs rotate command
+func MakeCertsRotate() *cobra.Command {
+	var command = &cobra.Command{
+		Use:   "rotate",
+		Short: "Rotate the certificates of each node, and fetch a new kubeconfig",
+		Long: `Rotate the certificates of a cluster.
+
+K3s is stopped on one server at a time, k3s certificate rotate is run,
+then K3s is started and must be ready before the next server. Agents
+request new certificates from the servers when they are restarted, so
+each agent is restarted one at a time afterwards.
+
+The kubeconfig is then fetched again from the first server, since its
+client certificate has changed.
+
+` + pkg.SupportMessageShort + `
+`,
+		Example: `  k3sup certs rotate \
+    --server SERVER_1,SERVER_2,SERVER_3 \
+    --agent AGENT_1,AGENT_2 \
+    --local-path ~/.kube/config --merge --context k3s-prod`,
+		SilenceUsage: true,
+	}
+
+	command.Flags().StringSlice("server", []string{}, "Hostname or IP of each server, repeat the flag or give a comma-separated list")
+	command.Flags().StringSlice("agent", []string{}, "Hostname or IP of each agent, repeat the flag or give a comma-separated list")
+	command.Flags().String("user", "root", "Username for SSH login")
+	command.Flags().String("ssh-key", "~/.ssh/id_rsa", "The ssh key to use for remote login")
+	command.Flags().Int("ssh-port", 22, "The port on which to connect for ssh")
+	command.Flags().Bool("sudo", true, "Use sudo for commands. e.g. set to false when using the root user and no sudo is available.")
+	command.Flags().Bool("print-command", false, "Print the commands to be executed")
+	command.Flags().String("server-data-dir", "/var/lib/rancher/k3s/", "Data directory of K3s on each server")
+
+	command.Flags().String("local-path", "kubeconfig", "Local path to save the kubeconfig file")
+	command.Flags().String("context", "default", "Set the name of the kubeconfig context.")
+	command.Flags().Bool("merge", false, `Merge the config with existing kubeconfig if it already exists.
+Provide the --local-path flag with --merge if a kubeconfig already exists in some other directory`)
+	command.Flags().String("api-server-url", "", "URL of the API server to write into the kubeconfig, if different from the first server")
+
+	command.Flags().Int("attempts", 60, "Number of attempts to check if a server is ready after restarting it")
+	command.Flags().Duration("pause", time.Second*2, "Pause between checking a server for readiness")
+
+	command.PreRunE = func(command *cobra.Command, args []string) error {
+		servers, _ := command.Flags().GetStringSlice("server")
+		if len(servers) == 0 {
+			return fmt.Errorf("give every server with --server")
+		}
+
+		if apiServerURL, _ := command.Flags().GetString("api-server-url"); len(apiServerURL) > 0 {
+			if _, err := parseAPIServerURL(apiServerURL); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	command.RunE = func(command *cobra.Command, args []string) error {
+		servers, _ := command.Flags().GetStringSlice("server")
+		agents, _ := command.Flags().GetStringSlice("agent")
+		user, _ := command.Flags().GetString("user")
+		sshKey, _ := command.Flags().GetString("ssh-key")
+		port, _ := command.Flags().GetInt("ssh-port")
+		dataDir, _ := command.Flags().GetString("server-data-dir")
+		localKubeconfig, _ := command.Flags().GetString("local-path")
+		context, _ := command.Flags().GetString("context")
+		merge, _ := command.Flags().GetBool("merge")
+		apiServerURL, _ := command.Flags().GetString("api-server-url")
+		attempts, _ := command.Flags().GetInt("attempts")
+		pause, _ := command.Flags().GetDuration("pause")
+		sudoPrefix, printCommand := serverOptions(command)
+
+		sshKeyPath := expandPath(sshKey)
+
+		connect := func(host string) (*operator.SSHOperator, DoneFunc, error) {
+			address := fmt.Sprintf("%s:%d", host, port)
+			sshOperator, sshOperatorDone, errored, err := connectOperator(user, address, sshKeyPath)
+			if errored {
+				return nil, nil, fmt.Errorf("%s: %w", host, err)
+			}
+			return sshOperator, sshOperatorDone, nil
+		}
+
+		for i, server := range servers {
+			fmt.Printf("[server %d/%d] Rotating certificates on %s\n", i+1, len(servers), server)
+
+			sshOperator, sshOperatorDone, err := connect(server)
+			if err != nil {
+				return err
+			}
+
+			err = rotateServerCertificates(sshOperator, sudoPrefix, dataDir, printCommand)
+			if err == nil {
+				err = waitForServerReady(sshOperator, sudoPrefix, attempts, pause, printCommand)
+			}
+
+			if sshOperatorDone != nil {
+				sshOperatorDone()
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", server, err)
+			}
+		}
+
+		for i, agent := range agents {
+			fmt.Printf("[agent %d/%d] Restarting %s\n", i+1, len(agents), agent)
+
+			sshOperator, sshOperatorDone, err := connect(agent)
+			if err != nil {
+				return err
+			}
+
+			_, err = executeCommand(sshOperator, fmt.Sprintf("%ssystemctl restart k3s-agent\n", sudoPrefix), printCommand)
+			if sshOperatorDone != nil {
+				sshOperatorDone()
+			}
+			if err != nil {
+				return fmt.Errorf("%s: unable to restart k3s-agent: %w", agent, err)
+			}
+		}
+
+		sshOperator, sshOperatorDone, err := connect(servers[0])
+		if err != nil {
+			return err
+		}
+		if sshOperatorDone != nil {
+			defer sshOperatorDone()
+		}
+
+		getConfigcommand := fmt.Sprintf("%scat /etc/rancher/k3s/k3s.yaml\n", sudoPrefix)
+		if err := obtainKubeconfig(os.Stdout, sshOperator, getConfigcommand, servers[0], context, localKubeconfig, apiServerURL, merge, false); err != nil {
+			return err
+		}
+
+		fmt.Printf("Rotated certificates on %d servers and restarted %d agents\n", len(servers), len(agents))
+
+		return nil
+	}
+
+	return command
+}
+
+// rotateServerCertificates rotates the certificates of a server, which
+// must be stopped for k3s certificate rotate to run
+func rotateServerCertificates(op operator.CommandOperator, sudoPrefix, dataDir string, printCommand bool) error {
+	if _, err := executeCommand(op, fmt.Sprintf("%ssystemctl stop k3s\n", sudoPrefix), printCommand); err != nil {
+		return fmt.Errorf("unable to stop K3s: %w", err)
+	}
+
+	rotateCommand := fmt.Sprintf("%sk3s certificate rotate --data-dir %s 2>&1\n", sudoPrefix, dataDir)
+	_, rotateErr := executeCommand(op, rotateCommand, printCommand)
+
+	// K3s is started again even if the rotation failed
+	if _, err := executeCommand(op, fmt.Sprintf("%ssystemctl start k3s\n", sudoPrefix), printCommand); err != nil {
+		return fmt.Errorf("unable to start K3s: %w", err)
+	}
+
+	if rotateErr != nil {
+		return fmt.Errorf("unable to rotate certificates: %w", rotateErr)
+	}
+
+	return nil
+}
+
+// makeListCertificatesCommand gives a command which prints each
+// certificate of a server or agent, after a line with its path
+func makeListCertificatesCommand(sudoPrefix, dataDir string) string {
+	script := fmt.Sprintf(`for f in $(find %s %s -maxdepth 2 -name "*.crt" 2>/dev/null | sort); do echo "# $f"; cat "$f"; done`,
+		path.Join(dataDir, "server/tls"), path.Join(dataDir, "agent"))
+
+	return fmt.Sprintf("%ssh -c %s\n", sudoPrefix, shellQuote(script))
+}
+
+// parseCertificateFiles reads the output of makeListCertificatesCommand,
+// giving the expiry of the first certificate in each file
+func parseCertificateFiles(source, out string) []certExpiry {
+	files := []string{}
+	contents := map[string]string{}
+
+	current := ""
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "# ") {
+			current = strings.TrimPrefix(line, "# ")
+			files = append(files, current)
+			continue
+		}
+		if len(current) > 0 {
+			contents[current] += line + "\n"
+		}
+	}
+
+	expiries := []certExpiry{}
+	for _, file := range files {
+		cert := firstCertificate([]byte(contents[file]))
+		if cert == nil {
+			continue
+		}
+
+		expiries = append(expiries, certExpiry{
+			Source:   source,
+			File:     file,
+			Subject:  cert.Subject.CommonName,
+			NotAfter: cert.NotAfter,
+		})
+	}
+
+	return expiries
+}
+
+// kubeconfigCertificates gives the expiry of each user's client
+// certificate in a kubeconfig
+func kubeconfigCertificates(source string, data []byte) ([]certExpiry, error) {
+	config, err := parseKubeconfig(data)
+	if err != nil {
+		return nil, err
+	}
+
+	expiries := []certExpiry{}
+	for _, user := range config.Users {
+		encoded, ok := user.User["client-certificate-data"].(string)
+		if !ok {
+			continue
+		}
+
+		pemData, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode the client certificate of user %s: %w", user.Name, err)
+		}
+
+		cert := firstCertificate(pemData)
+		if cert == nil {
+			return nil, fmt.Errorf("no client certificate found for user %s", user.Name)
+		}
+
+		expiries = append(expiries, certExpiry{
+			Source:   source,
+			File:     "user " + user.Name,
+			Subject:  cert.Subject.CommonName,
+			NotAfter: cert.NotAfter,
+		})
+	}
+
+	return expiries, nil
+}
+
+func firstCertificate(data []byte) *x509.Certificate {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil
+		}
+		return cert
+	}
+}
+
+// certStatus gives the number of whole days until notAfter, and whether
+// the certificate is valid, expiring within warnWithin, or expired
+func certStatus(notAfter, now time.Time, warnWithin time.Duration) (int, string) {
+	remaining := notAfter.Sub(now)
+	days := int(remaining.Hours() / 24)
+
+	switch {
+	case remaining <= 0:
+		return days, certExpired
+	case remaining <= warnWithin:
+		return days, certExpiring
+	default:
+		return days, certValid
+	}
+}
+
+func printCertExpiries(w io.Writer, expiries []certExpiry) {
+	sort.SliceStable(expiries, func(i, j int) bool {
+		return expiries[i].NotAfter.Before(expiries[j].NotAfter)
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "SOURCE\tFILE\tSUBJECT\tEXPIRES\tDAYS\tSTATUS\n")
+	for _, e := range expiries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n",
+			e.Source, e.File, e.Subject, e.NotAfter.Format("2006-01-02"), e.Days, strings.ToUpper(e.Status))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeTestCertificate(t *testing.T, commonName string, notAfter time.Time) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    notAfter.Add(-time.Hour * 24 * 365),
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func Test_parseCertificateFiles(t *testing.T) {
+	notAfter := time.Date(2027, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	out := "# /var/lib/rancher/k3s/server/tls/client-admin.crt\n" +
+		string(makeTestCertificate(t, "system:admin", notAfter)) +
+		"# /var/lib/rancher/k3s/server/tls/empty.crt\n" +
+		"# /var/lib/rancher/k3s/agent/serving-kubelet.crt\n" +
+		string(makeTestCertificate(t, "k3s-1", notAfter.Add(time.Hour*24)))
+
+	got := parseCertificateFiles("10.0.0.1", out)
+	if len(got) != 2 {
+		t.Fatalf("want 2 certificates, got %d: %+v", len(got), got)
+	}
+
+	if got[0].File != "/var/lib/rancher/k3s/server/tls/client-admin.crt" || got[0].Subject != "system:admin" {
+		t.Errorf("unexpected first certificate: %+v", got[0])
+	}
+	if !got[0].NotAfter.Equal(notAfter) {
+		t.Errorf("want expiry %s, got %s", notAfter, got[0].NotAfter)
+	}
+	if got[1].Subject != "k3s-1" || got[1].Source != "10.0.0.1" {
+		t.Errorf("unexpected second certificate: %+v", got[1])
+	}
+}
+
+func Test_kubeconfigCertificates(t *testing.T) {
+	notAfter := time.Date(2027, 1, 2, 0, 0, 0, 0, time.UTC)
+	certData := base64.StdEncoding.EncodeToString(makeTestCertificate(t, "system:admin", notAfter))
+
+	kubeconfig := `apiVersion: v1
+kind: Config
+users:
+- name: default
+  user:
+    client-certificate-data: ` + certData + `
+- name: scoped
+  user:
+    token: abc
+`
+
+	got, err := kubeconfigCertificates("kubeconfig", []byte(kubeconfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("want 1 certificate, got %d", len(got))
+	}
+	if got[0].File != "user default" || !got[0].NotAfter.Equal(notAfter) {
+		t.Errorf("unexpected certificate: %+v", got[0])
+	}
+}
+
+func Test_certStatus(t *testing.T) {
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	warnWithin := time.Hour * 24 * 90
+
+	tests := []struct {
+		notAfter   time.Time
+		wantDays   int
+		wantStatus string
+	}{
+		{notAfter: now.Add(time.Hour * 24 * 200), wantDays: 200, wantStatus: certValid},
+		{notAfter: now.Add(time.Hour * 24 * 30), wantDays: 30, wantStatus: certExpiring},
+		{notAfter: now.Add(-time.Hour * 24 * 2), wantDays: -2, wantStatus: certExpired},
+	}
+
+	for _, tc := range tests {
+		days, status := certStatus(tc.notAfter, now, warnWithin)
+		if days != tc.wantDays || status != tc.wantStatus {
+			t.Errorf("%s: want %d %s, got %d %s", tc.notAfter, tc.wantDays, tc.wantStatus, days, status)
+		}
+	}
+}
+
+func Test_makeListCertificatesCommand(t *testing.T) {
+	got := makeListCertificatesCommand("sudo ", "/var/lib/rancher/k3s/")
+
+	if !strings.HasPrefix(got, "sudo sh -c '") {
+		t.Errorf("want the script to run with sudo, got: %s", got)
+	}
+	if !strings.Contains(got, "/var/lib/rancher/k3s/server/tls /var/lib/rancher/k3s/agent") {
+		t.Errorf("want the server and agent directories, got: %s", got)
+	}
+}
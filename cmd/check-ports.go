@@ -0,0 +1,377 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alexellis/k3sup/pkg"
+	operator "github.com/alexellis/k3sup/pkg/operator"
+	"github.com/spf13/cobra"
+)
+
+const (
+	portBlocked = "blocked"
+	portUnknown = "unknown"
+)
+
+// portCheckScript listens on, or probes ports. It is run with python3,
+// which is available on most distributions, and uses no single quotes
+// so that it can be passed to python3 -c.
+const portCheckScript = `
+import socket, sys, threading, time
+
+def listen_tcp(port, results):
+    try:
+        s = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
+        s.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+        s.bind(("0.0.0.0", port))
+        s.listen(64)
+    except OSError:
+        results.append("tcp/%d in-use" % port)
+        return
+    results.append("tcp/%d listening" % port)
+    while True:
+        c, _ = s.accept()
+        c.close()
+
+def listen_udp(port, results):
+    try:
+        s = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+        s.bind(("0.0.0.0", port))
+    except OSError:
+        results.append("udp/%d in-use" % port)
+        return
+    results.append("udp/%d listening" % port)
+    while True:
+        data, addr = s.recvfrom(64)
+        s.sendto(data, addr)
+
+def probe(host, proto, port, timeout, out):
+    try:
+        if proto == "tcp":
+            socket.create_connection((host, port), timeout=timeout).close()
+            out.append("%s %s/%d open" % (host, proto, port))
+            return
+        info = socket.getaddrinfo(host, port, 0, socket.SOCK_DGRAM)[0]
+        s = socket.socket(info[0], socket.SOCK_DGRAM)
+        s.settimeout(timeout / 3.0)
+        for i in range(3):
+            s.sendto(b"k3sup", info[4])
+            try:
+                s.recvfrom(64)
+                out.append("%s %s/%d open" % (host, proto, port))
+                return
+            except socket.timeout:
+                pass
+    except Exception:
+        pass
+    out.append("%s %s/%d blocked" % (host, proto, port))
+
+mode = sys.argv[1]
+if mode == "listen":
+    duration = float(sys.argv[3])
+    results = []
+    for spec in sys.argv[4:]:
+        proto, port = spec.split("/")
+        fn = listen_tcp if proto == "tcp" else listen_udp
+        threading.Thread(target=fn, args=(int(port), results), daemon=True).start()
+    time.sleep(0.5)
+    with open(sys.argv[2], "w") as f:
+        f.write("\n".join(results) + "\n")
+    time.sleep(duration)
+else:
+    timeout = float(sys.argv[2])
+    out = []
+    threads = []
+    for spec in sys.argv[3:]:
+        host, proto, port = spec.split(",")
+        t = threading.Thread(target=probe, args=(host, proto, int(port), timeout, out))
+        t.start()
+        threads.append(t)
+    for t in threads:
+        t.join()
+    print("\n".join(out))
+`
+
+// portCheckResults is written by the listener on each node
+const portCheckResults = "/tmp/k3sup-check-ports.txt"
+
+// portPath is a port which must be reachable from one node to another
+type portPath struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Port   string `json:"port"`
+	Status string `json:"status"`
+}
+
+// MakeCheckPorts creates the check-ports command
+func MakeCheckPorts() *cobra.Command {
+	var command = &cobra.Command{
+		Use:   "check-ports",
+		Short: "Check the ports K3s needs are open between nodes",
+		Long: `Check the ports K3s needs are open between each pair of nodes, before
+installing anything.
+
+k3sup connects to each node over SSH, briefly listens on the ports its
+role needs, then probes them from every other node. The result is a
+matrix of open and blocked paths. python3 is required on each node.
+
+Servers need 6443/tcp and 10250/tcp from all nodes, and 2379-2380/tcp
+from other servers for embedded etcd. Agents need 10250/tcp from the
+servers. All nodes need 8472/udp for the vxlan backend of flannel, or 51820/udp for the
+wireguard-native backend.
+
+The input file is the same as for the plan command.
+
+` + pkg.SupportMessageShort + `
+`,
+		Example: `  # Check a cluster where the first 3 hosts will be servers
+  k3sup check-ports hosts.json --servers 3 --user ubuntu
+
+  # Check the ports for the wireguard-native backend, as JSON
+  k3sup check-ports hosts.json --flannel-backend wireguard-native \
+    --output json`,
+		SilenceUsage: true,
+	}
+
+	command.Flags().Int("servers", 3, "Number of servers to use from the devices file")
+	command.Flags().String("user", "root", "Username for SSH login, unless set for the host in the devices file")
+	command.Flags().String("ssh-key", "~/.ssh/id_rsa", "The ssh key to use for remote login, unless set for the host in the devices file")
+	command.Flags().Int("ssh-port", 22, "The port on which to connect for ssh, unless set for the host in the devices file")
+	command.Flags().String("flannel-backend", "vxlan", "Flannel backend that will be used: vxlan or wireguard-native")
+	command.Flags().Duration("timeout", time.Second*3, "Timeout for each probe")
+	command.Flags().StringP("output", "o", "table", "Output format: table or json")
+
+	command.PreRunE = func(command *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return fmt.Errorf("give a path to a devices file, in JSON, YAML, CSV or Ansible inventory format")
+		}
+
+		backend, _ := command.Flags().GetString("flannel-backend")
+		if backend != "vxlan" && backend != "wireguard-native" {
+			return fmt.Errorf("--flannel-backend must be vxlan or wireguard-native, got: %q", backend)
+		}
+
+		output, _ := command.Flags().GetString("output")
+		if output != "table" && output != "json" {
+			return fmt.Errorf("--output must be table or json, got: %q", output)
+		}
+
+		return nil
+	}
+
+	command.RunE = func(command *cobra.Command, args []string) error {
+		hosts, err := readHosts(args[0])
+		if err != nil {
+			return err
+		}
+		if len(hosts) < 2 {
+			return fmt.Errorf("at least two hosts are needed to check the ports between them")
+		}
+
+		servers, _ := command.Flags().GetInt("servers")
+		user, _ := command.Flags().GetString("user")
+		sshKey, _ := command.Flags().GetString("ssh-key")
+		sshPort, _ := command.Flags().GetInt("ssh-port")
+		backend, _ := command.Flags().GetString("flannel-backend")
+		timeout, _ := command.Flags().GetDuration("timeout")
+		output, _ := command.Flags().GetString("output")
+
+		roles := assignRoles(hosts, servers)
+
+		operators := map[string]operator.CommandOperator{}
+		for _, host := range hosts {
+			sshOperator, done, err := connectHost(host, user, sshPort, sshKey)
+			if err != nil {
+				return err
+			}
+			defer done()
+			operators[host.Address()] = sshOperator
+		}
+
+		// Listen for long enough for every node to probe every other
+		duration := time.Second*10 + time.Duration(len(hosts))*timeout
+		inUse := map[string]map[string]bool{}
+
+		for _, host := range hosts {
+			ports := listenPorts(roles[host.Address()], backend)
+			// The listener runs in the background, so writes which ports it
+			// could listen on to a file, which also names it for pkill
+			listenCommand := fmt.Sprintf("rm -f %s && nohup python3 -c '%s' listen %s %d %s > /dev/null 2>&1 < /dev/null &\nsleep 2 && cat %s\n",
+				portCheckResults, portCheckScript, portCheckResults, int(duration.Seconds()), strings.Join(ports, " "), portCheckResults)
+
+			res, err := operators[host.Address()].ExecuteStdio(listenCommand, false)
+			if err != nil {
+				return fmt.Errorf("unable to listen on %s: %w", host.Address(), err)
+			}
+
+			inUse[host.Address()] = parseListenResults(string(res.StdOut))
+		}
+
+		paths := []portPath{}
+		for _, source := range hosts {
+			specs := []string{}
+			for _, target := range hosts {
+				if target.Address() == source.Address() {
+					continue
+				}
+				for _, port := range requiredPorts(roles[source.Address()], roles[target.Address()], backend) {
+					proto, number, _ := strings.Cut(port, "/")
+					specs = append(specs, fmt.Sprintf("%s,%s,%s", target.Address(), proto, number))
+				}
+			}
+
+			probeCommand := fmt.Sprintf("python3 -c '%s' probe %.1f %s\n",
+				portCheckScript, timeout.Seconds(), strings.Join(specs, " "))
+
+			res, err := operators[source.Address()].ExecuteStdio(probeCommand, false)
+			if err != nil {
+				return fmt.Errorf("unable to probe ports from %s: %w", source.Address(), err)
+			}
+
+			paths = append(paths, parseProbeResults(source.Address(), string(res.StdOut), inUse)...)
+		}
+
+		for _, host := range hosts {
+			// The brackets stop pkill from matching its own shell
+			operators[host.Address()].ExecuteStdio(fmt.Sprintf("pkill -f '%s' || true\n", strings.Replace(portCheckResults, ".", "[.]", 1)), false)
+			operators[host.Address()].ExecuteStdio(fmt.Sprintf("rm -f %s\n", portCheckResults), false)
+		}
+
+		sortPortPaths(paths)
+
+		if output == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(paths); err != nil {
+				return err
+			}
+		} else {
+			printPortPaths(os.Stdout, paths, roles)
+		}
+
+		blocked := 0
+		for _, p := range paths {
+			if p.Status == portBlocked {
+				blocked++
+			}
+		}
+		if blocked > 0 {
+			return fmt.Errorf("%d of %d paths are blocked", blocked, len(paths))
+		}
+
+		return nil
+	}
+
+	return command
+}
+
+// assignRoles gives the role of each host by its address, as the plan
+// command would
+func assignRoles(hosts []Host, servers int) map[string]string {
+	roles := map[string]string{}
+	for i, role := range hostRoles(hosts, servers) {
+		roles[hosts[i].Address()] = role
+	}
+	return roles
+}
+
+func flannelPort(backend string) string {
+	if backend == "wireguard-native" {
+		return "udp/51820"
+	}
+	return "udp/8472"
+}
+
+// listenPorts gives the ports a node listens on for its role
+func listenPorts(role, backend string) []string {
+	if role == "server" {
+		return []string{"tcp/6443", "tcp/10250", "tcp/2379", "tcp/2380", flannelPort(backend)}
+	}
+	return []string{"tcp/10250", flannelPort(backend)}
+}
+
+// requiredPorts gives the ports which must be reachable from a node with
+// the source role to a node with the target role. The kubelet is only
+// reached from, and reaches, the servers.
+func requiredPorts(source, target, backend string) []string {
+	ports := []string{}
+	if target == "server" {
+		ports = append(ports, "tcp/6443")
+		if source == "server" {
+			ports = append(ports, "tcp/2379", "tcp/2380")
+		}
+	}
+	if source == "server" || target == "server" {
+		ports = append(ports, "tcp/10250")
+	}
+
+	return append(ports, flannelPort(backend))
+}
+
+// parseListenResults gives the ports which could not be listened on,
+// as they were already in use
+func parseListenResults(out string) map[string]bool {
+	inUse := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == "in-use" {
+			inUse[fields[0]] = true
+		}
+	}
+	return inUse
+}
+
+// parseProbeResults reads the lines printed by a probe. A UDP port which
+// was already in use on the target cannot be checked, since nothing
+// replies to the probe, so is reported as unknown.
+func parseProbeResults(source, out string, inUse map[string]map[string]bool) []portPath {
+	paths := []portPath{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+
+		target, port, status := fields[0], fields[1], fields[2]
+		if status == portBlocked && strings.HasPrefix(port, "udp/") && inUse[target][port] {
+			status = portUnknown
+		}
+
+		paths = append(paths, portPath{
+			Source: source,
+			Target: target,
+			Port:   port,
+			Status: status,
+		})
+	}
+	return paths
+}
+
+func sortPortPaths(paths []portPath) {
+	sort.SliceStable(paths, func(i, j int) bool {
+		if paths[i].Source != paths[j].Source {
+			return paths[i].Source < paths[j].Source
+		}
+		if paths[i].Target != paths[j].Target {
+			return paths[i].Target < paths[j].Target
+		}
+		return paths[i].Port < paths[j].Port
+	})
+}
+
+func printPortPaths(w io.Writer, paths []portPath, roles map[string]string) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "SOURCE\tTARGET\tPORT\tSTATUS\n")
+	for _, p := range paths {
+		fmt.Fprintf(tw, "%s (%s)\t%s (%s)\t%s\t%s\n",
+			p.Source, roles[p.Source], p.Target, roles[p.Target], p.Port, strings.ToUpper(p.Status))
+	}
+	tw.Flush()
+}
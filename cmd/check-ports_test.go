@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_requiredPorts(t *testing.T) {
+	tests := []struct {
+		title   string
+		source  string
+		target  string
+		backend string
+		want    []string
+	}{
+		{
+			title:   "server to server needs etcd",
+			source:  "server",
+			target:  "server",
+			backend: "vxlan",
+			want:    []string{"tcp/6443", "tcp/2379", "tcp/2380", "tcp/10250", "udp/8472"},
+		},
+		{
+			title:   "agent to server does not need etcd",
+			source:  "agent",
+			target:  "server",
+			backend: "vxlan",
+			want:    []string{"tcp/6443", "tcp/10250", "udp/8472"},
+		},
+		{
+			title:   "server to agent needs the kubelet",
+			source:  "server",
+			target:  "agent",
+			backend: "wireguard-native",
+			want:    []string{"tcp/10250", "udp/51820"},
+		},
+		{
+			title:   "agent to agent only needs flannel",
+			source:  "agent",
+			target:  "agent",
+			backend: "vxlan",
+			want:    []string{"udp/8472"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.title, func(t *testing.T) {
+			got := requiredPorts(tc.source, tc.target, tc.backend)
+			if !reflect.DeepEqual(tc.want, got) {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func Test_listenPorts_CoverRequiredPorts(t *testing.T) {
+	for _, target := range []string{"server", "agent"} {
+		listening := map[string]bool{}
+		for _, port := range listenPorts(target, "vxlan") {
+			listening[port] = true
+		}
+
+		for _, source := range []string{"server", "agent"} {
+			for _, port := range requiredPorts(source, target, "vxlan") {
+				if !listening[port] {
+					t.Errorf("%s does not listen on %s, needed from %s", target, port, source)
+				}
+			}
+		}
+	}
+}
+
+func Test_assignRoles(t *testing.T) {
+	hosts := []Host{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}, {IP: "10.0.0.3"}}
+
+	got := assignRoles(hosts, 1)
+	want := map[string]string{"10.0.0.1": "server", "10.0.0.2": "agent", "10.0.0.3": "agent"}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
+
+func Test_assignRoles_HostRoles(t *testing.T) {
+	hosts := []Host{{IP: "10.0.0.1", Role: "agent"}, {IP: "10.0.0.2"}, {Hostname: "node-3", Role: "server"}}
+
+	got := assignRoles(hosts, 2)
+	want := map[string]string{"10.0.0.1": "agent", "10.0.0.2": "server", "node-3": "server"}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
+
+func Test_parseProbeResults_UDPInUseIsUnknown(t *testing.T) {
+	inUse := map[string]map[string]bool{
+		"10.0.0.2": parseListenResults("tcp/10250 listening\nudp/8472 in-use\n"),
+	}
+
+	out := `10.0.0.2 tcp/10250 open
+10.0.0.2 udp/8472 blocked
+10.0.0.3 udp/8472 blocked
+`
+	got := parseProbeResults("10.0.0.1", out, inUse)
+	want := []portPath{
+		{Source: "10.0.0.1", Target: "10.0.0.2", Port: "tcp/10250", Status: "open"},
+		{Source: "10.0.0.1", Target: "10.0.0.2", Port: "udp/8472", Status: portUnknown},
+		{Source: "10.0.0.1", Target: "10.0.0.3", Port: "udp/8472", Status: portBlocked},
+	}
+
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
+
+func Test_printPortPaths(t *testing.T) {
+	paths := []portPath{
+		{Source: "10.0.0.2", Target: "10.0.0.1", Port: "tcp/6443", Status: portBlocked},
+		{Source: "10.0.0.1", Target: "10.0.0.2", Port: "tcp/10250", Status: "open"},
+	}
+	roles := map[string]string{"10.0.0.1": "server", "10.0.0.2": "agent"}
+
+	sortPortPaths(paths)
+
+	buf := bytes.Buffer{}
+	printPortPaths(&buf, paths, roles)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("want 3 lines, got: %q", buf.String())
+	}
+	if !strings.HasPrefix(lines[1], "10.0.0.1 (server)") || !strings.HasSuffix(lines[1], "OPEN") {
+		t.Errorf("unexpected first row: %q", lines[1])
+	}
+	if !strings.HasSuffix(lines[2], "BLOCKED") {
+		t.Errorf("unexpected second row: %q", lines[2])
+	}
+}
@@ -0,0 +1,565 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// clusterStateDir holds a directory per cluster recorded by install, join
+// and apply
+var clusterStateDir = "~/.k3sup/clusters"
+
+// clusterLockTimeout is how long to wait for another k3sup process, such
+// as a parallel join from apply, to finish updating a record
+var clusterLockTimeout = time.Second * 30
+
+var validClusterName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// clusterRecord is what k3sup knows about a cluster it installed, so that
+// later commands can target it with --cluster. It holds no secrets, the
+// node token is only kept, in a separate file, with --save-node-token.
+type clusterRecord struct {
+	Name       string        `yaml:"name"`
+	Context    string        `yaml:"context"`
+	Kubeconfig string        `yaml:"kubeconfig"`
+	APIServer  string        `yaml:"api_server"`
+	DataDir    string        `yaml:"data_dir,omitempty"`
+	Nodes      []clusterNode `yaml:"nodes"`
+	Updated    time.Time     `yaml:"updated"`
+}
+
+// clusterNode is a node of a recorded cluster, and how to reach it
+type clusterNode struct {
+	Host       string `yaml:"host"`
+	Role       string `yaml:"role"`
+	User       string `yaml:"user"`
+	SSHPort    int    `yaml:"ssh_port"`
+	SSHKey     string `yaml:"ssh_key"`
+	Sudo       bool   `yaml:"sudo"`
+	Local      bool   `yaml:"local,omitempty"`
+	K3sVersion string `yaml:"k3s_version,omitempty"`
+	K3sChannel string `yaml:"k3s_channel,omitempty"`
+}
+
+func clusterDir(name string) (string, error) {
+	if !validClusterName.MatchString(name) {
+		return "", fmt.Errorf("invalid cluster name %q, use letters, digits, '.', '-' and '_'", name)
+	}
+	return filepath.Join(expandPath(clusterStateDir), name), nil
+}
+
+// readClusterRecord reads the record of the cluster called name
+func readClusterRecord(name string) (*clusterRecord, error) {
+	dir, err := clusterDir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "cluster.yaml"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no cluster called %q was found in %s, it is recorded by k3sup install, join and apply", name, expandPath(clusterStateDir))
+	} else if err != nil {
+		return nil, err
+	}
+
+	record := &clusterRecord{}
+	if err := yaml.Unmarshal(data, record); err != nil {
+		return nil, fmt.Errorf("unable to read the record of cluster %q: %w", name, err)
+	}
+	return record, nil
+}
+
+// updateClusterRecord reads the record of the cluster called name, or
+// starts a new one, then calls update and writes it back. The record is
+// locked whilst it is updated, so that nodes joining in parallel are not
+// lost. When update leaves no nodes, the record is removed.
+func updateClusterRecord(name string, update func(*clusterRecord) error) error {
+	dir, err := clusterDir(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	unlock, err := lockClusterRecord(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	record := &clusterRecord{Name: name}
+	if _, err := os.Stat(filepath.Join(dir, "cluster.yaml")); err == nil {
+		if record, err = readClusterRecord(name); err != nil {
+			return err
+		}
+	}
+
+	if err := update(record); err != nil {
+		return err
+	}
+
+	if len(record.Nodes) == 0 {
+		unlock()
+		return os.RemoveAll(dir)
+	}
+
+	record.Updated = time.Now().UTC().Round(time.Second)
+	data, err := yaml.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	// Written to a temporary file first, so that a reader never sees
+	// half a record
+	tmp := filepath.Join(dir, "cluster.yaml.tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, "cluster.yaml"))
+}
+
+func lockClusterRecord(dir string) (func(), error) {
+	lockPath := filepath.Join(dir, "cluster.lock")
+	deadline := time.Now().Add(clusterLockTimeout)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			once := false
+			return func() {
+				if !once {
+					once = true
+					os.Remove(lockPath)
+				}
+			}, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for %s, remove it if no other k3sup is running", lockPath)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+// findCluster gives the name of the recorded cluster which has host as a
+// node with role, or as any node when role is empty, or an empty string
+func findCluster(host, role string) (string, error) {
+	entries, err := os.ReadDir(expandPath(clusterStateDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !validClusterName.MatchString(entry.Name()) {
+			continue
+		}
+		record, err := readClusterRecord(entry.Name())
+		if err != nil {
+			continue
+		}
+		if node, ok := record.node(host); ok && (len(role) == 0 || node.Role == role) {
+			return record.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// setNode adds node to the record, or replaces the node with its host
+func (r *clusterRecord) setNode(node clusterNode) {
+	for i, existing := range r.Nodes {
+		if existing.Host == node.Host {
+			r.Nodes[i] = node
+			return
+		}
+	}
+	r.Nodes = append(r.Nodes, node)
+}
+
+func (r *clusterRecord) removeNode(host string) {
+	nodes := []clusterNode{}
+	for _, node := range r.Nodes {
+		if node.Host != host {
+			nodes = append(nodes, node)
+		}
+	}
+	r.Nodes = nodes
+}
+
+func (r *clusterRecord) node(host string) (clusterNode, bool) {
+	for _, node := range r.Nodes {
+		if node.Host == host {
+			return node, true
+		}
+	}
+	return clusterNode{}, false
+}
+
+// primary gives the first server of the cluster, which is used to reach
+// the cluster
+func (r *clusterRecord) primary() (clusterNode, error) {
+	for _, node := range r.Nodes {
+		if node.Role == "server" {
+			return node, nil
+		}
+	}
+	return clusterNode{}, fmt.Errorf("cluster %q has no servers recorded", r.Name)
+}
+
+func (r *clusterRecord) hosts(role string) []string {
+	hosts := []string{}
+	for _, node := range r.Nodes {
+		if node.Role == role {
+			hosts = append(hosts, node.Host)
+		}
+	}
+	return hosts
+}
+
+func (r *clusterRecord) nodeTokenPath() string {
+	dir, _ := clusterDir(r.Name)
+	return filepath.Join(dir, "node-token")
+}
+
+// connectionValues gives the flags used to reach node over SSH
+func connectionValues(node clusterNode) map[string]string {
+	values := map[string]string{
+		"user":    node.User,
+		"ssh-key": node.SSHKey,
+		"sudo":    strconv.FormatBool(node.Sudo),
+	}
+	if node.SSHPort > 0 {
+		values["ssh-port"] = strconv.Itoa(node.SSHPort)
+	}
+	return values
+}
+
+// addClusterFlag adds --cluster to a command which can fill in its flags
+// from a recorded cluster
+func addClusterFlag(command *cobra.Command) {
+	command.Flags().String("cluster", "", "Name of a cluster recorded in "+clusterStateDir+", to fill in the flags which are not given")
+}
+
+// fillFromCluster reads the cluster given by --cluster, if any, and sets
+// each flag in the values given by fill which is not on the command line
+func fillFromCluster(command *cobra.Command, fill func(*clusterRecord) (map[string]string, error)) error {
+	name, _ := command.Flags().GetString("cluster")
+	if len(name) == 0 {
+		return nil
+	}
+
+	record, err := readClusterRecord(name)
+	if err != nil {
+		return err
+	}
+	values, err := fill(record)
+	if err != nil {
+		return err
+	}
+
+	return fillFlags(command, values)
+}
+
+// fillFlags sets each flag in values which was not changed on the command
+// line, skipping empty values
+func fillFlags(command *cobra.Command, values map[string]string) error {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if len(values[name]) == 0 || command.Flags().Lookup(name) == nil || command.Flags().Changed(name) {
+			continue
+		}
+		if err := command.Flags().Set(name, values[name]); err != nil {
+			return fmt.Errorf("unable to set --%s from the cluster record: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// joinClusterValues fills in the server to join, and the version and SSH
+// settings of the first server, which the new node most likely shares
+func joinClusterValues(record *clusterRecord) (map[string]string, error) {
+	primary, err := record.primary()
+	if err != nil {
+		return nil, err
+	}
+
+	values := connectionValues(primary)
+	values["server-host"] = primary.Host
+	values["server-user"] = primary.User
+	if primary.SSHPort > 0 {
+		values["server-ssh-port"] = strconv.Itoa(primary.SSHPort)
+	}
+	values["server-data-dir"] = record.DataDir
+	values["k3s-version"] = primary.K3sVersion
+	if len(primary.K3sVersion) == 0 {
+		values["k3s-channel"] = primary.K3sChannel
+	}
+	if _, err := os.Stat(record.nodeTokenPath()); err == nil {
+		values["node-token-path"] = record.nodeTokenPath()
+	}
+	return values, nil
+}
+
+// serverClusterValues fills in the first server, for commands which run
+// on a server, such as get-config and node-token
+func serverClusterValues(record *clusterRecord) (map[string]string, error) {
+	primary, err := record.primary()
+	if err != nil {
+		return nil, err
+	}
+
+	values := connectionValues(primary)
+	values["host"] = primary.Host
+	values["local"] = strconv.FormatBool(primary.Local)
+	values["server-data-dir"] = record.DataDir
+	// Not --local-path, as get-config would overwrite a merged kubeconfig
+	values["context"] = record.Context
+	if !strings.HasPrefix(record.APIServer, fmt.Sprintf("https://%s:", primary.Host)) {
+		values["api-server-url"] = record.APIServer
+	}
+	return values, nil
+}
+
+// upgradeClusterValues fills in every server and agent of the cluster
+func upgradeClusterValues(record *clusterRecord) (map[string]string, error) {
+	primary, err := record.primary()
+	if err != nil {
+		return nil, err
+	}
+
+	values := connectionValues(primary)
+	values["server"] = strings.Join(record.hosts("server"), ",")
+	values["agent"] = strings.Join(record.hosts("agent"), ",")
+	values["server-data-dir"] = record.DataDir
+	return values, nil
+}
+
+// clusterHosts gives a Host for each address. With --cluster, each host
+// recorded in the cluster keeps its own SSH settings, unless they were
+// given on the command line.
+func clusterHosts(command *cobra.Command, addresses []string) ([]Host, error) {
+	var record *clusterRecord
+	if name, _ := command.Flags().GetString("cluster"); len(name) > 0 {
+		var err error
+		if record, err = readClusterRecord(name); err != nil {
+			return nil, err
+		}
+	}
+
+	hosts := []Host{}
+	for _, address := range addresses {
+		host := Host{IP: address}
+		if record != nil {
+			if node, ok := record.node(address); ok {
+				if !command.Flags().Changed("user") {
+					host.User = node.User
+				}
+				if !command.Flags().Changed("ssh-port") {
+					host.SSHPort = node.SSHPort
+				}
+				if !command.Flags().Changed("ssh-key") {
+					host.SSHKey = node.SSHKey
+				}
+			}
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// uninstallClusterValues fills in how to reach host, and another server
+// to remove it from the cluster through
+func uninstallClusterValues(record *clusterRecord, host string) (map[string]string, error) {
+	node, ok := record.node(host)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a node of cluster %q", host, record.Name)
+	}
+
+	values := connectionValues(node)
+	values["server-data-dir"] = record.DataDir
+	for _, server := range record.Nodes {
+		if server.Role == "server" && server.Host != host {
+			values["server-host"] = server.Host
+			values["server-user"] = server.User
+			if server.SSHPort > 0 {
+				values["server-ssh-port"] = strconv.Itoa(server.SSHPort)
+			}
+			break
+		}
+	}
+	return values, nil
+}
+
+// clusterName gives the cluster given by --cluster, or else the recorded
+// cluster which has host as a node with role
+func clusterName(command *cobra.Command, host, role string) (string, error) {
+	if name, _ := command.Flags().GetString("cluster"); len(name) > 0 {
+		return name, nil
+	}
+	return findCluster(host, role)
+}
+
+// commandNode gives the node described by the connection and version
+// flags of command
+func commandNode(command *cobra.Command, host, role string) clusterNode {
+	node := clusterNode{Host: host, Role: role}
+	node.User, _ = command.Flags().GetString("user")
+	node.SSHPort, _ = command.Flags().GetInt("ssh-port")
+	node.SSHKey, _ = command.Flags().GetString("ssh-key")
+	node.Sudo, _ = command.Flags().GetBool("sudo")
+	node.K3sVersion, _ = command.Flags().GetString("k3s-version")
+	if len(node.K3sVersion) == 0 {
+		node.K3sChannel, _ = command.Flags().GetString("k3s-channel")
+	}
+	return node
+}
+
+// recordInstall records the server set up by install under --cluster-name,
+// and saves the node token when asked. Nothing is recorded without a name,
+// or when K3s was not installed. A record whose first server is another
+// host was of an earlier cluster, so its nodes are dropped.
+func recordInstall(command *cobra.Command, op operator.CommandOperator, host string, local bool) error {
+	name, _ := command.Flags().GetString("cluster-name")
+	skipInstall, _ := command.Flags().GetBool("skip-install")
+	if len(name) == 0 || skipInstall {
+		return nil
+	}
+	context, _ := command.Flags().GetString("context")
+
+	localPath, _ := command.Flags().GetString("local-path")
+	kubeconfig, err := filepath.Abs(expandPath(localPath))
+	if err != nil {
+		return err
+	}
+
+	k3sExtraArgs, _ := command.Flags().GetString("k3s-extra-args")
+	apiServer, _ := command.Flags().GetString("api-server-url")
+	if len(apiServer) == 0 {
+		apiServer = fmt.Sprintf("https://%s:%s", host, httpsListenPort(k3sExtraArgs))
+	}
+
+	node := commandNode(command, host, "server")
+	node.Local = local
+
+	if err := updateClusterRecord(name, func(record *clusterRecord) error {
+		if primary, err := record.primary(); err == nil && primary.Host != host {
+			record.Nodes = nil
+			if err := os.Remove(record.nodeTokenPath()); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		record.Context = context
+		record.Kubeconfig = kubeconfig
+		record.APIServer = apiServer
+		record.DataDir = k3sExtraArg(k3sExtraArgs, "--data-dir", "")
+		record.setNode(node)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if saveToken, _ := command.Flags().GetBool("save-node-token"); saveToken {
+		sudoPrefix := ""
+		if node.Sudo {
+			sudoPrefix = "sudo "
+		}
+		dataDir := k3sExtraArg(k3sExtraArgs, "--data-dir", "/var/lib/rancher/k3s")
+		nodeToken, err := obtainNodeToken(op, fmt.Sprintf("%scat %s\n", sudoPrefix, filepath.Join(dataDir, "server/node-token")), host)
+		if err != nil {
+			return err
+		}
+		if len(nodeToken) == 0 {
+			return fmt.Errorf("no node token found")
+		}
+
+		record := clusterRecord{Name: name}
+		if err := os.WriteFile(record.nodeTokenPath(), []byte(nodeToken+"\n"), 0600); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(command.OutOrStdout(), "Recorded cluster %q in %s\n", name, expandPath(clusterStateDir))
+	return nil
+}
+
+// recordJoin adds the node set up by join to the cluster of its server,
+// when the cluster was recorded
+func recordJoin(command *cobra.Command, serverHost, host, role string) error {
+	name, err := clusterName(command, serverHost, "server")
+	if err != nil || len(name) == 0 {
+		return err
+	}
+
+	if err := updateClusterRecord(name, func(record *clusterRecord) error {
+		record.setNode(commandNode(command, host, role))
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(command.OutOrStdout(), "Added %s to cluster %q\n", host, name)
+	return nil
+}
+
+// recordUpgrade sets the version of each upgraded node in the cluster of
+// server, when the cluster was recorded
+func recordUpgrade(command *cobra.Command, server string, hosts []string, version, channel string) error {
+	name, err := clusterName(command, server, "server")
+	if err != nil || len(name) == 0 {
+		return err
+	}
+
+	return updateClusterRecord(name, func(record *clusterRecord) error {
+		for _, host := range hosts {
+			if node, ok := record.node(host); ok {
+				node.K3sVersion = version
+				node.K3sChannel = ""
+				if len(version) == 0 {
+					node.K3sChannel = channel
+				}
+				record.setNode(node)
+			}
+		}
+		return nil
+	})
+}
+
+// recordUninstall removes host from its cluster, when the cluster was
+// recorded
+func recordUninstall(command *cobra.Command, host string) error {
+	name, err := clusterName(command, host, "")
+	if err != nil || len(name) == 0 {
+		return err
+	}
+
+	if err := updateClusterRecord(name, func(record *clusterRecord) error {
+		record.removeNode(host)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(command.OutOrStdout(), "Removed %s from cluster %q\n", host, name)
+	return nil
+}
@@ -0,0 +1,261 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func useTempClusterStateDir(t *testing.T) string {
+	dir := t.TempDir()
+	previous := clusterStateDir
+	clusterStateDir = dir
+	t.Cleanup(func() { clusterStateDir = previous })
+	return dir
+}
+
+func Test_updateClusterRecord(t *testing.T) {
+	dir := useTempClusterStateDir(t)
+
+	server := clusterNode{Host: "10.0.0.1", Role: "server", User: "ubuntu", SSHPort: 22, SSHKey: "~/.ssh/id_rsa", Sudo: true, K3sChannel: "stable"}
+	agent := clusterNode{Host: "10.0.0.2", Role: "agent", User: "ubuntu", SSHPort: 22, SSHKey: "~/.ssh/id_rsa", Sudo: true}
+
+	for _, node := range []clusterNode{server, agent} {
+		if err := updateClusterRecord("prod", func(record *clusterRecord) error {
+			record.Context = "prod"
+			record.setNode(node)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	record, err := readClusterRecord("prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []clusterNode{server, agent}; !reflect.DeepEqual(want, record.Nodes) {
+		t.Fatalf("want nodes %v, got %v", want, record.Nodes)
+	}
+	if record.Name != "prod" || record.Context != "prod" || record.Updated.IsZero() {
+		t.Fatalf("unexpected record: %+v", record)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "prod", "cluster.lock")); !os.IsNotExist(err) {
+		t.Fatalf("want the lock to be removed, got: %v", err)
+	}
+
+	if name, _ := findCluster("10.0.0.1", "server"); name != "prod" {
+		t.Fatalf("want prod for the server, got %q", name)
+	}
+	if name, _ := findCluster("10.0.0.2", "server"); name != "" {
+		t.Fatalf("want no cluster with the agent as a server, got %q", name)
+	}
+	if name, _ := findCluster("10.0.0.2", ""); name != "prod" {
+		t.Fatalf("want prod for the agent, got %q", name)
+	}
+
+	// Removing the last node removes the record
+	if err := updateClusterRecord("prod", func(record *clusterRecord) error {
+		record.removeNode("10.0.0.1")
+		record.removeNode("10.0.0.2")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "prod")); !os.IsNotExist(err) {
+		t.Fatalf("want the record to be removed, got: %v", err)
+	}
+}
+
+func Test_readClusterRecord_Errors(t *testing.T) {
+	useTempClusterStateDir(t)
+
+	if _, err := readClusterRecord("missing"); err == nil {
+		t.Fatal("want an error for a cluster which was not recorded")
+	}
+	if _, err := readClusterRecord("../etc"); err == nil {
+		t.Fatal("want an error for an invalid name")
+	}
+}
+
+func Test_fillFlags_KeepsFlagsGiven(t *testing.T) {
+	command := &cobra.Command{}
+	command.Flags().String("user", "root", "")
+	command.Flags().Int("ssh-port", 22, "")
+	command.Flags().Bool("sudo", true, "")
+	command.Flags().String("host", "", "")
+	if err := command.ParseFlags([]string{"--user", "ubuntu"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fillFlags(command, map[string]string{
+		"user":     "pi",
+		"ssh-port": "2222",
+		"sudo":     "false",
+		"host":     "",
+		"missing":  "value",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	user, _ := command.Flags().GetString("user")
+	port, _ := command.Flags().GetInt("ssh-port")
+	sudo, _ := command.Flags().GetBool("sudo")
+	host, _ := command.Flags().GetString("host")
+	if user != "ubuntu" || port != 2222 || sudo || host != "" {
+		t.Fatalf("unexpected flags: user=%s ssh-port=%d sudo=%v host=%q", user, port, sudo, host)
+	}
+}
+
+func Test_joinClusterValues(t *testing.T) {
+	useTempClusterStateDir(t)
+
+	record := &clusterRecord{
+		Name:    "prod",
+		DataDir: "/mnt/k3s",
+		Nodes: []clusterNode{
+			{Host: "10.0.0.1", Role: "server", User: "ubuntu", SSHPort: 2222, SSHKey: "~/.ssh/prod", K3sVersion: "v1.30.2+k3s1"},
+		},
+	}
+
+	values, err := joinClusterValues(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"user":            "ubuntu",
+		"ssh-port":        "2222",
+		"ssh-key":         "~/.ssh/prod",
+		"sudo":            "false",
+		"server-host":     "10.0.0.1",
+		"server-user":     "ubuntu",
+		"server-ssh-port": "2222",
+		"server-data-dir": "/mnt/k3s",
+		"k3s-version":     "v1.30.2+k3s1",
+	}
+	if !reflect.DeepEqual(want, values) {
+		t.Fatalf("want %v, got %v", want, values)
+	}
+
+	// The saved node token is used when there is one
+	if err := os.MkdirAll(filepath.Dir(record.nodeTokenPath()), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(record.nodeTokenPath(), []byte("K10::server:token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	values, _ = joinClusterValues(record)
+	if values["node-token-path"] != record.nodeTokenPath() {
+		t.Fatalf("want the saved node token, got %q", values["node-token-path"])
+	}
+
+	if _, err := joinClusterValues(&clusterRecord{Name: "empty"}); err == nil {
+		t.Fatal("want an error for a cluster without servers")
+	}
+}
+
+func Test_uninstallClusterValues(t *testing.T) {
+	record := &clusterRecord{
+		Name: "prod",
+		Nodes: []clusterNode{
+			{Host: "10.0.0.1", Role: "server", User: "ubuntu", SSHPort: 22},
+			{Host: "10.0.0.2", Role: "server", User: "admin", SSHPort: 2222},
+			{Host: "10.0.0.3", Role: "agent", User: "pi", SSHPort: 22},
+		},
+	}
+
+	values, err := uninstallClusterValues(record, "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["server-host"] != "10.0.0.2" || values["server-user"] != "admin" || values["server-ssh-port"] != "2222" || values["user"] != "ubuntu" {
+		t.Fatalf("want to remove the server through 10.0.0.2, got %v", values)
+	}
+
+	values, _ = uninstallClusterValues(record, "10.0.0.3")
+	if values["server-host"] != "10.0.0.1" || values["user"] != "pi" {
+		t.Fatalf("want to remove the agent through 10.0.0.1, got %v", values)
+	}
+
+	if _, err := uninstallClusterValues(record, "10.0.0.4"); err == nil {
+		t.Fatal("want an error for a host which is not in the cluster")
+	}
+}
+
+func Test_clusterHosts(t *testing.T) {
+	useTempClusterStateDir(t)
+
+	if err := updateClusterRecord("prod", func(record *clusterRecord) error {
+		record.setNode(clusterNode{Host: "10.0.0.1", Role: "server", User: "ubuntu", SSHPort: 2222, SSHKey: "~/.ssh/prod"})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	command := &cobra.Command{}
+	command.Flags().String("user", "root", "")
+	command.Flags().Int("ssh-port", 22, "")
+	command.Flags().String("ssh-key", "~/.ssh/id_rsa", "")
+	addClusterFlag(command)
+	if err := command.ParseFlags([]string{"--cluster", "prod", "--user", "admin"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := clusterHosts(command, []string{"10.0.0.1", "10.0.0.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Host{{IP: "10.0.0.1", SSHPort: 2222, SSHKey: "~/.ssh/prod"}, {IP: "10.0.0.2"}}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+}
+
+func Test_recordInstall(t *testing.T) {
+	dir := useTempClusterStateDir(t)
+
+	install := func(host string, args ...string) {
+		command := MakeInstall()
+		if err := command.ParseFlags(append([]string{"--local-path", filepath.Join(dir, "kubeconfig")}, args...)); err != nil {
+			t.Fatal(err)
+		}
+		if err := recordInstall(command, nil, host, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing is recorded without a name, or without an install
+	install("10.0.0.1")
+	install("10.0.0.1", "--cluster-name", "prod", "--skip-install")
+	if _, err := readClusterRecord("prod"); err == nil {
+		t.Fatal("want no record without --cluster-name, or with --skip-install")
+	}
+
+	install("10.0.0.1", "--cluster-name", "prod")
+	if err := updateClusterRecord("prod", func(record *clusterRecord) error {
+		record.setNode(clusterNode{Host: "10.0.0.2", Role: "agent"})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Installing the same server again keeps the nodes which joined it
+	install("10.0.0.1", "--cluster-name", "prod")
+	record, err := readClusterRecord("prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record.Nodes) != 2 {
+		t.Fatalf("want both nodes kept, got %+v", record.Nodes)
+	}
+
+	// Another first server is a new cluster under the same name
+	install("10.0.0.9", "--cluster-name", "prod")
+	if record, _ = readClusterRecord("prod"); len(record.Nodes) != 1 || record.Nodes[0].Host != "10.0.0.9" {
+		t.Fatalf("want only the new server, got %+v", record.Nodes)
+	}
+}
@@ -0,0 +1,289 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+)
+
+// generateCustomCACertsURL is the script K3s provides to generate its CA
+// certificates from a root or intermediate CA, pinned to a release so
+// that it matches the checksum given for it
+const generateCustomCACertsURL = "https://github.com/k3s-io/k3s/raw/v1.30.2+k3s1/contrib/util/generate-custom-ca-certs.sh"
+
+// generateCustomCAScript downloads the script to a private directory,
+// checks it against the sha256 given for it, then runs it as root
+const generateCustomCAScript = `set -e
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+curl -sfL -o "$tmp/generate-custom-ca-certs.sh" "%[1]s"
+actual=$(sha256sum "$tmp/generate-custom-ca-certs.sh" | awk '{print $1}')
+if [ "%[2]s" != "$actual" ]; then echo "checksum mismatch for generate-custom-ca-certs.sh, got $actual"; exit 1; fi
+%[3]sDATA_DIR=%[4]s bash "$tmp/generate-custom-ca-certs.sh" 2>&1
+`
+
+var sha256Value = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// customCACerts are the CAs which K3s loads from its TLS directory, each
+// with a .crt and a .key file
+var customCACerts = []string{
+	"client-ca",
+	"request-header-ca",
+	"server-ca",
+	"etcd/peer-ca",
+	"etcd/server-ca",
+}
+
+// customCA is the CA material read from --custom-ca-dir. Either the full
+// set of CA certificates is given, or only a root or intermediate CA from
+// which the set is generated on the node.
+type customCA struct {
+	files    map[string][]byte
+	generate bool
+
+	// rootKeyDropped is set when root-ca.key was given but is not
+	// needed, so that it is not copied to the servers
+	rootKeyDropped bool
+
+	// scriptSHA256 is the checksum of the script which generates the
+	// CA certificates
+	scriptSHA256 string
+}
+
+// loadCustomCA reads the CA material from dir and checks that each CA
+// chains to root-ca.pem, and matches its key. root-ca.key is only kept
+// when it is the only key to sign the CA certificates with, so that the
+// private key of an offline root is not copied to every server.
+func loadCustomCA(dir string) (*customCA, error) {
+	ca := &customCA{files: map[string][]byte{}}
+
+	read := func(name string) bool {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return false
+		}
+		ca.files[name] = data
+		return true
+	}
+
+	if !read("root-ca.pem") {
+		return nil, fmt.Errorf("%s must contain root-ca.pem", dir)
+	}
+	read("root-ca.key")
+	read("intermediate-ca.pem")
+	read("intermediate-ca.key")
+
+	complete := true
+	for _, name := range customCACerts {
+		complete = read(name+".crt") && read(name+".key") && complete
+	}
+	complete = read("service.key") && complete
+
+	roots, intermediates, err := customCAPools(ca.files)
+	if err != nil {
+		return nil, err
+	}
+
+	if complete {
+		for _, name := range customCACerts {
+			if err := verifyCustomCA(ca.files[name+".crt"], ca.files[name+".key"], roots, intermediates); err != nil {
+				return nil, fmt.Errorf("%s.crt: %w", name, err)
+			}
+		}
+		if block, _ := pem.Decode(ca.files["service.key"]); block == nil || !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			return nil, fmt.Errorf("service.key must be a PEM encoded private key")
+		}
+		ca.dropRootKey()
+		return ca, nil
+	}
+
+	ca.generate = true
+	switch {
+	case len(ca.files["intermediate-ca.pem"]) > 0 && len(ca.files["intermediate-ca.key"]) > 0:
+		if err := verifyCustomCA(ca.files["intermediate-ca.pem"], ca.files["intermediate-ca.key"], roots, x509.NewCertPool()); err != nil {
+			return nil, fmt.Errorf("intermediate-ca.pem: %w", err)
+		}
+		ca.dropRootKey()
+	case len(ca.files["root-ca.key"]) > 0:
+		if err := verifyCustomCA(ca.files["root-ca.pem"], ca.files["root-ca.key"], roots, x509.NewCertPool()); err != nil {
+			return nil, fmt.Errorf("root-ca.pem: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("%s must contain intermediate-ca.pem and intermediate-ca.key, root-ca.key, or the full set of K3s CA certificates", dir)
+	}
+
+	// Only the root and intermediate are needed to generate the rest
+	for name := range ca.files {
+		if !strings.HasPrefix(name, "root-ca.") && !strings.HasPrefix(name, "intermediate-ca.") {
+			delete(ca.files, name)
+		}
+	}
+
+	return ca, nil
+}
+
+// dropRootKey removes root-ca.key from the files written to the servers
+func (ca *customCA) dropRootKey() {
+	if _, ok := ca.files["root-ca.key"]; ok {
+		delete(ca.files, "root-ca.key")
+		ca.rootKeyDropped = true
+	}
+}
+
+func customCAPools(files map[string][]byte) (*x509.CertPool, *x509.CertPool, error) {
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(files["root-ca.pem"]) {
+		return nil, nil, fmt.Errorf("root-ca.pem does not contain a PEM encoded certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	if data := files["intermediate-ca.pem"]; len(data) > 0 && !intermediates.AppendCertsFromPEM(data) {
+		return nil, nil, fmt.Errorf("intermediate-ca.pem does not contain a PEM encoded certificate")
+	}
+
+	return roots, intermediates, nil
+}
+
+// verifyCustomCA checks that certPEM is a CA which chains to one of roots,
+// and when keyPEM is given, that it matches the certificate
+func verifyCustomCA(certPEM, keyPEM []byte, roots, intermediates *x509.CertPool) error {
+	block, rest := pem.Decode(certPEM)
+	if block == nil {
+		return fmt.Errorf("no PEM encoded certificate found")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+	if !cert.IsCA {
+		return fmt.Errorf("%q is not a CA certificate", cert.Subject.CommonName)
+	}
+
+	// Certificates after the first, as written by the K3s script, are
+	// the rest of the chain
+	for {
+		var next *pem.Block
+		next, rest = pem.Decode(rest)
+		if next == nil {
+			break
+		}
+		if chained, err := x509.ParseCertificate(next.Bytes); err == nil {
+			intermediates.AddCert(chained)
+		}
+	}
+
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return fmt.Errorf("%q does not chain to root-ca.pem: %w", cert.Subject.CommonName, err)
+	}
+
+	if len(keyPEM) > 0 {
+		if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+			return fmt.Errorf("the key does not match the certificate: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// provisionCustomCA writes the CA material into the TLS directory of K3s
+// before its first start, generates the rest of the CA certificates if
+// needed, then checks the chain of the certificates on the node
+func provisionCustomCA(out io.Writer, op operator.CommandOperator, sudoPrefix, dataDir string, ca *customCA, printCommand bool) error {
+	tlsDir := path.Join(dataDir, "server/tls")
+
+	existsCommand := fmt.Sprintf("%stest -e %s && echo exists || true\n", sudoPrefix, path.Join(tlsDir, "server-ca.crt"))
+	res, err := executeCommandTo(out, op, existsCommand, printCommand)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(res.StdOut)) == "exists" {
+		return fmt.Errorf("K3s has already created its CA certificates in %s, a custom CA can only be used before the first start", tlsDir)
+	}
+
+	names := make([]string, 0, len(ca.files))
+	for name := range ca.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		mode := "0644"
+		if strings.HasSuffix(name, ".key") {
+			mode = "0600"
+		}
+
+		// Keys are written by the command, so it is never printed
+		target := path.Join(tlsDir, name)
+		if _, err := executeCommandTo(out, op, writeFileCommand(sudoPrefix, target, ca.files[name], mode), false); err != nil {
+			return fmt.Errorf("unable to write %s: %w", target, err)
+		}
+		fmt.Fprintf(out, "Wrote %s\n", target)
+	}
+
+	if ca.generate {
+		if _, err := executeCommandTo(out, op, "command -v openssl\n", printCommand); err != nil {
+			return fmt.Errorf("openssl is needed on the node to generate the CA certificates: %w", err)
+		}
+
+		fmt.Fprintf(out, "Generating the K3s CA certificates in %s\n", tlsDir)
+		if _, err := executeCommandTo(out, op, makeGenerateCustomCACommand(sudoPrefix, dataDir, ca.scriptSHA256), printCommand); err != nil {
+			return fmt.Errorf("unable to generate the CA certificates: %w", err)
+		}
+	}
+
+	roots, intermediates, err := customCAPools(ca.files)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range customCACerts {
+		certPath := path.Join(tlsDir, name+".crt")
+		res, err := executeCommandTo(out, op, fmt.Sprintf("%scat %s\n", sudoPrefix, certPath), printCommand)
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %w", certPath, err)
+		}
+
+		if err := verifyCustomCA(res.StdOut, nil, roots, intermediates); err != nil {
+			return fmt.Errorf("%s: %w", certPath, err)
+		}
+	}
+
+	fmt.Fprintf(out, "Verified the CA certificates in %s chain to root-ca.pem\n", tlsDir)
+
+	return nil
+}
+
+func makeGenerateCustomCACommand(sudoPrefix, dataDir, scriptSHA256 string) string {
+	return fmt.Sprintf(generateCustomCAScript,
+		generateCustomCACertsURL, scriptSHA256, sudoPrefix, shellQuote(strings.TrimSuffix(dataDir, "/")))
+}
+
+// checkCustomCAScript checks the sha256 given for the script when the CA
+// certificates are to be generated
+func checkCustomCAScript(ca *customCA, scriptSHA256 string) error {
+	if !ca.generate {
+		return nil
+	}
+	if len(scriptSHA256) == 0 {
+		return fmt.Errorf("the CA certificates are generated with %s, check the script and give its sha256 with --custom-ca-script-sha256, or give the full set of CA certificates", generateCustomCACertsURL)
+	}
+	if !sha256Value.MatchString(scriptSHA256) {
+		return fmt.Errorf("--custom-ca-script-sha256 must be 64 lower case hex characters")
+	}
+	return nil
+}
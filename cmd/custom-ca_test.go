@@ -0,0 +1,252 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func makeTestCA(t *testing.T, commonName string, parent *testCA) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeTestFile(t *testing.T, dir, name string, data []byte) {
+	t.Helper()
+
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(target, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_loadCustomCA_Intermediate(t *testing.T) {
+	dir := t.TempDir()
+	root := makeTestCA(t, "root", nil)
+	intermediate := makeTestCA(t, "intermediate", root)
+
+	writeTestFile(t, dir, "root-ca.pem", root.certPEM)
+	writeTestFile(t, dir, "root-ca.key", root.keyPEM)
+	writeTestFile(t, dir, "intermediate-ca.pem", intermediate.certPEM)
+	writeTestFile(t, dir, "intermediate-ca.key", intermediate.keyPEM)
+	writeTestFile(t, dir, "server-ca.crt", intermediate.certPEM)
+
+	ca, err := loadCustomCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ca.generate {
+		t.Errorf("want the CA certificates to be generated")
+	}
+	if len(ca.files) != 3 {
+		t.Errorf("want only the root and intermediate files, got %d files", len(ca.files))
+	}
+	if _, ok := ca.files["server-ca.crt"]; ok {
+		t.Errorf("server-ca.crt should not be kept when generating")
+	}
+	if _, ok := ca.files["root-ca.key"]; ok || !ca.rootKeyDropped {
+		t.Errorf("root-ca.key should not be kept with the intermediate key")
+	}
+}
+
+func Test_loadCustomCA_RootKey(t *testing.T) {
+	dir := t.TempDir()
+	root := makeTestCA(t, "root", nil)
+
+	writeTestFile(t, dir, "root-ca.pem", root.certPEM)
+	writeTestFile(t, dir, "root-ca.key", root.keyPEM)
+
+	ca, err := loadCustomCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ca.files["root-ca.key"]; !ok || ca.rootKeyDropped {
+		t.Errorf("want root-ca.key kept when it is the only key")
+	}
+}
+
+func Test_loadCustomCA_FullSet(t *testing.T) {
+	dir := t.TempDir()
+	root := makeTestCA(t, "root", nil)
+	intermediate := makeTestCA(t, "intermediate", root)
+
+	writeTestFile(t, dir, "root-ca.pem", root.certPEM)
+	writeTestFile(t, dir, "intermediate-ca.pem", intermediate.certPEM)
+	for _, name := range customCACerts {
+		ca := makeTestCA(t, name, intermediate)
+		// As written by the K3s script, with the chain appended
+		writeTestFile(t, dir, name+".crt", append(ca.certPEM, intermediate.certPEM...))
+		writeTestFile(t, dir, name+".key", ca.keyPEM)
+	}
+	writeTestFile(t, dir, "service.key", root.keyPEM)
+	writeTestFile(t, dir, "root-ca.key", root.keyPEM)
+
+	ca, err := loadCustomCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ca.generate {
+		t.Errorf("want the given CA certificates to be used")
+	}
+	if _, ok := ca.files["etcd/peer-ca.key"]; !ok {
+		t.Errorf("want etcd/peer-ca.key in the files")
+	}
+	if _, ok := ca.files["root-ca.key"]; ok || !ca.rootKeyDropped {
+		t.Errorf("root-ca.key should not be kept with the full set")
+	}
+}
+
+func Test_loadCustomCA_Errors(t *testing.T) {
+	root := makeTestCA(t, "root", nil)
+	intermediate := makeTestCA(t, "intermediate", root)
+	other := makeTestCA(t, "other", nil)
+
+	cases := []struct {
+		name  string
+		files map[string][]byte
+		want  string
+	}{
+		{
+			name:  "no root",
+			files: map[string][]byte{"intermediate-ca.pem": intermediate.certPEM},
+			want:  "must contain root-ca.pem",
+		},
+		{
+			name:  "no key",
+			files: map[string][]byte{"root-ca.pem": root.certPEM, "intermediate-ca.pem": intermediate.certPEM},
+			want:  "must contain intermediate-ca.pem and intermediate-ca.key",
+		},
+		{
+			name: "wrong chain",
+			files: map[string][]byte{
+				"root-ca.pem":         other.certPEM,
+				"intermediate-ca.pem": intermediate.certPEM,
+				"intermediate-ca.key": intermediate.keyPEM,
+			},
+			want: "does not chain to root-ca.pem",
+		},
+		{
+			name: "mismatched key",
+			files: map[string][]byte{
+				"root-ca.pem":         root.certPEM,
+				"intermediate-ca.pem": intermediate.certPEM,
+				"intermediate-ca.key": other.keyPEM,
+			},
+			want: "the key does not match",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range c.files {
+				writeTestFile(t, dir, name, data)
+			}
+
+			_, err := loadCustomCA(dir)
+			if err == nil {
+				t.Fatalf("want error containing %q, got nil", c.want)
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("want error containing %q, got %q", c.want, err.Error())
+			}
+		})
+	}
+}
+
+func Test_makeGenerateCustomCACommand(t *testing.T) {
+	sum := strings.Repeat("0123456789abcdef", 4)
+	got := makeGenerateCustomCACommand("sudo ", "/var/lib/rancher/k3s/", sum)
+
+	for _, want := range []string{
+		"tmp=$(mktemp -d)\n",
+		`curl -sfL -o "$tmp/generate-custom-ca-certs.sh" "` + generateCustomCACertsURL + `"`,
+		`if [ "` + sum + `" != "$actual" ]`,
+		`sudo DATA_DIR='/var/lib/rancher/k3s' bash "$tmp/generate-custom-ca-certs.sh" 2>&1`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("want %q in:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "/tmp/") || strings.Contains(got, "/raw/master/") {
+		t.Errorf("want a pinned script in a private directory, got:\n%s", got)
+	}
+}
+
+func Test_checkCustomCAScript(t *testing.T) {
+	sum := strings.Repeat("0123456789abcdef", 4)
+
+	if err := checkCustomCAScript(&customCA{}, ""); err != nil {
+		t.Errorf("want no checksum needed for the full set, got: %v", err)
+	}
+	if err := checkCustomCAScript(&customCA{generate: true}, sum); err != nil {
+		t.Errorf("want a valid checksum to be accepted, got: %v", err)
+	}
+	if err := checkCustomCAScript(&customCA{generate: true}, ""); err == nil {
+		t.Error("want an error without a checksum")
+	}
+	if err := checkCustomCAScript(&customCA{generate: true}, "abc"); err == nil {
+		t.Error("want an error for an invalid checksum")
+	}
+}
@@ -0,0 +1,577 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/alexellis/k3sup/pkg"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// probeNodeScript prints the hostname of the node, which K3s service it
+// has, whether that service is running, and the version of K3s
+const probeNodeScript = `echo "hostname=$(hostname)"
+for service in k3s k3s-agent; do
+  if [ -f /etc/systemd/system/$service.service ]; then echo "service=$service"; echo "active=$(systemctl is-active $service)"; fi
+done
+if [ -x /usr/local/bin/k3s ]; then echo "version=$(/usr/local/bin/k3s --version | head -n 1)"; fi
+`
+
+// k3sConfigPath is the K3s config file, files in the directory of the
+// same name with .d added are merged into it
+const k3sConfigPath = "/etc/rancher/k3s/config.yaml"
+
+// k3sConfigScript prints config.yaml and each file in config.yaml.d, each
+// after a K3SUP_FILE line with its path
+const k3sConfigScript = `%ssh -c 'for f in ` + k3sConfigPath + ` ` + k3sConfigPath + `.d/*; do if [ -f "$f" ]; then echo "K3SUP_FILE $f"; cat "$f"; echo; fi; done'
+`
+
+// nodeState is what was found on a node when it was probed
+type nodeState struct {
+	Err      error
+	Hostname string
+	Service  string
+	Role     string
+	Active   bool
+	Version  string
+	Settings map[string][]string
+}
+
+// liveNode is a Node registered in the cluster
+type liveNode struct {
+	Name      string
+	Labels    map[string]string
+	Addresses []string
+}
+
+// nodeDrift is a difference between the spec and a node. Step is the
+// index of the node's step, or -1 for a node which is not in the spec.
+type nodeDrift struct {
+	Step   int
+	Node   string
+	Status string
+	Field  string
+	Want   string
+	Got    string
+}
+
+// MakeDiff creates the diff command
+func MakeDiff() *cobra.Command {
+	var command = &cobra.Command{
+		Use:   "diff",
+		Short: "Compare the nodes of a cluster with its devices file or plan",
+		Long: `Compare the hosts, roles, version and settings given for a cluster
+with what is on its nodes, without changing anything.
+
+Each node is probed over SSH for the version of K3s, whether it runs
+the k3s or k3s-agent service, and its effective settings, from the
+flags in the service's unit, /etc/rancher/k3s/config.yaml and the
+files in /etc/rancher/k3s/config.yaml.d, which are merged in the same
+order as K3s merges them. The labels of each Node are read from the first server.
+
+Nodes are shown as missing when K3s is not installed, drifted when the
+role, version, a setting given in --k3s-extra-args or --tls-san, or a
+label differs, and extra when a Node is registered which is not in the
+spec. diff takes the same flags as apply, and exits non-zero when any
+difference is found.
+
+` + pkg.SupportMessageShort + `
+`,
+		Example: `  # Compare the cluster with the devices file it was applied from
+  k3sup diff hosts.json --servers 3 --user ubuntu \
+    --k3s-version v1.30.2+k3s1
+
+  # Compare the cluster with a reviewed plan
+  k3sup diff --plan plan.yaml`,
+		SilenceUsage: true,
+	}
+
+	addApplySpecFlags(command)
+
+	command.PreRunE = func(command *cobra.Command, args []string) error {
+		return validateApplySpecFlags(command)
+	}
+
+	command.RunE = func(command *cobra.Command, args []string) error {
+		parallel, _ := command.Flags().GetInt("parallel")
+
+		steps, err := readApplySteps(command, args)
+		if err != nil {
+			return err
+		}
+
+		states := probeNodes(steps, parallel)
+		live, err := readLiveNodes(steps, states)
+		if err != nil {
+			fmt.Printf("Unable to read the nodes of the cluster, labels and extra nodes are not compared: %s\n", err)
+		}
+
+		drift := diffCluster(steps, states, live)
+		if len(drift) == 0 {
+			fmt.Printf("All %d nodes match the spec\n", len(steps))
+			return nil
+		}
+
+		printDrift(command.OutOrStdout(), drift)
+		return fmt.Errorf("found %s", plural(len(drift), "difference"))
+	}
+
+	return command
+}
+
+// probeNodes probes the node of each step, up to parallel at once
+func probeNodes(steps []planStep, parallel int) []nodeState {
+	states := make([]nodeState, len(steps))
+
+	wg := sync.WaitGroup{}
+	limit := make(chan struct{}, parallel)
+	for i := range steps {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-limit }()
+			states[i] = probeNode(steps[i])
+		}(i)
+	}
+	wg.Wait()
+
+	return states
+}
+
+// probeNode finds what is installed on the node of step
+func probeNode(step planStep) nodeState {
+	op, done, err := connectStep(step)
+	if err != nil {
+		return nodeState{Err: err}
+	}
+	defer done()
+
+	res, err := executeCommand(op, probeNodeScript, false)
+	if err != nil {
+		return nodeState{Err: err}
+	}
+	state := parseNodeProbe(string(res.StdOut))
+	if state.Role == "none" {
+		return state
+	}
+
+	unit, err := executeCommand(op, fmt.Sprintf("cat /etc/systemd/system/%s.service\n", state.Service), false)
+	if err != nil {
+		state.Err = fmt.Errorf("unable to read the %s service: %w", state.Service, err)
+		return state
+	}
+
+	sudoPrefix := ""
+	if step.Sudo {
+		sudoPrefix = "sudo "
+	}
+	config, err := executeCommand(op, fmt.Sprintf(k3sConfigScript, sudoPrefix), false)
+	if err != nil {
+		state.Err = fmt.Errorf("unable to read the K3s config: %w", err)
+		return state
+	}
+
+	if state.Settings, err = effectiveSettings(string(unit.StdOut), k3sConfigFiles(string(config.StdOut))); err != nil {
+		state.Err = err
+	}
+	return state
+}
+
+// parseNodeProbe reads the output of probeNodeScript
+func parseNodeProbe(out string) nodeState {
+	state := nodeState{Role: "none"}
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "hostname":
+			state.Hostname = value
+		case "service":
+			// A server's service is checked before an agent's
+			if len(state.Service) == 0 {
+				state.Service = value
+				state.Role = "server"
+				if value == "k3s-agent" {
+					state.Role = "agent"
+				}
+			}
+		case "active":
+			if !state.Active {
+				state.Active = value == "active"
+			}
+		case "version":
+			// i.e. k3s version v1.30.2+k3s1 (aa4794b3)
+			if fields := strings.Fields(value); len(fields) >= 3 {
+				state.Version = fields[2]
+			}
+		}
+	}
+	return state
+}
+
+// k3sConfigFile is a config file read from a node
+type k3sConfigFile struct {
+	Path string
+	Data []byte
+}
+
+// k3sConfigFiles reads the output of k3sConfigScript, giving config.yaml
+// first, then the .yaml and .yml files in config.yaml.d sorted by name,
+// which is the order K3s reads them in
+func k3sConfigFiles(out string) []k3sConfigFile {
+	files := []k3sConfigFile{}
+	dropIns := []k3sConfigFile{}
+	for _, part := range strings.Split("\n"+out, "\nK3SUP_FILE ")[1:] {
+		path, data, _ := strings.Cut(part, "\n")
+		file := k3sConfigFile{Path: path, Data: []byte(data)}
+		if ext := strings.ToLower(filepath.Ext(path)); path == k3sConfigPath {
+			files = append(files, file)
+		} else if ext == ".yaml" || ext == ".yml" {
+			dropIns = append(dropIns, file)
+		}
+	}
+
+	sort.Slice(dropIns, func(i, j int) bool { return dropIns[i].Path < dropIns[j].Path })
+	return append(files, dropIns...)
+}
+
+// repeatableK3sFlags are the flags of K3s which can be given more than
+// once, their values in the systemd unit are added to those in the config
+// files, where the value of any other flag replaces it
+var repeatableK3sFlags = map[string]bool{
+	"tls-san":                           true,
+	"disable":                           true,
+	"node-label":                        true,
+	"node-taint":                        true,
+	"kube-apiserver-arg":                true,
+	"kube-controller-manager-arg":       true,
+	"kube-scheduler-arg":                true,
+	"kube-cloud-controller-manager-arg": true,
+	"kubelet-arg":                       true,
+	"kube-proxy-arg":                    true,
+	"etcd-arg":                          true,
+}
+
+// effectiveSettings gives the flags K3s runs with, from its config files in
+// order, then from the flags in its systemd unit, which take precedence.
+// As with K3s, a key in a later file replaces the value of an earlier one,
+// unless it ends in +, which appends to it. A flag in the unit replaces
+// the value from the config files, unless it can be repeated.
+func effectiveSettings(unit string, files []k3sConfigFile) (map[string][]string, error) {
+	settings := map[string][]string{}
+
+	for _, file := range files {
+		doc := yaml.Node{}
+		if err := yaml.Unmarshal(file.Data, &doc); err != nil {
+			return nil, fmt.Errorf("unable to read %s: %w", file.Path, err)
+		}
+		if len(doc.Content) == 0 {
+			continue
+		}
+		values := doc.Content[0]
+		if values.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("unable to read %s: want a map of flags", file.Path)
+		}
+
+		for i := 0; i+1 < len(values.Content); i += 2 {
+			name := values.Content[i].Value
+			var value interface{}
+			if err := values.Content[i+1].Decode(&value); err != nil {
+				return nil, fmt.Errorf("unable to read %s in %s: %w", name, file.Path, err)
+			}
+
+			items := []string{}
+			switch v := value.(type) {
+			case []interface{}:
+				for _, item := range v {
+					items = append(items, fmt.Sprint(item))
+				}
+			default:
+				items = append(items, fmt.Sprint(v))
+			}
+
+			if strings.HasSuffix(name, "+") {
+				name = strings.TrimSuffix(name, "+")
+				settings[name] = append(settings[name], items...)
+			} else {
+				settings[name] = items
+			}
+		}
+	}
+
+	for name, values := range parseK3sArgs(unitExecArgs(unit)) {
+		if repeatableK3sFlags[name] {
+			settings[name] = append(settings[name], values...)
+		} else {
+			settings[name] = values[len(values)-1:]
+		}
+	}
+
+	return settings, nil
+}
+
+// unitExecArgs gives the arguments of ExecStart in a systemd unit written
+// by the K3s installer, after the k3s binary and its subcommand
+func unitExecArgs(unit string) []string {
+	command := ""
+	inExec := false
+	for _, line := range strings.Split(unit, "\n") {
+		line = strings.TrimSpace(line)
+		if !inExec {
+			if !strings.HasPrefix(line, "ExecStart=") {
+				continue
+			}
+			inExec = true
+			line = strings.TrimPrefix(line, "ExecStart=")
+		}
+
+		if strings.HasSuffix(line, "\\") {
+			command += strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		command += line
+		break
+	}
+
+	args := []string{}
+	for _, field := range strings.Fields(command) {
+		args = append(args, strings.Trim(field, `'"`))
+	}
+	if len(args) < 2 {
+		return []string{}
+	}
+	return args[2:]
+}
+
+// parseK3sArgs gives the values of each flag in args. A flag followed by
+// another flag, or by nothing, is a boolean.
+func parseK3sArgs(args []string) map[string][]string {
+	values := map[string][]string{}
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "-") {
+			continue
+		}
+
+		name := strings.TrimLeft(args[i], "-")
+		if flag, value, ok := strings.Cut(name, "="); ok {
+			values[flag] = append(values[flag], value)
+		} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+			values[name] = append(values[name], args[i+1])
+			i++
+		} else {
+			values[name] = append(values[name], "true")
+		}
+	}
+	return values
+}
+
+// specSettings gives the settings of K3s given for step, labels are
+// compared with the Node instead, as K3s only sets them when a node
+// registers
+func specSettings(step planStep) map[string][]string {
+	settings := parseK3sArgs(strings.Fields(flagValue(step.Flags, "k3s-extra-args")))
+	delete(settings, "node-label")
+
+	for _, san := range strings.Split(flagValue(step.Flags, "tls-san"), ",") {
+		if san = strings.TrimSpace(san); len(san) > 0 {
+			settings["tls-san"] = append(settings["tls-san"], san)
+		}
+	}
+	return settings
+}
+
+// readLiveNodes reads the Nodes of the cluster from the first server
+// which is running, it gives no nodes when no server is running
+func readLiveNodes(steps []planStep, states []nodeState) ([]liveNode, error) {
+	for i, step := range steps {
+		if states[i].Role != "server" || !states[i].Active {
+			continue
+		}
+
+		op, done, err := connectStep(step)
+		if err != nil {
+			return nil, err
+		}
+		defer done()
+
+		sudoPrefix := ""
+		if step.Sudo {
+			sudoPrefix = "sudo "
+		}
+		res, err := executeCommand(op, fmt.Sprintf("%sk3s kubectl get nodes -o json\n", sudoPrefix), false)
+		if err != nil {
+			return nil, err
+		}
+		return parseLiveNodes(res.StdOut)
+	}
+	return nil, nil
+}
+
+// parseLiveNodes reads the output of kubectl get nodes -o json
+func parseLiveNodes(data []byte) ([]liveNode, error) {
+	list := struct {
+		Items []struct {
+			Metadata struct {
+				Name   string            `json:"name"`
+				Labels map[string]string `json:"labels"`
+			} `json:"metadata"`
+			Status struct {
+				Addresses []struct {
+					Address string `json:"address"`
+				} `json:"addresses"`
+			} `json:"status"`
+		} `json:"items"`
+	}{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("unable to read the nodes: %w", err)
+	}
+
+	nodes := []liveNode{}
+	for _, item := range list.Items {
+		node := liveNode{Name: item.Metadata.Name, Labels: item.Metadata.Labels}
+		for _, address := range item.Status.Addresses {
+			node.Addresses = append(node.Addresses, address.Address)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// matchLiveNode gives the index of the Node of step, matched by its
+// addresses or hostname, or -1
+func matchLiveNode(step planStep, state nodeState, live []liveNode) int {
+	for i, node := range live {
+		for _, address := range node.Addresses {
+			if address == step.Host.Address() || address == step.Host.NodeIP || address == step.Host.ExternalIP {
+				return i
+			}
+		}
+	}
+	for i, node := range live {
+		if (len(state.Hostname) > 0 && node.Name == state.Hostname) || (len(step.Host.Hostname) > 0 && node.Name == step.Host.Hostname) {
+			return i
+		}
+	}
+	return -1
+}
+
+// diffCluster compares each step with what was found on its node, and
+// the Nodes of the cluster. Labels and extra nodes are only compared when
+// live is not nil.
+func diffCluster(steps []planStep, states []nodeState, live []liveNode) []nodeDrift {
+	drift := []nodeDrift{}
+	matched := make([]bool, len(live))
+
+	for i, step := range steps {
+		state := states[i]
+		add := func(status, field, want, got string) {
+			drift = append(drift, nodeDrift{Step: i, Node: step.Name, Status: status, Field: field, Want: want, Got: got})
+		}
+
+		if state.Err != nil {
+			add("unreachable", "node", "reachable", state.Err.Error())
+			continue
+		}
+		if state.Role == "none" {
+			add("missing", "k3s", step.Role, "not installed")
+			continue
+		}
+
+		node := -1
+		if live != nil {
+			if node = matchLiveNode(step, state, live); node >= 0 {
+				matched[node] = true
+			}
+		}
+
+		if state.Role != step.Role {
+			add("drifted", "role", step.Role, state.Role)
+			continue
+		}
+		if !state.Active {
+			add("drifted", "service", "active", state.Service+" is not running")
+		}
+		if want := flagValue(step.Flags, "k3s-version"); len(want) > 0 && want != state.Version {
+			add("drifted", "version", want, state.Version)
+		}
+
+		want := specSettings(step)
+		names := make([]string, 0, len(want))
+		for name := range want {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			got := state.Settings[name]
+			for _, value := range want[name] {
+				if !contains(got, value) {
+					gotStr := "-"
+					if len(got) > 0 {
+						gotStr = strings.Join(got, ",")
+					}
+					add("drifted", "--"+name, strings.Join(want[name], ","), gotStr)
+					break
+				}
+			}
+		}
+
+		if live == nil {
+			continue
+		}
+		if node < 0 {
+			add("drifted", "node", "registered", "not found")
+			continue
+		}
+		keys := make([]string, 0, len(step.Host.Labels))
+		for key := range step.Host.Labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			got, ok := live[node].Labels[key]
+			if !ok {
+				got = "-"
+			}
+			if got != step.Host.Labels[key] {
+				add("drifted", "label "+key, step.Host.Labels[key], got)
+			}
+		}
+	}
+
+	for i, node := range live {
+		if !matched[i] {
+			drift = append(drift, nodeDrift{Step: -1, Node: node.Name, Status: "extra", Field: "node", Want: "-", Got: "registered"})
+		}
+	}
+
+	return drift
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func printDrift(w io.Writer, drift []nodeDrift) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "NODE\tSTATUS\tFIELD\tWANT\tGOT\n")
+	for _, d := range drift {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", d.Node, strings.ToUpper(d.Status), d.Field, d.Want, d.Got)
+	}
+	tw.Flush()
+}
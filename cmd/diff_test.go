@@ -0,0 +1,288 @@
+package cmd
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testK3sUnit = `[Unit]
+Description=Lightweight Kubernetes
+
+[Service]
+Type=notify
+ExecStartPre=-/sbin/modprobe br_netfilter
+ExecStart=/usr/local/bin/k3s \
+    server \
+	'--tls-san' \
+	'10.0.0.1' \
+	'--cluster-init' \
+	'--disable' \
+	'traefik' \
+	'--node-ip=192.168.0.1' \
+
+KillMode=process
+`
+
+func Test_parseNodeProbe(t *testing.T) {
+	state := parseNodeProbe("hostname=node-1\nservice=k3s\nactive=active\nversion=k3s version v1.30.2+k3s1 (aa4794b3)\n")
+	want := nodeState{Hostname: "node-1", Service: "k3s", Role: "server", Active: true, Version: "v1.30.2+k3s1"}
+	if !reflect.DeepEqual(want, state) {
+		t.Fatalf("want %+v, got %+v", want, state)
+	}
+
+	state = parseNodeProbe("hostname=node-2\nservice=k3s-agent\nactive=inactive\n")
+	if state.Role != "agent" || state.Active {
+		t.Fatalf("want an inactive agent, got %+v", state)
+	}
+
+	if state := parseNodeProbe("hostname=node-3\n"); state.Role != "none" {
+		t.Fatalf("want no role, got %q", state.Role)
+	}
+}
+
+func Test_unitExecArgs(t *testing.T) {
+	got := unitExecArgs(testK3sUnit)
+	want := []string{"--tls-san", "10.0.0.1", "--cluster-init", "--disable", "traefik", "--node-ip=192.168.0.1"}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+
+	if got := unitExecArgs("[Service]\nType=notify\n"); len(got) != 0 {
+		t.Fatalf("want no args without ExecStart, got %q", got)
+	}
+}
+
+func Test_parseK3sArgs(t *testing.T) {
+	got := parseK3sArgs(strings.Fields("--disable traefik --disable servicelb --cluster-init --node-ip=10.0.0.2 --node-label a=b"))
+	want := map[string][]string{
+		"disable":      {"traefik", "servicelb"},
+		"cluster-init": {"true"},
+		"node-ip":      {"10.0.0.2"},
+		"node-label":   {"a=b"},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
+
+func Test_effectiveSettings(t *testing.T) {
+	files := []k3sConfigFile{{Path: k3sConfigPath, Data: []byte("tls-san:\n  - k3s.example.com\nwrite-kubeconfig-mode: \"0644\"\n")}}
+
+	got, err := effectiveSettings(testK3sUnit, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"tls-san":               {"k3s.example.com", "10.0.0.1"},
+		"write-kubeconfig-mode": {"0644"},
+		"cluster-init":          {"true"},
+		"disable":               {"traefik"},
+		"node-ip":               {"192.168.0.1"},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	if _, err := effectiveSettings("", []k3sConfigFile{{Path: k3sConfigPath, Data: []byte("tls-san: [")}}); err == nil {
+		t.Fatal("want an error for an invalid config.yaml")
+	}
+}
+
+func Test_effectiveSettings_DropIns(t *testing.T) {
+	out := `K3SUP_FILE /etc/rancher/k3s/config.yaml.d/20-san.yaml
+tls-san+:
+  - k3s.internal
+
+K3SUP_FILE /etc/rancher/k3s/config.yaml
+tls-san:
+  - k3s.example.com
+write-kubeconfig-mode: "0600"
+
+K3SUP_FILE /etc/rancher/k3s/config.yaml.d/10-mode.yml
+write-kubeconfig-mode: "0644"
+
+K3SUP_FILE /etc/rancher/k3s/config.yaml.d/README
+
+not: [yaml
+`
+
+	files := k3sConfigFiles(out)
+	paths := []string{}
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+	wantPaths := []string{k3sConfigPath, k3sConfigPath + ".d/10-mode.yml", k3sConfigPath + ".d/20-san.yaml"}
+	if !reflect.DeepEqual(wantPaths, paths) {
+		t.Fatalf("want files %q, got %q", wantPaths, paths)
+	}
+
+	got, err := effectiveSettings("", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"tls-san":               {"k3s.example.com", "k3s.internal"},
+		"write-kubeconfig-mode": {"0644"},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
+
+func Test_parseLiveNodes(t *testing.T) {
+	data := []byte(`{"items": [{"metadata": {"name": "node-1", "labels": {"tier": "web"}},
+		"status": {"addresses": [{"type": "InternalIP", "address": "10.0.0.1"}, {"type": "Hostname", "address": "node-1"}]}}]}`)
+
+	got, err := parseLiveNodes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []liveNode{{Name: "node-1", Labels: map[string]string{"tier": "web"}, Addresses: []string{"10.0.0.1", "node-1"}}}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+}
+
+func testDiffSteps() []planStep {
+	return makePlanSteps([]Host{
+		{Hostname: "node-1", IP: "10.0.0.1", Role: "server"},
+		{Hostname: "node-2", IP: "10.0.0.2", Role: "agent", Labels: map[string]string{"tier": "web"}},
+		{Hostname: "node-3", IP: "10.0.0.3", Role: "agent"},
+	}, planOptions{
+		Servers:         1,
+		User:            "ubuntu",
+		TLSSAN:          "k3s.example.com",
+		ServerExtraArgs: "--disable traefik",
+		K3sVersion:      "v1.30.2+k3s1",
+		Context:         "default",
+		LocalPath:       "kubeconfig",
+	})
+}
+
+func Test_diffCluster_InSync(t *testing.T) {
+	steps := testDiffSteps()
+	states := []nodeState{
+		{Role: "server", Service: "k3s", Active: true, Version: "v1.30.2+k3s1", Settings: map[string][]string{
+			"tls-san": {"10.0.0.1", "k3s.example.com"},
+			"disable": {"traefik"},
+		}},
+		{Role: "agent", Service: "k3s-agent", Active: true, Version: "v1.30.2+k3s1", Settings: map[string][]string{}},
+		{Role: "agent", Service: "k3s-agent", Active: true, Version: "v1.30.2+k3s1", Settings: map[string][]string{}},
+	}
+	live := []liveNode{
+		{Name: "node-1", Addresses: []string{"10.0.0.1"}},
+		{Name: "node-2", Addresses: []string{"10.0.0.2"}, Labels: map[string]string{"tier": "web"}},
+		{Name: "node-3", Addresses: []string{"10.0.0.3"}},
+	}
+
+	if drift := diffCluster(steps, states, live); len(drift) != 0 {
+		t.Fatalf("want no differences, got %+v", drift)
+	}
+}
+
+func Test_diffCluster_Drift(t *testing.T) {
+	steps := testDiffSteps()
+	states := []nodeState{
+		{Role: "server", Service: "k3s", Active: true, Version: "v1.29.6+k3s2", Settings: map[string][]string{
+			"tls-san": {"10.0.0.1"},
+			"disable": {"traefik"},
+		}},
+		{Role: "agent", Service: "k3s-agent", Active: true, Version: "v1.30.2+k3s1", Settings: map[string][]string{}},
+		{Role: "none"},
+	}
+	live := []liveNode{
+		{Name: "node-1", Addresses: []string{"10.0.0.1"}},
+		{Name: "node-2", Addresses: []string{"10.0.0.2"}, Labels: map[string]string{"tier": "db"}},
+		{Name: "node-9", Addresses: []string{"10.0.0.9"}},
+	}
+
+	got := diffCluster(steps, states, live)
+	want := []nodeDrift{
+		{Step: 0, Node: "node-1", Status: "drifted", Field: "version", Want: "v1.30.2+k3s1", Got: "v1.29.6+k3s2"},
+		{Step: 0, Node: "node-1", Status: "drifted", Field: "--tls-san", Want: "k3s.example.com", Got: "10.0.0.1"},
+		{Step: 1, Node: "node-2", Status: "drifted", Field: "label tier", Want: "web", Got: "db"},
+		{Step: 2, Node: "node-3", Status: "missing", Field: "k3s", Want: "agent", Got: "not installed"},
+		{Step: -1, Node: "node-9", Status: "extra", Field: "node", Want: "-", Got: "registered"},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %+v\ngot  %+v", want, got)
+	}
+
+	actions := applyActions(steps, states, live, got)
+	wantActions := []applyAction{
+		{Run: true, Reinstall: true, NodeName: "node-1"},
+		{NodeName: "node-2", Labels: map[string]string{"tier": "web"}},
+		{Run: true},
+	}
+	if !reflect.DeepEqual(wantActions, actions) {
+		t.Fatalf("want actions %+v, got %+v", wantActions, actions)
+	}
+}
+
+func Test_diffCluster_RoleAndUnreachable(t *testing.T) {
+	steps := testDiffSteps()
+	states := []nodeState{
+		{Role: "server", Service: "k3s", Active: false, Version: "v1.30.2+k3s1", Settings: map[string][]string{
+			"tls-san": {"k3s.example.com"},
+			"disable": {"traefik"},
+		}},
+		{Role: "server", Service: "k3s", Active: true},
+		{Err: errors.New("connection refused")},
+	}
+
+	// Without the Nodes of the cluster, labels are not compared
+	got := diffCluster(steps, states, nil)
+	want := []nodeDrift{
+		{Step: 0, Node: "node-1", Status: "drifted", Field: "service", Want: "active", Got: "k3s is not running"},
+		{Step: 1, Node: "node-2", Status: "drifted", Field: "role", Want: "agent", Got: "server"},
+		{Step: 2, Node: "node-3", Status: "unreachable", Field: "node", Want: "reachable", Got: "connection refused"},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %+v\ngot  %+v", want, got)
+	}
+
+	actions := applyActions(steps, states, nil, got)
+	if !actions[0].Run || actions[1].Run || actions[1].Err == nil || !actions[2].Run {
+		t.Fatalf("want to run the first and last nodes, and an error for the role, got %+v", actions)
+	}
+
+	// The installed server is drained first, the unreachable node cannot be
+	if !actions[0].Reinstall || actions[2].Reinstall {
+		t.Fatalf("want to drain only the first node, got %+v", actions)
+	}
+
+	if servers := installedServers(steps, states); len(servers) != 1 || servers[0].Address() != "10.0.0.1" {
+		t.Fatalf("want only node-1 to drain through, got %+v", servers)
+	}
+}
+
+func Test_effectiveSettings_UnitTakesPrecedence(t *testing.T) {
+	files := []k3sConfigFile{{Path: k3sConfigPath, Data: []byte("node-ip: 192.168.0.9\ndisable:\n  - servicelb\n")}}
+
+	got, err := effectiveSettings(testK3sUnit, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A scalar set in both places is taken from the unit, a repeatable
+	// flag has the values from both
+	if want := []string{"192.168.0.1"}; !reflect.DeepEqual(want, got["node-ip"]) {
+		t.Errorf("want node-ip %q, got %q", want, got["node-ip"])
+	}
+	if want := []string{"servicelb", "traefik"}; !reflect.DeepEqual(want, got["disable"]) {
+		t.Errorf("want disable %q, got %q", want, got["disable"])
+	}
+
+	// The stale value in config.yaml is reported as drift
+	steps := makePlanSteps([]Host{{Hostname: "node-1", IP: "10.0.0.1", Role: "server"}}, planOptions{
+		Servers:         1,
+		ServerExtraArgs: "--node-ip 192.168.0.9",
+	})
+	states := []nodeState{{Role: "server", Service: "k3s", Active: true, Settings: got}}
+	drift := diffCluster(steps, states, nil)
+	if len(drift) != 1 || drift[0].Field != "--node-ip" {
+		t.Fatalf("want node-ip to differ, got %+v", drift)
+	}
+}
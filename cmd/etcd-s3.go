@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// etcdSnapshotConfigPath is a drop-in K3s config file, so that the
+// settings and credentials are kept out of the systemd unit and only
+// readable by root
+const etcdSnapshotConfigPath = "/etc/rancher/k3s/config.yaml.d/k3sup-etcd-snapshot.yaml"
+
+// etcdSnapshotConfig holds the settings for scheduled etcd snapshots, in
+// the format of the K3s config file
+type etcdSnapshotConfig struct {
+	ScheduleCron  string `yaml:"etcd-snapshot-schedule-cron,omitempty"`
+	Retention     int    `yaml:"etcd-snapshot-retention,omitempty"`
+	S3            bool   `yaml:"etcd-s3,omitempty"`
+	Endpoint      string `yaml:"etcd-s3-endpoint,omitempty"`
+	Bucket        string `yaml:"etcd-s3-bucket,omitempty"`
+	Folder        string `yaml:"etcd-s3-folder,omitempty"`
+	Region        string `yaml:"etcd-s3-region,omitempty"`
+	AccessKey     string `yaml:"etcd-s3-access-key,omitempty"`
+	SecretKey     string `yaml:"etcd-s3-secret-key,omitempty"`
+	Insecure      bool   `yaml:"etcd-s3-insecure,omitempty"`
+	SkipSSLVerify bool   `yaml:"etcd-s3-skip-ssl-verify,omitempty"`
+}
+
+var etcdSnapshotConfigFlags = []string{
+	"etcd-snapshot-schedule-cron",
+	"etcd-snapshot-retention",
+	"etcd-s3-endpoint",
+	"etcd-s3-bucket",
+	"etcd-s3-folder",
+	"etcd-s3-region",
+	"etcd-s3-access-key",
+	"etcd-s3-secret-key",
+	"etcd-s3-insecure",
+	"etcd-s3-skip-ssl-verify",
+}
+
+func addEtcdSnapshotConfigFlags(command *cobra.Command) {
+	command.Flags().String("etcd-snapshot-schedule-cron", "", "Cron schedule for etcd snapshots, i.e. \"0 */6 * * *\", requires embedded etcd")
+	command.Flags().Int("etcd-snapshot-retention", 0, "Number of etcd snapshots to keep, 0 for the K3s default")
+	command.Flags().String("etcd-s3-endpoint", "", "S3 endpoint to upload etcd snapshots to, i.e. minio.example.com:9000, defaults to AWS S3")
+	command.Flags().String("etcd-s3-bucket", "", "S3 bucket to upload etcd snapshots to")
+	command.Flags().String("etcd-s3-folder", "", "Folder within the S3 bucket for etcd snapshots")
+	command.Flags().String("etcd-s3-region", "", "Region of the S3 bucket")
+	command.Flags().String("etcd-s3-access-key", "", "S3 access key, or set AWS_ACCESS_KEY_ID")
+	command.Flags().String("etcd-s3-secret-key", "", "S3 secret key, or set AWS_SECRET_ACCESS_KEY to keep it out of your shell history")
+	command.Flags().Bool("etcd-s3-insecure", false, "Use HTTP rather than HTTPS for the S3 endpoint")
+	command.Flags().Bool("etcd-s3-skip-ssl-verify", false, "Skip verification of the S3 endpoint's certificate")
+}
+
+// readEtcdSnapshotConfig reads the flags added by addEtcdSnapshotConfigFlags.
+// Nil is returned when none were given.
+func readEtcdSnapshotConfig(command *cobra.Command) (*etcdSnapshotConfig, error) {
+	given := false
+	for _, name := range etcdSnapshotConfigFlags {
+		given = given || command.Flags().Changed(name)
+	}
+	if !given {
+		return nil, nil
+	}
+
+	config := &etcdSnapshotConfig{}
+	config.ScheduleCron, _ = command.Flags().GetString("etcd-snapshot-schedule-cron")
+	config.Retention, _ = command.Flags().GetInt("etcd-snapshot-retention")
+	config.Endpoint, _ = command.Flags().GetString("etcd-s3-endpoint")
+	config.Bucket, _ = command.Flags().GetString("etcd-s3-bucket")
+	config.Folder, _ = command.Flags().GetString("etcd-s3-folder")
+	config.Region, _ = command.Flags().GetString("etcd-s3-region")
+	config.AccessKey, _ = command.Flags().GetString("etcd-s3-access-key")
+	config.SecretKey, _ = command.Flags().GetString("etcd-s3-secret-key")
+	config.Insecure, _ = command.Flags().GetBool("etcd-s3-insecure")
+	config.SkipSSLVerify, _ = command.Flags().GetBool("etcd-s3-skip-ssl-verify")
+
+	if config.Retention < 0 {
+		return nil, fmt.Errorf("--etcd-snapshot-retention must not be negative")
+	}
+
+	s3 := len(config.Endpoint) > 0 || len(config.Folder) > 0 || len(config.Region) > 0 ||
+		len(config.AccessKey) > 0 || len(config.SecretKey) > 0 || config.Insecure || config.SkipSSLVerify
+	if len(config.Bucket) == 0 {
+		if s3 {
+			return nil, fmt.Errorf("give the bucket for etcd snapshots with --etcd-s3-bucket")
+		}
+		return config, nil
+	}
+
+	config.S3 = true
+	if len(config.AccessKey) == 0 {
+		config.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if len(config.SecretKey) == 0 {
+		config.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	return config, nil
+}
+
+func (c *etcdSnapshotConfig) marshal() ([]byte, error) {
+	buf := bytes.Buffer{}
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+
+	return append([]byte("# Written by k3sup\n"), buf.Bytes()...), nil
+}
+
+// configureEtcdSnapshots writes the drop-in config file on the node, which
+// K3s reads when it is next started
+func configureEtcdSnapshots(out io.Writer, op operator.CommandOperator, sudoPrefix string, config *etcdSnapshotConfig, printCommand bool) error {
+	data, err := config.marshal()
+	if err != nil {
+		return err
+	}
+
+	// The command contains the S3 credentials, so is never printed
+	if _, err := executeCommand(op, writeFileCommand(sudoPrefix, etcdSnapshotConfigPath, data, "0600"), false); err != nil {
+		return fmt.Errorf("unable to write %s: %w", etcdSnapshotConfigPath, err)
+	}
+
+	if printCommand {
+		fmt.Fprintf(out, "ssh: write %s with mode 0600\n", etcdSnapshotConfigPath)
+	}
+	fmt.Fprintf(out, "Etcd snapshot settings written to %s\n", etcdSnapshotConfigPath)
+
+	return nil
+}
+
+// checkEtcdS3 lists the snapshots on the node, which includes those in the
+// S3 bucket, to check that the bucket is reachable with the credentials.
+// K3s may still be starting, so the check is retried.
+func checkEtcdS3(out io.Writer, op operator.CommandOperator, sudoPrefix string, config *etcdSnapshotConfig, printCommand bool) error {
+	if !config.S3 {
+		return nil
+	}
+
+	const attempts = 10
+	listCommand := fmt.Sprintf("%sk3s etcd-snapshot ls 2>&1\n", sudoPrefix)
+
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		res, err := executeCommandTo(out, op, listCommand, printCommand && i == 0)
+		if err == nil {
+			err = etcdS3Error(string(res.StdOut))
+		}
+		if err == nil {
+			fmt.Fprintf(out, "S3 bucket %s is reachable\n", config.Bucket)
+			return nil
+		}
+
+		lastErr = err
+		time.Sleep(time.Second * 3)
+	}
+
+	return fmt.Errorf("unable to reach S3 bucket %s for etcd snapshots: %w", config.Bucket, lastErr)
+}
+
+// etcdS3Error finds an error logged by k3s etcd-snapshot, which may exit
+// zero when it cannot list the S3 bucket
+func etcdS3Error(out string) error {
+	for _, line := range strings.Split(out, "\n") {
+		if strings.Contains(line, "level=error") || strings.Contains(line, "level=fatal") {
+			return fmt.Errorf("%s", strings.TrimSpace(line))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func makeEtcdSnapshotConfigCommand(args ...string) (*cobra.Command, error) {
+	command := &cobra.Command{}
+	addEtcdSnapshotConfigFlags(command)
+	return command, command.ParseFlags(args)
+}
+
+func Test_readEtcdSnapshotConfig_NoFlags(t *testing.T) {
+	command, err := makeEtcdSnapshotConfigCommand()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := readEtcdSnapshotConfig(command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config != nil {
+		t.Fatalf("want no config, got %+v", config)
+	}
+}
+
+func Test_readEtcdSnapshotConfig_S3(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret-from-env")
+
+	command, err := makeEtcdSnapshotConfigCommand(
+		"--etcd-snapshot-schedule-cron", "0 */6 * * *",
+		"--etcd-snapshot-retention", "10",
+		"--etcd-s3-endpoint", "127.0.0.1:9000",
+		"--etcd-s3-bucket", "k3s",
+		"--etcd-s3-access-key", "minio",
+		"--etcd-s3-insecure",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := readEtcdSnapshotConfig(command)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := config.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# Written by k3sup
+etcd-snapshot-schedule-cron: 0 */6 * * *
+etcd-snapshot-retention: 10
+etcd-s3: true
+etcd-s3-endpoint: 127.0.0.1:9000
+etcd-s3-bucket: k3s
+etcd-s3-access-key: minio
+etcd-s3-secret-key: secret-from-env
+etcd-s3-insecure: true
+`
+	if string(data) != want {
+		t.Fatalf("want:\n%s\ngot:\n%s", want, string(data))
+	}
+}
+
+func Test_readEtcdSnapshotConfig_S3NeedsBucket(t *testing.T) {
+	command, err := makeEtcdSnapshotConfigCommand("--etcd-s3-endpoint", "127.0.0.1:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = readEtcdSnapshotConfig(command)
+	if err == nil || !strings.Contains(err.Error(), "--etcd-s3-bucket") {
+		t.Fatalf("want an error asking for the bucket, got: %v", err)
+	}
+}
+
+func Test_etcdS3Error(t *testing.T) {
+	ok := "Name Location Size Created\n"
+	if err := etcdS3Error(ok); err != nil {
+		t.Errorf("want no error, got: %s", err)
+	}
+
+	failed := `time="2024-06-10T10:00:00Z" level=error msg="failed to list S3 snapshots: bucket k3s does not exist"` + "\n"
+	if err := etcdS3Error(failed); err == nil {
+		t.Errorf("want an error")
+	}
+}
@@ -0,0 +1,372 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/alexellis/k3sup/pkg"
+	operator "github.com/alexellis/k3sup/pkg/operator"
+	"github.com/spf13/cobra"
+)
+
+// clusterResetTokenScript runs the cluster reset with the token in a file
+// only root can read, so that it is never on a command line, where ps
+// would show it
+const clusterResetTokenScript = `set -e
+tmp=$(%[1]smktemp -d)
+trap '%[1]srm -rf "$tmp"' EXIT
+%[2]s%[3]s --token-file "$tmp/token" 2>&1
+`
+
+// MakeEtcdSnapshot creates the etcd-snapshot parent command
+func MakeEtcdSnapshot() *cobra.Command {
+	var command = &cobra.Command{
+		Use:   "etcd-snapshot",
+		Short: "Manage etcd snapshots of a cluster with embedded etcd",
+		Long: `Save, list, prune, download and restore etcd snapshots of a cluster
+created with install --cluster.
+
+The k3s etcd-snapshot command is run over SSH on a server. Snapshots are
+kept on the server in the snapshots directory of its data directory.
+
+` + pkg.SupportMessageShort + `
+`,
+		SilenceUsage: true,
+	}
+
+	return command
+}
+
+// MakeEtcdSnapshotSave creates the etcd-snapshot save command
+func MakeEtcdSnapshotSave() *cobra.Command {
+	var command = &cobra.Command{
+		Use:          "save",
+		Short:        "Take an on-demand snapshot",
+		Example:      `  k3sup etcd-snapshot save --host SERVER_IP --name before-upgrade`,
+		SilenceUsage: true,
+	}
+
+	addServerFlags(command)
+	command.Flags().String("name", "", "Prefix for the name of the snapshot, the node name and a timestamp are appended by K3s")
+
+	command.RunE = func(command *cobra.Command, args []string) error {
+		name, _ := command.Flags().GetString("name")
+
+		snapshotArgs := ""
+		if len(name) > 0 {
+			snapshotArgs = " --name " + name
+		}
+
+		return runEtcdSnapshot(command, "save"+snapshotArgs)
+	}
+
+	return command
+}
+
+// MakeEtcdSnapshotList creates the etcd-snapshot ls command
+func MakeEtcdSnapshotList() *cobra.Command {
+	var command = &cobra.Command{
+		Use:          "ls",
+		Short:        "List snapshots",
+		Example:      `  k3sup etcd-snapshot ls --host SERVER_IP`,
+		SilenceUsage: true,
+	}
+
+	addServerFlags(command)
+
+	command.RunE = func(command *cobra.Command, args []string) error {
+		return runEtcdSnapshot(command, "ls")
+	}
+
+	return command
+}
+
+// MakeEtcdSnapshotPrune creates the etcd-snapshot prune command
+func MakeEtcdSnapshotPrune() *cobra.Command {
+	var command = &cobra.Command{
+		Use:          "prune",
+		Short:        "Delete snapshots beyond the retention count",
+		Example:      `  k3sup etcd-snapshot prune --host SERVER_IP --snapshot-retention 3`,
+		SilenceUsage: true,
+	}
+
+	addServerFlags(command)
+	command.Flags().Int("snapshot-retention", 5, "Number of snapshots to keep")
+	command.Flags().String("name", "", "Only prune snapshots with this name prefix")
+
+	command.RunE = func(command *cobra.Command, args []string) error {
+		retention, _ := command.Flags().GetInt("snapshot-retention")
+		name, _ := command.Flags().GetString("name")
+
+		snapshotArgs := fmt.Sprintf("prune --snapshot-retention %d", retention)
+		if len(name) > 0 {
+			snapshotArgs += " --name " + name
+		}
+
+		return runEtcdSnapshot(command, snapshotArgs)
+	}
+
+	return command
+}
+
+// MakeEtcdSnapshotDownload creates the etcd-snapshot download command
+func MakeEtcdSnapshotDownload() *cobra.Command {
+	var command = &cobra.Command{
+		Use:   "download",
+		Short: "Download a snapshot to the local machine",
+		Example: `  # Download a snapshot to the current directory
+  k3sup etcd-snapshot download --host SERVER_IP \
+    --snapshot on-demand-server-1-1718000000`,
+		SilenceUsage: true,
+	}
+
+	addServerFlags(command)
+	command.Flags().String("snapshot", "", "Name of the snapshot, or its path on the server")
+	command.Flags().String("local-path", "", "Local path to save the snapshot to, defaults to its name in the current directory")
+
+	command.PreRunE = func(command *cobra.Command, args []string) error {
+		snapshot, _ := command.Flags().GetString("snapshot")
+		if len(snapshot) == 0 {
+			return fmt.Errorf("give the snapshot to download with --snapshot")
+		}
+		return nil
+	}
+
+	command.RunE = func(command *cobra.Command, args []string) error {
+		snapshot, _ := command.Flags().GetString("snapshot")
+		localPath, _ := command.Flags().GetString("local-path")
+		dataDir, _ := command.Flags().GetString("server-data-dir")
+		sudoPrefix, printCommand := serverOptions(command)
+
+		remotePath := snapshotPath(dataDir, snapshot)
+		if len(localPath) == 0 {
+			localPath = path.Base(remotePath)
+		}
+
+		op, done, err := connectServer(command)
+		if err != nil {
+			return err
+		}
+		defer done()
+
+		res, err := executeCommand(op, fmt.Sprintf("%ssha256sum %s\n", sudoPrefix, remotePath), printCommand)
+		if err != nil {
+			return fmt.Errorf("unable to find snapshot %s: %w", remotePath, err)
+		}
+		wantSum, _, _ := strings.Cut(strings.TrimSpace(string(res.StdOut)), " ")
+
+		res, err = executeCommand(op, fmt.Sprintf("%scat %s\n", sudoPrefix, remotePath), printCommand)
+		if err != nil {
+			return fmt.Errorf("unable to download snapshot %s: %w", remotePath, err)
+		}
+
+		sum := sha256.Sum256(res.StdOut)
+		if gotSum := hex.EncodeToString(sum[:]); gotSum != wantSum {
+			return fmt.Errorf("checksum of the downloaded snapshot %s does not match %s on the server", gotSum, wantSum)
+		}
+
+		if err := os.WriteFile(localPath, res.StdOut, 0600); err != nil {
+			return err
+		}
+
+		fmt.Printf("Saved %s (%d bytes) to %s\n", remotePath, len(res.StdOut), localPath)
+
+		return nil
+	}
+
+	return command
+}
+
+// MakeEtcdSnapshotRestore creates the etcd-snapshot restore command
+func MakeEtcdSnapshotRestore() *cobra.Command {
+	var command = &cobra.Command{
+		Use:   "restore",
+		Short: "Restore the cluster from a snapshot",
+		Long: `Restore a cluster with embedded etcd from a snapshot.
+
+K3s is stopped on every server. The first server is reset to the
+snapshot with k3s server --cluster-reset, then started. Only once it is
+ready, with a healthy etcd, is the etcd data of each other server
+deleted, then each is started in turn so that it rejoins the cluster
+from the first server.
+
+The snapshot must be on the first server.
+
+` + pkg.SupportMessageShort + `
+`,
+		Example: `  k3sup etcd-snapshot restore \
+    --server SERVER_1,SERVER_2,SERVER_3 \
+    --snapshot on-demand-server-1-1718000000 \
+    --yes`,
+		SilenceUsage: true,
+	}
+
+	command.Flags().StringSlice("server", []string{}, "Hostname or IP of each server, the first is restored from the snapshot, repeat the flag or give a comma-separated list")
+	command.Flags().String("user", "root", "Username for SSH login")
+	command.Flags().String("ssh-key", "~/.ssh/id_rsa", "The ssh key to use for remote login")
+	command.Flags().Int("ssh-port", 22, "The port on which to connect for ssh")
+	command.Flags().Bool("sudo", true, "Use sudo for commands. e.g. set to false when using the root user and no sudo is available.")
+	command.Flags().Bool("print-command", false, "Print the commands to be executed")
+	command.Flags().String("server-data-dir", "/var/lib/rancher/k3s/", "Data directory of K3s on each server")
+
+	command.Flags().String("snapshot", "", "Name of the snapshot on the first server, or its path")
+	command.Flags().String("token", "", "Token of the cluster the snapshot was taken from, if different to the current token")
+	command.Flags().Bool("yes", false, "Confirm that K3s is to be stopped on every server and the cluster reset")
+
+	command.Flags().Int("attempts", 60, "Number of attempts to check if a server is ready after starting it")
+	command.Flags().Duration("pause", time.Second*2, "Pause between checking a server for readiness")
+
+	command.PreRunE = func(command *cobra.Command, args []string) error {
+		servers, _ := command.Flags().GetStringSlice("server")
+		if len(servers) == 0 {
+			return fmt.Errorf("give every server with --server")
+		}
+
+		snapshot, _ := command.Flags().GetString("snapshot")
+		if len(snapshot) == 0 {
+			return fmt.Errorf("give the snapshot to restore with --snapshot")
+		}
+
+		yes, _ := command.Flags().GetBool("yes")
+		if !yes {
+			return fmt.Errorf("restoring stops K3s on every server and resets the cluster, pass --yes to confirm")
+		}
+
+		return nil
+	}
+
+	command.RunE = func(command *cobra.Command, args []string) error {
+		servers, _ := command.Flags().GetStringSlice("server")
+		user, _ := command.Flags().GetString("user")
+		sshKey, _ := command.Flags().GetString("ssh-key")
+		port, _ := command.Flags().GetInt("ssh-port")
+		dataDir, _ := command.Flags().GetString("server-data-dir")
+		snapshot, _ := command.Flags().GetString("snapshot")
+		token, _ := command.Flags().GetString("token")
+		attempts, _ := command.Flags().GetInt("attempts")
+		pause, _ := command.Flags().GetDuration("pause")
+		sudoPrefix, printCommand := serverOptions(command)
+
+		sshKeyPath := expandPath(sshKey)
+
+		operators := []operator.CommandOperator{}
+		for _, server := range servers {
+			address := fmt.Sprintf("%s:%d", server, port)
+			sshOperator, sshOperatorDone, errored, err := connectOperator(user, address, sshKeyPath)
+			if errored {
+				return fmt.Errorf("%s: %w", server, err)
+			}
+			if sshOperatorDone != nil {
+				defer sshOperatorDone()
+			}
+			operators = append(operators, sshOperator)
+		}
+
+		restorePath := snapshotPath(dataDir, snapshot)
+		if _, err := executeCommand(operators[0], fmt.Sprintf("%stest -f %s\n", sudoPrefix, restorePath), printCommand); err != nil {
+			return fmt.Errorf("snapshot %s was not found on %s", restorePath, servers[0])
+		}
+
+		for i, server := range servers {
+			fmt.Printf("Stopping K3s on %s\n", server)
+			if _, err := executeCommand(operators[i], fmt.Sprintf("%ssystemctl stop k3s\n", sudoPrefix), printCommand); err != nil {
+				return fmt.Errorf("%s: unable to stop K3s: %w", server, err)
+			}
+		}
+
+		fmt.Printf("Restoring %s on %s\n", restorePath, servers[0])
+		// The command holds the token when one is given, so it is not
+		// printed then
+		if _, err := executeCommand(operators[0], makeClusterResetCommand(sudoPrefix, dataDir, restorePath, token), printCommand && len(token) == 0); err != nil {
+			return fmt.Errorf("%s: unable to reset the cluster: %w", servers[0], err)
+		}
+
+		// The etcd data of the other servers is only deleted once the
+		// restored server is serving, so a failed reset leaves them as
+		// they were
+		fmt.Printf("Starting K3s on %s\n", servers[0])
+		if err := startServer(operators[0], sudoPrefix, attempts, pause, printCommand); err != nil {
+			return fmt.Errorf("%s: %w, the etcd data of the other servers was not changed", servers[0], err)
+		}
+		if _, err := executeCommand(operators[0], fmt.Sprintf("%sk3s kubectl get --raw /readyz/etcd\n", sudoPrefix), printCommand); err != nil {
+			return fmt.Errorf("%s: etcd is not healthy after the reset, the etcd data of the other servers was not changed: %w", servers[0], err)
+		}
+
+		for i, server := range servers[1:] {
+			fmt.Printf("Deleting the etcd data of %s\n", server)
+			wipeCommand := fmt.Sprintf("%srm -rf %s\n", sudoPrefix, path.Join(dataDir, "server/db"))
+			if _, err := executeCommand(operators[i+1], wipeCommand, printCommand); err != nil {
+				return fmt.Errorf("%s: unable to delete the etcd data: %w", server, err)
+			}
+
+			fmt.Printf("Starting K3s on %s\n", server)
+			if err := startServer(operators[i+1], sudoPrefix, attempts, pause, printCommand); err != nil {
+				return fmt.Errorf("%s: %w", server, err)
+			}
+		}
+
+		fmt.Printf("Restored the cluster from %s\n", snapshot)
+
+		return nil
+	}
+
+	return command
+}
+
+// startServer starts K3s on a server and waits for it to be ready
+func startServer(op operator.CommandOperator, sudoPrefix string, attempts int, pause time.Duration, printCommand bool) error {
+	if _, err := executeCommand(op, fmt.Sprintf("%ssystemctl start k3s\n", sudoPrefix), printCommand); err != nil {
+		return fmt.Errorf("unable to start K3s: %w", err)
+	}
+
+	return waitForServerReady(op, sudoPrefix, attempts, pause, printCommand)
+}
+
+// runEtcdSnapshot runs k3s etcd-snapshot with snapshotArgs on the server
+// and prints its output
+func runEtcdSnapshot(command *cobra.Command, snapshotArgs string) error {
+	dataDir, _ := command.Flags().GetString("server-data-dir")
+	sudoPrefix, printCommand := serverOptions(command)
+
+	op, done, err := connectServer(command)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	snapshotCommand := fmt.Sprintf("%sk3s etcd-snapshot %s --data-dir %s 2>&1\n", sudoPrefix, snapshotArgs, dataDir)
+	res, err := executeCommand(op, snapshotCommand, printCommand)
+	if err != nil {
+		return fmt.Errorf("unable to run k3s etcd-snapshot: %w", err)
+	}
+
+	fmt.Print(ensureTrailingNewline(string(res.StdOut)))
+
+	return nil
+}
+
+// snapshotPath gives the path of a snapshot on the server, which is in the
+// snapshots directory unless a path is given
+func snapshotPath(dataDir, snapshot string) string {
+	if strings.Contains(snapshot, "/") {
+		return snapshot
+	}
+	return path.Join(dataDir, "server/db/snapshots", snapshot)
+}
+
+// makeClusterResetCommand gives the command to reset etcd to the snapshot
+// at restorePath, which exits once the reset is complete. A token is
+// given to K3s in a file, not on the command line.
+func makeClusterResetCommand(sudoPrefix, dataDir, restorePath, token string) string {
+	resetCommand := fmt.Sprintf("%sk3s server --cluster-reset --cluster-reset-restore-path=%s --data-dir %s", sudoPrefix, restorePath, dataDir)
+	if len(token) == 0 {
+		return resetCommand + " 2>&1\n"
+	}
+	return fmt.Sprintf(clusterResetTokenScript, sudoPrefix,
+		writeFileCommand(sudoPrefix, "$tmp/token", []byte(token), "0600"), resetCommand)
+}
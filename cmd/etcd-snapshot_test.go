@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_snapshotPath(t *testing.T) {
+	got := snapshotPath("/var/lib/rancher/k3s/", "on-demand-server-1-1718000000")
+	want := "/var/lib/rancher/k3s/server/db/snapshots/on-demand-server-1-1718000000"
+	if got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+
+	got = snapshotPath("/var/lib/rancher/k3s/", "/mnt/backup/snapshot-1")
+	if got != "/mnt/backup/snapshot-1" {
+		t.Errorf("want the path unchanged, got %s", got)
+	}
+}
+
+func Test_makeClusterResetCommand(t *testing.T) {
+	tests := []struct {
+		title string
+		token string
+		want  string
+	}{
+		{
+			title: "current token",
+			want:  "sudo k3s server --cluster-reset --cluster-reset-restore-path=/tmp/snap --data-dir /var/lib/rancher/k3s/ 2>&1\n",
+		},
+		{
+			title: "token from the snapshot's cluster",
+			token: "K10abc",
+			want: `set -e
+tmp=$(sudo mktemp -d)
+trap 'sudo rm -rf "$tmp"' EXIT
+sudo mkdir -p $tmp && sudo install -m 0600 /dev/null $tmp/token && cat <<'K3SUP_EOF' | sudo tee $tmp/token > /dev/null
+K10abc
+K3SUP_EOF
+sudo k3s server --cluster-reset --cluster-reset-restore-path=/tmp/snap --data-dir /var/lib/rancher/k3s/ --token-file "$tmp/token" 2>&1
+`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.title, func(t *testing.T) {
+			got := makeClusterResetCommand("sudo ", "/var/lib/rancher/k3s/", "/tmp/snap", tc.token)
+			if got != tc.want {
+				t.Errorf("want %q, got %q", tc.want, got)
+			}
+			if strings.Contains(got, "--token "+tc.token) {
+				t.Errorf("the token must not be on the command line: %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/alexellis/k3sup/pkg"
+	"github.com/spf13/cobra"
+)
+
+// MakeForgetConfig creates the forget-config command
+func MakeForgetConfig() *cobra.Command {
+	var command = &cobra.Command{
+		Use:   "forget-config",
+		Short: "Remove a cluster's context from a local kubeconfig",
+		Long: `Remove a context from a local kubeconfig, along with the cluster and
+user entries which only it refers to. This undoes "--merge" from the
+install and get-config commands.
+
+A copy of the previous file is kept alongside it.
+
+` + pkg.SupportMessageShort + `
+`,
+		Example: `  # Remove the k3s-prod-eu-1 context from the default kubeconfig
+  k3sup forget-config --context k3s-prod-eu-1
+
+  # Remove a context from a kubeconfig in another location
+  k3sup forget-config \
+    --local-path $HOME/.kube/kubeconfig \
+    --context k3s-prod-eu-1`,
+		SilenceUsage: true,
+	}
+
+	command.Flags().String("local-path", "~/.kube/config", "Local path to the kubeconfig file")
+	command.Flags().String("context", "", "Name of the kubeconfig context to remove")
+
+	command.PreRunE = func(command *cobra.Command, args []string) error {
+		context, err := command.Flags().GetString("context")
+		if err != nil {
+			return err
+		}
+
+		if len(context) == 0 {
+			return fmt.Errorf("--context is required")
+		}
+
+		return nil
+	}
+
+	command.RunE = func(command *cobra.Command, args []string) error {
+		localKubeconfig, _ := command.Flags().GetString("local-path")
+		context, _ := command.Flags().GetString("context")
+
+		absPath, _ := filepath.Abs(expandPath(localKubeconfig))
+
+		if err := forgetConfig(absPath, context); err != nil {
+			return err
+		}
+
+		fmt.Printf("Removed context %s from: %s\n", context, absPath)
+
+		return nil
+	}
+
+	return command
+}
+
+// forgetConfig removes context from the kubeconfig at path, keeping a
+// backup of the previous file
+func forgetConfig(path, context string) error {
+	config, err := loadKubeconfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := removeContext(config, context); err != nil {
+		return fmt.Errorf("%w in %s", err, path)
+	}
+
+	data, err := marshalKubeconfig(config)
+	if err != nil {
+		return err
+	}
+
+	backup, err := backupConfig(path)
+	if err != nil {
+		return err
+	}
+	if len(backup) > 0 {
+		fmt.Printf("Previous kubeconfig saved to: %s\n", backup)
+	}
+
+	return writeConfig(io.Discard, path, data, context, true)
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/alexellis/k3sup/pkg"
 	operator "github.com/alexellis/k3sup/pkg/operator"
@@ -34,7 +36,30 @@ func MakeGetConfig() *cobra.Command {
 
   # Get kubeconfig from local installation directly on a server
   # where you ran "k3sup install --local"
-  k3sup get-config --local`,
+  k3sup get-config --local
+
+  # Point the kubeconfig at a load balancer or DNS name rather
+  # than the host used for SSH
+  k3sup get-config --host HOST \
+    --api-server-url https://k3s.example.com:6443
+
+  # Create a kubeconfig for a teammate with read-only access to
+  # the "dev" namespace, using a token valid for 8 hours
+  k3sup get-config --host HOST \
+    --user-name alice \
+    --role view \
+    --namespace dev \
+    --token-ttl 8h \
+    --local-path ./alice.kubeconfig
+
+  # Revoke the teammate's access
+  k3sup get-config --host HOST \
+    --user-name alice \
+    --namespace dev \
+    --revoke
+
+  # Get the kubeconfig of a cluster recorded by k3sup install
+  k3sup get-config --cluster prod`,
 		SilenceUsage: true,
 	}
 
@@ -45,13 +70,26 @@ func MakeGetConfig() *cobra.Command {
 	command.Flags().Int("ssh-port", 22, "The port on which to connect for ssh")
 	command.Flags().Bool("sudo", true, "Use sudo for kubeconfig retrieval. e.g. set to false when using the root user and no sudo is available.")
 	command.Flags().String("local-path", "kubeconfig", "Local path to save the kubeconfig file")
-	command.Flags().String("context", "default", "Set the name of the kubeconfig context.")
+	command.Flags().String("context", "default", "Set the name of the kubeconfig context. With --user-name, the context is USER-NAME@CONTEXT unless --context is given")
 	command.Flags().Bool("merge", false, `Merge the config with existing kubeconfig if it already exists.
 Provide the --local-path flag with --merge if a kubeconfig already exists in some other directory`)
+	command.Flags().Bool("use-context", false, "Set the current-context to the value of --context when merging into an existing kubeconfig")
 	command.Flags().Bool("print-command", false, "Print a command that you can use with SSH to manually recover from an error")
 	command.Flags().Bool("local", false, "Perform a local get-config without using ssh")
+	command.Flags().String("api-server-url", "", "URL of the API server to write into the kubeconfig, if different from the host, i.e. https://k3s.example.com:6443 for a load balancer")
+
+	command.Flags().String("user-name", "", "Create a ServiceAccount with this name and write a kubeconfig for it, instead of the cluster-admin kubeconfig")
+	command.Flags().String("role", "view", "Role to grant to --user-name: view, edit or admin")
+	command.Flags().String("namespace", "", "Limit the --role of --user-name to this namespace, leave empty to grant it across the cluster")
+	command.Flags().Duration("token-ttl", time.Hour*24, "How long the token for --user-name is valid")
+	command.Flags().Bool("revoke", false, "Delete the ServiceAccount and binding for --user-name, revoking its tokens")
+	addClusterFlag(command)
 
 	command.PreRunE = func(command *cobra.Command, args []string) error {
+		if err := fillFromCluster(command, serverClusterValues); err != nil {
+			return err
+		}
+
 		local, err := command.Flags().GetBool("local")
 		if err != nil {
 			return err
@@ -71,6 +109,24 @@ Provide the --local-path flag with --merge if a kubeconfig already exists in som
 				return err
 			}
 		}
+
+		if apiServerURL, _ := command.Flags().GetString("api-server-url"); len(apiServerURL) > 0 {
+			if _, err := parseAPIServerURL(apiServerURL); err != nil {
+				return err
+			}
+		}
+
+		userName, _ := command.Flags().GetString("user-name")
+		if len(userName) > 0 {
+			role, _ := command.Flags().GetString("role")
+			namespace, _ := command.Flags().GetString("namespace")
+			if err := validateScopedUser(userName, role, namespace); err != nil {
+				return err
+			}
+		} else if revoke, _ := command.Flags().GetBool("revoke"); revoke {
+			return fmt.Errorf("--revoke can only be used with --user-name")
+		}
+
 		return nil
 	}
 
@@ -116,42 +172,95 @@ Provide the --local-path flag with --merge if a kubeconfig already exists in som
 		if err != nil {
 			return err
 		}
+		useContext, err := command.Flags().GetBool("use-context")
+		if err != nil {
+			return err
+		}
+
+		apiServerURL, _ := command.Flags().GetString("api-server-url")
+
+		userName, _ := command.Flags().GetString("user-name")
+		role, _ := command.Flags().GetString("role")
+		namespace, _ := command.Flags().GetString("namespace")
+		tokenTTL, _ := command.Flags().GetDuration("token-ttl")
+		revoke, _ := command.Flags().GetBool("revoke")
 
 		getConfigcommand := fmt.Sprintf("%scat /etc/rancher/k3s/k3s.yaml\n", sudoPrefix)
 
+		var op operator.CommandOperator
 		if local {
-			operator := operator.ExecOperator{}
+			op = operator.ExecOperator{}
+		} else {
+			fmt.Println("Public IP: " + host)
+
+			port, _ := command.Flags().GetInt("ssh-port")
+			user, _ := command.Flags().GetString("user")
+			sshKey, _ := command.Flags().GetString("ssh-key")
+
+			sshKeyPath := expandPath(sshKey)
+			address := fmt.Sprintf("%s:%d", host, port)
 
-			if err = obtainKubeconfig(operator, getConfigcommand, host, context, localKubeconfig, merge); err != nil {
+			sshOperator, sshOperatorDone, errored, err := connectOperator(user, address, sshKeyPath)
+			if errored {
 				return err
 			}
 
-			return nil
+			if sshOperatorDone != nil {
+				defer sshOperatorDone()
+			}
+			op = sshOperator
 		}
 
-		fmt.Println("Public IP: " + host)
+		if len(userName) > 0 {
+			if !command.Flags().Changed("context") {
+				context = scopedUserContext(userName, context)
+			}
 
-		port, _ := command.Flags().GetInt("ssh-port")
-		user, _ := command.Flags().GetString("user")
-		sshKey, _ := command.Flags().GetString("ssh-key")
+			if revoke {
+				if err := revokeScopedUser(op, sudoPrefix, userName, namespace, printCommand); err != nil {
+					return err
+				}
+				fmt.Printf("Revoked access for user: %s\n", userName)
+				return nil
+			}
 
-		sshKeyPath := expandPath(sshKey)
-		address := fmt.Sprintf("%s:%d", host, port)
+			if printCommand {
+				fmt.Printf("ssh: %s\n", getConfigcommand)
+			}
 
-		sshOperator, sshOperatorDone, errored, err := connectOperator(user, address, sshKeyPath)
-		if errored {
-			return err
-		}
+			kubeconfig, err := fetchKubeconfig(command.OutOrStdout(), op, getConfigcommand, host, context, apiServerURL)
+			if err != nil {
+				return err
+			}
+
+			token, err := createScopedUser(op, sudoPrefix, userName, role, namespace, tokenTTL, printCommand)
+			if err != nil {
+				return err
+			}
+
+			kubeconfig, err = scopeKubeconfig(kubeconfig, token, namespace)
+			if err != nil {
+				return err
+			}
 
-		if sshOperatorDone != nil {
-			defer sshOperatorDone()
+			if err := saveKubeconfig(command.OutOrStdout(), kubeconfig, context, localKubeconfig, merge, useContext); err != nil {
+				return err
+			}
+
+			fmt.Printf(`Created user %s with the %s role, the token expires in %s
+
+# Revoke access with:
+%s
+`, userName, role, tokenTTL, makeRevokeCommand(command, userName, namespace))
+
+			return nil
 		}
 
-		if printCommand {
+		if printCommand && !local {
 			fmt.Printf("ssh: %s\n", getConfigcommand)
 		}
 
-		if err = obtainKubeconfig(sshOperator, getConfigcommand, host, context, localKubeconfig, merge); err != nil {
+		if err = obtainKubeconfig(command.OutOrStdout(), op, getConfigcommand, host, context, localKubeconfig, apiServerURL, merge, useContext); err != nil {
 			return err
 		}
 
@@ -160,3 +269,23 @@ Provide the --local-path flag with --merge if a kubeconfig already exists in som
 
 	return command
 }
+
+// makeRevokeCommand prints the get-config command which revokes the
+// access given to userName, connecting to the same server as command
+func makeRevokeCommand(command *cobra.Command, userName, namespace string) string {
+	parts := []string{"k3sup get-config"}
+
+	for _, name := range []string{"cluster", "host", "ip", "user", "ssh-key", "ssh-port", "sudo", "local"} {
+		if f := command.Flags().Lookup(name); f != nil && f.Changed {
+			parts = append(parts, fmt.Sprintf("--%s=%s", name, shellArg(f.Value.String())))
+		}
+	}
+
+	parts = append(parts, fmt.Sprintf("--user-name %s", shellArg(userName)))
+	if len(namespace) > 0 {
+		parts = append(parts, fmt.Sprintf("--namespace %s", shellArg(namespace)))
+	}
+	parts = append(parts, "--revoke")
+
+	return strings.Join(parts, " \\\n  ")
+}
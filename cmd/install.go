@@ -3,10 +3,10 @@ package cmd
 import (
 	"bytes"
 	"fmt"
-	"log"
+	"io"
 	"net"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -81,7 +81,26 @@ func MakeInstall() *cobra.Command {
 
   # Use a custom path to your SSH key
   k3sup install --host HOST \
-    --ssh-key $HOME/ec2-key.pem`,
+    --ssh-key $HOME/ec2-key.pem
+
+  # Add extra TLS SANs for a load balancer and a DNS name
+  k3sup install --host HOST \
+    --tls-san 192.168.0.100 \
+    --tls-san k3s.example.com
+
+  # Point the kubeconfig at a load balancer in front of the server
+  k3sup install --host HOST \
+    --tls-san k3s.example.com \
+    --api-server-url https://k3s.example.com:6443
+
+  # Issue the cluster's certificates from your own CA, generating the
+  # K3s CAs from it with the script whose sha256 you checked
+  k3sup install --host HOST --cluster \
+    --custom-ca-dir ./pki --custom-ca-script-sha256 SHA256
+
+  # Record the cluster as prod, then join an agent to it by name
+  k3sup install --host HOST --user ubuntu --cluster-name prod
+  k3sup join --host AGENT --cluster prod`,
 		SilenceUsage: true,
 	}
 
@@ -94,6 +113,7 @@ func MakeInstall() *cobra.Command {
 	command.Flags().Int("ssh-port", 22, "The port on which to connect for ssh")
 	command.Flags().Bool("sudo", true, "Use sudo for installation. e.g. set to false when using the root user and no sudo is available.")
 	command.Flags().Bool("skip-install", false, "Skip the k3s installer")
+	command.Flags().Bool("skip-preflight", false, "Skip the preflight checks on the host before installing")
 
 	command.Flags().String("local-path", "kubeconfig", "Local path to save the kubeconfig file")
 	command.Flags().String("context", "default", "Set the name of the kubeconfig context.")
@@ -102,6 +122,7 @@ func MakeInstall() *cobra.Command {
 	command.Flags().Bool("ipsec", false, "Enforces and/or activates optional extra argument for k3s: flannel-backend option: ipsec")
 	command.Flags().Bool("merge", false, `Merge the config with existing kubeconfig if it already exists.
 Provide the --local-path flag with --merge if a kubeconfig already exists in some other directory`)
+	command.Flags().Bool("use-context", false, "Set the current-context to the value of --context when merging into an existing kubeconfig")
 	command.Flags().Bool("local", false, "Perform a local install without using ssh")
 	command.Flags().Bool("cluster", false, "Form a cluster using embedded etcd (requires K8s >= 1.19)")
 
@@ -113,7 +134,16 @@ Provide the --local-path flag with --merge if a kubeconfig already exists in som
 	command.Flags().String("k3s-extra-args", "", "Additional arguments to pass to k3s installer, wrapped in quotes (e.g. --k3s-extra-args '--disable servicelb')")
 	command.Flags().String("k3s-channel", PinnedK3sChannel, "Release channel: stable, latest, or pinned v1.19")
 
-	command.Flags().String("tls-san", "", "Use an additional IP or hostname for the API server")
+	command.Flags().StringSlice("tls-san", []string{}, "Use additional IPs or hostnames for the API server, repeat the flag or give a comma-separated list. The host is always included.")
+	command.Flags().String("api-server-url", "", "URL of the API server to write into the kubeconfig, if different from the host, i.e. https://k3s.example.com:6443 for a load balancer")
+
+	command.Flags().String("custom-ca-dir", "", "Local directory with a root-ca.pem and an intermediate CA, or the full set of K3s CA certificates, to use before the first start of K3s")
+	command.Flags().String("custom-ca-script-sha256", "", "sha256 of the K3s script which generates the CA certificates from --custom-ca-dir, needed unless the full set is given")
+
+	command.Flags().String("cluster-name", "", "Name to record the cluster under in "+clusterStateDir+", the cluster is only recorded when given")
+	command.Flags().Bool("save-node-token", false, "Save the node token with the cluster record, so that join --cluster does not need to fetch it")
+
+	addEtcdSnapshotConfigFlags(command)
 
 	command.PreRunE = func(command *cobra.Command, args []string) error {
 
@@ -136,12 +166,47 @@ Provide the --local-path flag with --merge if a kubeconfig already exists in som
 				return err
 			}
 		}
+
+		if apiServerURL, _ := command.Flags().GetString("api-server-url"); len(apiServerURL) > 0 {
+			if _, err := parseAPIServerURL(apiServerURL); err != nil {
+				return err
+			}
+		}
+
+		if customCADir, _ := command.Flags().GetString("custom-ca-dir"); len(customCADir) > 0 {
+			ca, err := loadCustomCA(expandPath(customCADir))
+			if err != nil {
+				return err
+			}
+			scriptSHA256, _ := command.Flags().GetString("custom-ca-script-sha256")
+			if err := checkCustomCAScript(ca, scriptSHA256); err != nil {
+				return err
+			}
+		}
+
+		if name, _ := command.Flags().GetString("cluster-name"); len(name) > 0 {
+			if _, err := clusterDir(name); err != nil {
+				return err
+			}
+		} else if saveToken, _ := command.Flags().GetBool("save-node-token"); saveToken {
+			return fmt.Errorf("--save-node-token needs --cluster-name, to save the token with the cluster record")
+		}
+
+		snapshotConfig, err := readEtcdSnapshotConfig(command)
+		if err != nil {
+			return err
+		}
+		if cluster, _ := command.Flags().GetBool("cluster"); snapshotConfig != nil && !cluster {
+			return fmt.Errorf("etcd snapshots need embedded etcd, use --cluster")
+		}
+
 		return nil
 	}
 
 	command.RunE = func(command *cobra.Command, args []string) error {
+		out := command.OutOrStdout()
 
-		fmt.Printf("Running: k3sup install\n")
+		fmt.Fprintf(out, "Running: k3sup install\n")
 
 		localKubeconfig, _ := command.Flags().GetString("local-path")
 
@@ -149,8 +214,10 @@ Provide the --local-path flag with --merge if a kubeconfig already exists in som
 		if err != nil {
 			return err
 		}
+		skipPreflight, _ := command.Flags().GetBool("skip-preflight")
 
-		tlsSAN, _ := command.Flags().GetString("tls-san")
+		tlsSANs, _ := command.Flags().GetStringSlice("tls-san")
+		apiServerURL, _ := command.Flags().GetString("api-server-url")
 
 		useSudo, err := command.Flags().GetBool("sudo")
 		if err != nil {
@@ -196,7 +263,7 @@ Provide the --local-path flag with --merge if a kubeconfig already exists in som
 			host = ip.String()
 		}
 
-		log.Println(host)
+		fmt.Fprintln(out, host)
 
 		cluster, _ := command.Flags().GetBool("cluster")
 		datastore, _ := command.Flags().GetString("datastore")
@@ -213,6 +280,10 @@ Provide the --local-path flag with --merge if a kubeconfig already exists in som
 		if err != nil {
 			return err
 		}
+		useContext, err := command.Flags().GetBool("use-context")
+		if err != nil {
+			return err
+		}
 
 		token, err := command.Flags().GetString("token")
 		if err != nil {
@@ -231,7 +302,7 @@ Provide the --local-path flag with --merge if a kubeconfig already exists in som
 			}
 		}
 
-		installk3sExec := makeInstallExec(cluster, host, tlsSAN,
+		installk3sExec := makeInstallExec(cluster, host, tlsSANs,
 			k3sExecOptions{
 				Datastore:    datastore,
 				Token:        token,
@@ -244,6 +315,23 @@ Provide the --local-path flag with --merge if a kubeconfig already exists in som
 			return fmt.Errorf("give a value for --k3s-version or --k3s-channel")
 		}
 
+		snapshotConfig, err := readEtcdSnapshotConfig(command)
+		if err != nil {
+			return err
+		}
+
+		var ca *customCA
+		if customCADir, _ := command.Flags().GetString("custom-ca-dir"); len(customCADir) > 0 {
+			if ca, err = loadCustomCA(expandPath(customCADir)); err != nil {
+				return err
+			}
+			if ca.rootKeyDropped {
+				fmt.Fprintf(out, "root-ca.key in %s is not needed and will not be copied to the server\n", customCADir)
+			}
+			ca.scriptSHA256, _ = command.Flags().GetString("custom-ca-script-sha256")
+		}
+		dataDir := k3sExtraArg(k3sExtraArgs, "--data-dir", "/var/lib/rancher/k3s")
+
 		installStr := createVersionStr(k3sVersion, k3sChannel)
 
 		installK3scommand := fmt.Sprintf("%s | %s %s sh -\n", getScript, installk3sExec, installStr)
@@ -254,7 +342,25 @@ Provide the --local-path flag with --merge if a kubeconfig already exists in som
 			operator := operator.ExecOperator{}
 
 			if !skipInstall {
-				fmt.Printf("Executing: %s\n", installK3scommand)
+				if !skipPreflight {
+					if err := preflight(out, operator, host, "server"); err != nil {
+						return err
+					}
+				}
+
+				if ca != nil {
+					if err := provisionCustomCA(out, operator, sudoPrefix, dataDir, ca, printCommand); err != nil {
+						return err
+					}
+				}
+
+				if snapshotConfig != nil {
+					if err := configureEtcdSnapshots(out, operator, sudoPrefix, snapshotConfig, printCommand); err != nil {
+						return err
+					}
+				}
+
+				fmt.Fprintf(out, "Executing: %s\n", installK3scommand)
 
 				res, err := operator.Execute(installK3scommand)
 				if err != nil {
@@ -263,25 +369,37 @@ Provide the --local-path flag with --merge if a kubeconfig already exists in som
 
 				if res.ExitCode != 0 {
 					if len(res.StdErr) > 0 {
-						fmt.Printf("stderr: %q", res.StdErr)
+						fmt.Fprintf(out, "stderr: %q", res.StdErr)
 					}
 				}
 
 				if len(res.StdOut) > 0 {
-					fmt.Printf("stdout: %q", res.StdOut)
+					fmt.Fprintf(out, "stdout: %q", res.StdOut)
+				}
+
+				verifyTLSSANs(out, host, httpsListenPort(k3sExtraArgs), makeTLSSANs(host, tlsSANs))
+
+				if snapshotConfig != nil {
+					if err := checkEtcdS3(out, operator, sudoPrefix, snapshotConfig, printCommand); err != nil {
+						return err
+					}
 				}
 			} else {
-				fmt.Printf("Skipping local installation\n")
+				fmt.Fprintf(out, "Skipping local installation\n")
 			}
 
-			if err = obtainKubeconfig(operator, getConfigcommand, host, context, localKubeconfig, merge); err != nil {
+			if err = obtainKubeconfig(out, operator, getConfigcommand, host, context, localKubeconfig, apiServerURL, merge, useContext); err != nil {
 				return err
 			}
 
+			if err := recordInstall(command, operator, host, true); err != nil {
+				fmt.Fprintf(out, "Unable to record the cluster: %s\n", err)
+			}
+
 			return nil
 		}
 
-		fmt.Println("Public IP: " + host)
+		fmt.Fprintln(out, "Public IP: "+host)
 
 		port, _ := command.Flags().GetInt("ssh-port")
 		user, _ := command.Flags().GetString("user")
@@ -299,11 +417,29 @@ Provide the --local-path flag with --merge if a kubeconfig already exists in som
 
 			defer sshOperatorDone()
 		}
+		sshOperator.SetOutput(out, command.ErrOrStderr())
 
 		if !skipInstall {
+			if !skipPreflight {
+				if err := preflight(out, sshOperator, host, "server"); err != nil {
+					return err
+				}
+			}
+
+			if ca != nil {
+				if err := provisionCustomCA(out, sshOperator, sudoPrefix, dataDir, ca, printCommand); err != nil {
+					return err
+				}
+			}
+
+			if snapshotConfig != nil {
+				if err := configureEtcdSnapshots(out, sshOperator, sudoPrefix, snapshotConfig, printCommand); err != nil {
+					return err
+				}
+			}
 
 			if printCommand {
-				fmt.Printf("ssh: %s\n", installK3scommand)
+				fmt.Fprintf(out, "ssh: %s\n", installK3scommand)
 			}
 
 			res, err := sshOperator.Execute(installK3scommand)
@@ -312,17 +448,29 @@ Provide the --local-path flag with --merge if a kubeconfig already exists in som
 				return fmt.Errorf("error received processing command: %s", err)
 			}
 
-			fmt.Printf("Result: %s %s\n", string(res.StdOut), string(res.StdErr))
+			fmt.Fprintf(out, "Result: %s %s\n", string(res.StdOut), string(res.StdErr))
+
+			verifyTLSSANs(out, host, httpsListenPort(k3sExtraArgs), makeTLSSANs(host, tlsSANs))
+
+			if snapshotConfig != nil {
+				if err := checkEtcdS3(out, sshOperator, sudoPrefix, snapshotConfig, printCommand); err != nil {
+					return err
+				}
+			}
 		}
 
 		if printCommand {
-			fmt.Printf("ssh: %s\n", getConfigcommand)
+			fmt.Fprintf(out, "ssh: %s\n", getConfigcommand)
 		}
 
-		if err = obtainKubeconfig(sshOperator, getConfigcommand, host, context, localKubeconfig, merge); err != nil {
+		if err = obtainKubeconfig(out, sshOperator, getConfigcommand, host, context, localKubeconfig, apiServerURL, merge, useContext); err != nil {
 			return err
 		}
 
+		if err := recordInstall(command, sshOperator, host, false); err != nil {
+			fmt.Fprintf(out, "Unable to record the cluster: %s\n", err)
+		}
+
 		return nil
 	}
 
@@ -402,26 +550,102 @@ func sshAgentOnly() (ssh.AuthMethod, error) {
 	return ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers), nil
 }
 
-func obtainKubeconfig(operator operator.CommandOperator, getConfigcommand, host, context, localKubeconfig string, merge bool) error {
+func obtainKubeconfig(out io.Writer, operator operator.CommandOperator, getConfigcommand, host, context, localKubeconfig, apiServerURL string, merge, useContext bool) error {
+	kubeconfig, err := fetchKubeconfig(out, operator, getConfigcommand, host, context, apiServerURL)
+	if err != nil {
+		return err
+	}
+
+	return saveKubeconfig(out, kubeconfig, context, localKubeconfig, merge, useContext)
+}
+
+// fetchKubeconfig reads the kubeconfig from the server and rewrites it
+// to point at host under the given context. When apiServerURL is given,
+// it is used as the server URL instead of host.
+func fetchKubeconfig(out io.Writer, operator operator.CommandOperator, getConfigcommand, host, context, apiServerURL string) ([]byte, error) {
 	res, err := operator.ExecuteStdio(getConfigcommand, false)
 	if err != nil {
-		return fmt.Errorf("error received processing command: %s", err)
+		return nil, fmt.Errorf("error received processing command: %s", err)
 	}
 
-	absPath, _ := filepath.Abs(expandPath(localKubeconfig))
+	kubeconfig, err := rewriteKubeconfig(string(res.StdOut), host, context)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(apiServerURL) == 0 {
+		return kubeconfig, nil
+	}
+
+	if err := checkAPIServerSAN(out, res.StdOut, host, apiServerURL); err != nil {
+		fmt.Fprintf(out, "Warning: unable to check the serving certificate for %s: %s\n", apiServerURL, err)
+	}
+
+	return setKubeconfigServer(kubeconfig, apiServerURL)
+}
+
+// checkAPIServerSAN warns when the host of apiServerURL is not one of
+// the SANs of the certificate served by the K3s server on host
+func checkAPIServerSAN(out io.Writer, k3sConfig []byte, host, apiServerURL string) error {
+	u, err := parseAPIServerURL(apiServerURL)
+	if err != nil {
+		return err
+	}
+
+	server, err := kubeconfigServer(k3sConfig)
+	if err != nil {
+		return err
+	}
+
+	serverURL, err := url.Parse(server)
+	if err != nil {
+		return err
+	}
+
+	port := serverURL.Port()
+	if len(port) == 0 {
+		port = "6443"
+	}
 
-	kubeconfig := rewriteKubeconfig(string(res.StdOut), host, context)
+	address := net.JoinHostPort(strings.Trim(host, "[]"), port)
+	missing, err := checkServingCertificate(address, []string{u.Hostname()})
+	if err != nil {
+		return err
+	}
 
+	if len(missing) > 0 {
+		fmt.Fprintf(out, `Warning: %s is not a SAN of the certificate served at %s,
+clients will fail to verify the API server. Add it with --tls-san.
+`, u.Hostname(), address)
+	}
+
+	return nil
+}
+
+// saveKubeconfig writes kubeconfig to localKubeconfig, or merges it into
+// the existing file there
+func saveKubeconfig(out io.Writer, kubeconfig []byte, context, localKubeconfig string, merge, useContext bool) error {
+	absPath, _ := filepath.Abs(expandPath(localKubeconfig))
+
+	var err error
 	if merge {
 		// Create a merged kubeconfig
-		kubeconfig, err = mergeConfigs(absPath, context, []byte(kubeconfig))
+		kubeconfig, err = mergeConfigs(out, absPath, kubeconfig, useContext)
 		if err != nil {
 			return err
 		}
+
+		backup, err := backupConfig(absPath)
+		if err != nil {
+			return err
+		}
+		if len(backup) > 0 {
+			fmt.Fprintf(out, "Previous kubeconfig saved to: %s\n", backup)
+		}
 	}
 
 	// Create a new kubeconfig
-	if err := writeConfig(absPath, []byte(kubeconfig), context, false); err != nil {
+	if err := writeConfig(out, absPath, []byte(kubeconfig), context, false); err != nil {
 		return err
 	}
 
@@ -429,10 +653,10 @@ func obtainKubeconfig(operator operator.CommandOperator, getConfigcommand, host,
 }
 
 // Generates config files give the path to file: string and the data: []byte
-func writeConfig(path string, data []byte, context string, suppressMessage bool) error {
+func writeConfig(out io.Writer, path string, data []byte, context string, suppressMessage bool) error {
 	absPath, _ := filepath.Abs(path)
 	if !suppressMessage {
-		fmt.Printf(`Saving file to: %s
+		fmt.Fprintf(out, `Saving file to: %s
 
 # Test your cluster with:
 export KUBECONFIG=%s
@@ -447,61 +671,56 @@ kubectl get node -o wide
 			pkg.SupportMessageShort)
 	}
 
-	if err := os.WriteFile(absPath, []byte(data), 0600); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func mergeConfigs(localKubeconfigPath, context string, k3sconfig []byte) ([]byte, error) {
-	// Create a temporary kubeconfig to store the config of the newly create k3s cluster
-	file, err := os.CreateTemp(os.TempDir(), "k3s-temp-*")
+	// Write to a temporary file in the same directory, then rename it
+	// so that a partially written kubeconfig is never left behind
+	file, err := os.CreateTemp(filepath.Dir(absPath), filepath.Base(absPath)+".tmp-*")
 	if err != nil {
-		return nil, fmt.Errorf("could not generate a temporary file to store the kubeconfig: %w", err)
+		return fmt.Errorf("could not create a temporary file to write the kubeconfig: %w", err)
 	}
+	tmpName := file.Name()
 
-	defer func() {
-		// Remove the temporarily generated file, even if there is an error and the
-		// function returns early
-		if err = os.Remove(file.Name()); err != nil {
-			log.Printf("could not remove temporary kubeconfig file: %s %s", file.Name(), err)
-		}
-	}()
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmpName)
+		return err
+	}
 
-	if err := writeConfig(file.Name(), []byte(k3sconfig), context, true); err != nil {
-		return nil, err
+	if err := file.Chmod(0600); err != nil {
+		file.Close()
+		os.Remove(tmpName)
+		return err
 	}
 
-	fmt.Printf("Merging config into file: %s\n", localKubeconfigPath)
+	if err := file.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
 
-	// Pick between ; or : for path concatenation
-	var joinChar string
-	if runtime.GOOS == "windows" {
-		joinChar = ";"
-	} else {
-		joinChar = ":"
+	if err := os.Rename(tmpName, absPath); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("could not write kubeconfig to %s: %w", absPath, err)
 	}
 
-	appendKubeConfigENV := fmt.Sprintf("KUBECONFIG=%s%s%s",
-		localKubeconfigPath,
-		joinChar,
-		file.Name())
+	return nil
+}
 
-	// Merge the two kubeconfigs and read the output into 'data'
-	cmd := exec.Command("kubectl", "config", "view", "--merge", "--flatten")
-	cmd.Env = append(os.Environ(), appendKubeConfigENV)
-	data, err := cmd.Output()
+// mergeConfigs merges the kubeconfig of the new cluster into the file at
+// localKubeconfigPath, replacing any cluster, context or user which has
+// the same name
+func mergeConfigs(out io.Writer, localKubeconfigPath string, k3sconfig []byte, useContext bool) ([]byte, error) {
+	fmt.Fprintf(out, "Merging config into file: %s\n", localKubeconfigPath)
+
+	existing, err := loadKubeconfigFile(localKubeconfigPath)
 	if err != nil {
-		return nil, fmt.Errorf("could not merge kubeconfig: %w", err)
+		return nil, err
 	}
 
-	if err := file.Close(); err != nil {
-		return nil, fmt.Errorf("could not close temporary kubeconfig file: %s %w",
-			file.Name(), err)
+	incoming, err := parseKubeconfig(k3sconfig)
+	if err != nil {
+		return nil, err
 	}
 
-	return data, nil
+	return marshalKubeconfig(mergeKubeconfig(existing, incoming, useContext))
 }
 
 func expandPath(path string) string {
@@ -581,23 +800,7 @@ func loadPublickey(path string) (ssh.AuthMethod, func() error, error) {
 	return ssh.PublicKeys(signer), noopCloseFunc, nil
 }
 
-// rewriteKubeconfig replaces the IP address of the server with the IP address
-// it also changes the context from "default" to the value of the --context flag
-func rewriteKubeconfig(kubeconfig string, host string, context string) []byte {
-	if context == "" {
-		context = "default"
-	}
-
-	kubeconfigReplacer := strings.NewReplacer(
-		"127.0.0.1", host,
-		"localhost", host,
-		"default", context,
-	)
-
-	return []byte(kubeconfigReplacer.Replace(kubeconfig))
-}
-
-func makeInstallExec(cluster bool, host, tlsSAN string, options k3sExecOptions) string {
+func makeInstallExec(cluster bool, host string, tlsSANs []string, options k3sExecOptions) string {
 	extraArgs := []string{}
 	if len(options.Datastore) > 0 {
 		extraArgs = append(extraArgs, fmt.Sprintf("--datastore-endpoint %s", options.Datastore))
@@ -623,11 +826,9 @@ func makeInstallExec(cluster bool, host, tlsSAN string, options k3sExecOptions)
 		installExec += " --cluster-init"
 	}
 
-	san := host
-	if len(tlsSAN) > 0 {
-		san = tlsSAN
+	for _, san := range makeTLSSANs(host, tlsSANs) {
+		installExec += fmt.Sprintf(" --tls-san %s", san)
 	}
-	installExec += fmt.Sprintf(" --tls-san %s", san)
 
 	if trimmed := strings.TrimSpace(extraArgsCmdline); len(trimmed) > 0 {
 		installExec += fmt.Sprintf(" %s", trimmed)
@@ -637,3 +838,61 @@ func makeInstallExec(cluster bool, host, tlsSAN string, options k3sExecOptions)
 
 	return installExec
 }
+
+// makeTLSSANs gives the host followed by each of tlsSANs, without
+// duplicates or empty values
+func makeTLSSANs(host string, tlsSANs []string) []string {
+	sans := []string{}
+	seen := map[string]bool{}
+
+	for _, san := range append([]string{host}, tlsSANs...) {
+		san = strings.TrimSpace(san)
+		if len(san) == 0 || seen[san] {
+			continue
+		}
+		seen[san] = true
+		sans = append(sans, san)
+	}
+
+	return sans
+}
+
+// httpsListenPort returns the value of --https-listen-port from the
+// extra arguments given to K3s, or the default of 6443
+func httpsListenPort(k3sExtraArgs string) string {
+	return k3sExtraArg(k3sExtraArgs, "--https-listen-port", "6443")
+}
+
+// k3sExtraArg returns the value of the flag name from the extra arguments
+// given to K3s, or defaultValue when it is not set
+func k3sExtraArg(k3sExtraArgs, name, defaultValue string) string {
+	args := strings.Fields(k3sExtraArgs)
+	for i, arg := range args {
+		if strings.HasPrefix(arg, name+"=") {
+			return strings.TrimPrefix(arg, name+"=")
+		}
+		if arg == name && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return defaultValue
+}
+
+// verifyTLSSANs checks that each of sans is served in the certificate of
+// the API server at host, and prints a warning for any that are missing
+func verifyTLSSANs(out io.Writer, host, port string, sans []string) {
+	address := net.JoinHostPort(strings.Trim(host, "[]"), port)
+
+	missing, err := checkServingCertificate(address, sans)
+	if err != nil {
+		fmt.Fprintf(out, "Warning: unable to verify the TLS SANs served at %s: %s\n", address, err)
+		return
+	}
+
+	if len(missing) > 0 {
+		fmt.Fprintf(out, "Warning: the certificate served at %s does not include: %s\n", address, strings.Join(missing, ", "))
+		return
+	}
+
+	fmt.Fprintf(out, "Verified TLS SANs served at %s: %s\n", address, strings.Join(sans, ", "))
+}
@@ -0,0 +1,602 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// readHosts reads the list of hosts from a devices file, which may be a
+// JSON or YAML list, a CSV file with a header row, or an Ansible
+// inventory in INI or YAML format
+func readHosts(name string) ([]Host, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var hosts []Host
+	switch hostsFormat(name, data) {
+	case "json":
+		hosts, err = parseJSONHosts(data)
+	case "yaml":
+		hosts, err = parseYAMLHosts(data)
+	case "csv":
+		hosts, err = parseCSVHosts(data)
+	default:
+		hosts, err = parseAnsibleINI(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", name, err)
+	}
+
+	if err := validateHosts(hosts); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return hosts, nil
+}
+
+// hostsFormat gives the format of a devices file from its extension, or
+// from its content when the extension is not known, such as for an
+// Ansible inventory named "hosts"
+func hostsFormat(name string, data []byte) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".csv":
+		return "csv"
+	case ".ini", ".cfg":
+		return "ini"
+	}
+
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("[")) && json.Valid(trimmed):
+		return "json"
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		return "ini"
+	}
+
+	firstLine, _, _ := strings.Cut(string(trimmed), "\n")
+	switch {
+	case strings.HasPrefix(firstLine, "-") || strings.HasSuffix(strings.TrimSpace(firstLine), ":"):
+		return "yaml"
+	case strings.Contains(firstLine, ",") && !strings.Contains(firstLine, "="):
+		return "csv"
+	}
+
+	return "ini"
+}
+
+func parseJSONHosts(data []byte) ([]Host, error) {
+	var hosts []Host
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&hosts); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+// parseYAMLHosts reads a YAML list in the same format as the JSON file, or
+// an Ansible inventory in YAML format
+func parseYAMLHosts(data []byte) ([]Host, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return []Host{}, nil
+	}
+
+	if doc.Content[0].Kind == yaml.MappingNode {
+		inventory := newAnsibleInventory()
+		if err := inventory.readYAMLGroups(doc.Content[0]); err != nil {
+			return nil, err
+		}
+		return inventory.hosts()
+	}
+
+	var hosts []Host
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&hosts); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+// parseCSVHosts reads a CSV file with a header row naming the same fields
+// as the JSON file. Labels and taints are separated with a comma or a
+// semi-colon, i.e. "tier=web;zone=b".
+func parseCSVHosts(data []byte) ([]Host, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("no header row: %w", err)
+	}
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+	}
+
+	hosts := []Host{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		host := Host{}
+		for i, value := range record {
+			value = strings.TrimSpace(value)
+			if len(value) == 0 {
+				continue
+			}
+			known, err := setHostField(&host, header[i], value)
+			if err != nil {
+				return nil, err
+			}
+			if !known {
+				return nil, fmt.Errorf("unknown column %q", header[i])
+			}
+		}
+		hosts = append(hosts, host)
+	}
+
+	return hosts, nil
+}
+
+// setHostField sets the field of host with the given JSON name from a
+// string value, and reports whether the field is known
+func setHostField(host *Host, field, value string) (bool, error) {
+	switch field {
+	case "hostname":
+		host.Hostname = value
+	case "ip":
+		host.IP = value
+	case "user":
+		host.User = value
+	case "ssh_port":
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return true, fmt.Errorf("invalid ssh_port: %q", value)
+		}
+		host.SSHPort = port
+	case "ssh_key":
+		host.SSHKey = value
+	case "role":
+		host.Role = value
+	case "labels":
+		labels, err := parseHostLabels(value)
+		if err != nil {
+			return true, err
+		}
+		host.Labels = labels
+	case "taints":
+		host.Taints = splitHostList(value)
+	case "k3s_extra_args":
+		host.K3sExtraArgs = value
+	case "node_ip":
+		host.NodeIP = value
+	case "external_ip":
+		host.ExternalIP = value
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+func splitHostList(value string) []string {
+	items := []string{}
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ';' }) {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseHostLabels(value string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, item := range splitHostList(value) {
+		key, labelValue, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("label %q must be in the form key=value", item)
+		}
+		labels[strings.TrimSpace(key)] = strings.TrimSpace(labelValue)
+	}
+	return labels, nil
+}
+
+// ansibleHostVars maps the variables of an Ansible inventory to the fields
+// of a Host. Other variables are used by playbooks, so are ignored.
+var ansibleHostVars = map[string]string{
+	"ansible_host":                 "ip",
+	"ansible_ssh_host":             "ip",
+	"ansible_user":                 "user",
+	"ansible_ssh_user":             "user",
+	"ansible_port":                 "ssh_port",
+	"ansible_ssh_port":             "ssh_port",
+	"ansible_ssh_private_key_file": "ssh_key",
+	"k3sup_role":                   "role",
+	"k3sup_labels":                 "labels",
+	"k3sup_taints":                 "taints",
+	"k3sup_k3s_extra_args":         "k3s_extra_args",
+	"k3sup_node_ip":                "node_ip",
+	"k3sup_external_ip":            "external_ip",
+}
+
+// ansibleGroupRole gives the role for hosts in the Ansible group name,
+// going by the names commonly used for K3s inventories
+func ansibleGroupRole(name string) string {
+	switch strings.ToLower(strings.ReplaceAll(name, "-", "_")) {
+	case "server", "servers", "master", "masters", "control_plane", "controlplane", "k3s_server", "k3s_servers":
+		return "server"
+	case "agent", "agents", "node", "nodes", "worker", "workers", "k3s_agent", "k3s_agents":
+		return "agent"
+	}
+	return ""
+}
+
+type ansibleGroup struct {
+	hosts    []string
+	children []string
+	vars     map[string]interface{}
+}
+
+// ansibleInventory is an Ansible inventory read from INI or YAML, before
+// the variables of its groups are applied to each host
+type ansibleInventory struct {
+	groups     map[string]*ansibleGroup
+	groupOrder []string
+	hostVars   map[string]map[string]interface{}
+}
+
+func newAnsibleInventory() *ansibleInventory {
+	return &ansibleInventory{
+		groups:   map[string]*ansibleGroup{},
+		hostVars: map[string]map[string]interface{}{},
+	}
+}
+
+func (inv *ansibleInventory) group(name string) *ansibleGroup {
+	if g, ok := inv.groups[name]; ok {
+		return g
+	}
+	g := &ansibleGroup{vars: map[string]interface{}{}}
+	inv.groups[name] = g
+	inv.groupOrder = append(inv.groupOrder, name)
+	return g
+}
+
+func (inv *ansibleInventory) addHost(groupName, hostName string, vars map[string]interface{}) {
+	g := inv.group(groupName)
+	g.hosts = append(g.hosts, hostName)
+
+	if _, ok := inv.hostVars[hostName]; !ok {
+		inv.hostVars[hostName] = map[string]interface{}{}
+	}
+	for key, value := range vars {
+		inv.hostVars[hostName][key] = value
+	}
+}
+
+// hosts resolves the inventory into hosts, in the order in which they are
+// first found when walking the groups from the top. Variables of "all"
+// apply first, then those of each group from parent to child, then those
+// of the host itself.
+func (inv *ansibleInventory) hosts() ([]Host, error) {
+	isChild := map[string]bool{}
+	for _, g := range inv.groups {
+		for _, child := range g.children {
+			isChild[child] = true
+		}
+	}
+
+	order := []string{}
+	layers := map[string][]map[string]interface{}{}
+	roles := map[string]string{}
+
+	var visit func(name string, inherited []map[string]interface{}, role string, path map[string]bool) error
+	visit = func(name string, inherited []map[string]interface{}, role string, path map[string]bool) error {
+		if path[name] {
+			return fmt.Errorf("group %s is a child of itself", name)
+		}
+		g, ok := inv.groups[name]
+		if !ok {
+			return fmt.Errorf("group %s is not defined", name)
+		}
+
+		if groupRole := ansibleGroupRole(name); len(groupRole) > 0 {
+			role = groupRole
+		}
+		vars := append(append([]map[string]interface{}{}, inherited...), g.vars)
+
+		for _, host := range g.hosts {
+			if _, ok := layers[host]; !ok {
+				order = append(order, host)
+			}
+			layers[host] = append(layers[host], vars...)
+
+			if len(role) > 0 {
+				if existing, ok := roles[host]; ok && existing != role {
+					return fmt.Errorf("host %s is in both a server and an agent group", host)
+				}
+				roles[host] = role
+			}
+		}
+
+		path[name] = true
+		defer delete(path, name)
+		for _, child := range g.children {
+			if err := visit(child, vars, role, path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, name := range inv.groupOrder {
+		if !isChild[name] {
+			if err := visit(name, nil, "", map[string]bool{}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	hosts := []Host{}
+	for _, name := range order {
+		host := Host{Hostname: name, Role: roles[name]}
+
+		all := inv.group("all").vars
+		for _, vars := range append(append([]map[string]interface{}{all}, layers[name]...), inv.hostVars[name]) {
+			if err := applyAnsibleVars(&host, vars); err != nil {
+				return nil, fmt.Errorf("host %s: %w", name, err)
+			}
+		}
+
+		hosts = append(hosts, host)
+	}
+
+	return hosts, nil
+}
+
+func applyAnsibleVars(host *Host, vars map[string]interface{}) error {
+	for key, value := range vars {
+		field, ok := ansibleHostVars[key]
+		if !ok {
+			continue
+		}
+
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if field != "labels" {
+				return fmt.Errorf("%s must not be a map", key)
+			}
+			host.Labels = map[string]string{}
+			for labelKey, labelValue := range v {
+				host.Labels[labelKey] = fmt.Sprint(labelValue)
+			}
+		case []interface{}:
+			if field != "taints" {
+				return fmt.Errorf("%s must not be a list", key)
+			}
+			host.Taints = []string{}
+			for _, taint := range v {
+				host.Taints = append(host.Taints, fmt.Sprint(taint))
+			}
+		default:
+			if _, err := setHostField(host, field, fmt.Sprint(value)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseAnsibleINI reads an Ansible inventory in INI format. Host patterns
+// such as node[01:10] are not expanded.
+func parseAnsibleINI(data []byte) ([]Host, error) {
+	inventory := newAnsibleInventory()
+
+	section, kind := "ungrouped", "hosts"
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section, kind = strings.TrimSpace(line[1:len(line)-1]), "hosts"
+			if name, suffix, ok := strings.Cut(section, ":"); ok {
+				section, kind = name, suffix
+			}
+			if kind != "hosts" && kind != "vars" && kind != "children" {
+				return nil, fmt.Errorf("line %d: unknown section type %q", lineNumber, kind)
+			}
+			inventory.group(section)
+			continue
+		}
+
+		fields, err := splitINIFields(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+
+		switch kind {
+		case "vars":
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				return nil, fmt.Errorf("line %d: variables must be in the form key=value", lineNumber)
+			}
+			inventory.group(section).vars[strings.TrimSpace(key)] = trimINIQuotes(strings.TrimSpace(value))
+		case "children":
+			g := inventory.group(section)
+			g.children = append(g.children, fields[0])
+			inventory.group(fields[0])
+		default:
+			if strings.ContainsAny(fields[0], "[]") {
+				return nil, fmt.Errorf("line %d: host patterns such as %s are not supported", lineNumber, fields[0])
+			}
+			vars := map[string]interface{}{}
+			for _, field := range fields[1:] {
+				key, value, ok := strings.Cut(field, "=")
+				if !ok {
+					return nil, fmt.Errorf("line %d: host variables must be in the form key=value, got: %q", lineNumber, field)
+				}
+				vars[key] = value
+			}
+			inventory.addHost(section, fields[0], vars)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return inventory.hosts()
+}
+
+// splitINIFields splits a line on whitespace, keeping quoted values
+// together and removing their quotes
+func splitINIFields(line string) ([]string, error) {
+	fields := []string{}
+	current := strings.Builder{}
+	var quote rune
+	inField := false
+
+	for _, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			current.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inField = true
+		case r == ' ' || r == '\t':
+			if inField {
+				fields = append(fields, current.String())
+				current.Reset()
+				inField = false
+			}
+		default:
+			current.WriteRune(r)
+			inField = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inField {
+		fields = append(fields, current.String())
+	}
+
+	return fields, nil
+}
+
+func trimINIQuotes(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// readYAMLGroups reads the groups at the top of an Ansible inventory in
+// YAML format, keeping the order of the groups and hosts
+func (inv *ansibleInventory) readYAMLGroups(node *yaml.Node) error {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if err := inv.readYAMLGroup(node.Content[i].Value, node.Content[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (inv *ansibleInventory) readYAMLGroup(name string, node *yaml.Node) error {
+	g := inv.group(name)
+	if node.Kind != yaml.MappingNode {
+		if node.Tag == "!!null" {
+			return nil
+		}
+		return fmt.Errorf("group %s must be a map of hosts, vars and children, line %d", name, node.Line)
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i].Value, node.Content[i+1]
+
+		switch key {
+		case "hosts":
+			for j := 0; j+1 < len(value.Content); j += 2 {
+				vars := map[string]interface{}{}
+				if err := value.Content[j+1].Decode(&vars); err != nil {
+					return fmt.Errorf("host %s: %w", value.Content[j].Value, err)
+				}
+				inv.addHost(name, value.Content[j].Value, vars)
+			}
+		case "vars":
+			if err := value.Decode(&g.vars); err != nil {
+				return fmt.Errorf("group %s: %w", name, err)
+			}
+			if g.vars == nil {
+				g.vars = map[string]interface{}{}
+			}
+		case "children":
+			for j := 0; j+1 < len(value.Content); j += 2 {
+				child := value.Content[j].Value
+				g.children = append(g.children, child)
+				if err := inv.readYAMLGroup(child, value.Content[j+1]); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("group %s: unknown key %q, line %d", name, key, value.Line)
+		}
+	}
+
+	return nil
+}
+
+func validateHosts(hosts []Host) error {
+	for i, host := range hosts {
+		if len(host.Address()) == 0 {
+			return fmt.Errorf("host %d needs an ip or a hostname", i+1)
+		}
+		if host.Role != "" && host.Role != "server" && host.Role != "agent" {
+			return fmt.Errorf("host %s: role must be server or agent, got: %q", host.Address(), host.Role)
+		}
+		if host.SSHPort < 0 || host.SSHPort > 65535 {
+			return fmt.Errorf("host %s: invalid ssh_port: %d", host.Address(), host.SSHPort)
+		}
+		for _, ip := range []string{host.NodeIP, host.ExternalIP} {
+			if len(ip) > 0 && net.ParseIP(ip) == nil {
+				return fmt.Errorf("host %s: invalid IP address: %q", host.Address(), ip)
+			}
+		}
+		for key := range host.Labels {
+			if len(key) == 0 || strings.ContainsAny(key, "= ") {
+				return fmt.Errorf("host %s: invalid label: %q", host.Address(), key)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeHostsFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	target := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(target, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+func Test_readHosts(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "hostname and ip",
+			content: `[{"hostname": "node-1", "ip": "10.0.0.1"}]`,
+		},
+		{
+			name:    "per-host settings",
+			content: `[{"hostname": "node-1", "user": "ubuntu", "ssh_port": 2222, "role": "server", "labels": {"tier": "web"}, "taints": ["a=b:NoSchedule"], "node_ip": "10.0.0.1"}]`,
+		},
+		{
+			name:    "unknown field",
+			content: `[{"hostname": "node-1", "ip": "10.0.0.1", "usr": "ubuntu"}]`,
+			want:    `unknown field "usr"`,
+		},
+		{
+			name:    "invalid role",
+			content: `[{"ip": "10.0.0.1", "role": "master"}]`,
+			want:    "role must be server or agent",
+		},
+		{
+			name:    "no address",
+			content: `[{"user": "ubuntu"}]`,
+			want:    "needs an ip or a hostname",
+		},
+		{
+			name:    "invalid node ip",
+			content: `[{"ip": "10.0.0.1", "node_ip": "10.0.0"}]`,
+			want:    "invalid IP address",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			name := writeHostsFile(t, "hosts.json", c.content)
+
+			_, err := readHosts(name)
+			if len(c.want) == 0 {
+				if err != nil {
+					t.Fatalf("want no error, got %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("want error containing %q, got %v", c.want, err)
+			}
+		})
+	}
+}
+
+func Test_readHosts_Formats(t *testing.T) {
+	want := []Host{
+		{Hostname: "node-1", IP: "10.0.0.1", User: "ubuntu", Role: "server"},
+		{Hostname: "node-2", IP: "10.0.0.2", User: "ubuntu", SSHPort: 2222, Role: "agent",
+			Labels: map[string]string{"tier": "web", "zone": "b"},
+			Taints: []string{"gpu=true:NoSchedule"}},
+	}
+
+	cases := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{
+			name: "yaml list",
+			file: "hosts.yaml",
+			content: `- hostname: node-1
+  ip: 10.0.0.1
+  user: ubuntu
+  role: server
+- hostname: node-2
+  ip: 10.0.0.2
+  user: ubuntu
+  ssh_port: 2222
+  role: agent
+  labels:
+    tier: web
+    zone: b
+  taints:
+    - gpu=true:NoSchedule
+`,
+		},
+		{
+			name: "csv",
+			file: "hosts.csv",
+			content: `hostname,ip,user,ssh_port,role,labels,taints
+node-1,10.0.0.1,ubuntu,,server,,
+node-2,10.0.0.2,ubuntu,2222,agent,"tier=web,zone=b",gpu=true:NoSchedule
+`,
+		},
+		{
+			name: "ansible ini",
+			file: "hosts",
+			content: `# K3s nodes
+[masters]
+node-1 ansible_host=10.0.0.1
+
+[workers]
+node-2 ansible_host=10.0.0.2 ansible_port=2222 k3sup_labels="tier=web,zone=b"
+
+[workers:vars]
+k3sup_taints=gpu=true:NoSchedule
+
+[k3s_cluster:children]
+masters
+workers
+
+[all:vars]
+ansible_user=ubuntu
+`,
+		},
+		{
+			name: "ansible yaml",
+			file: "inventory.yml",
+			content: `all:
+  vars:
+    ansible_user: ubuntu
+  children:
+    k3s_cluster:
+      children:
+        server:
+          hosts:
+            node-1:
+              ansible_host: 10.0.0.1
+        agent:
+          hosts:
+            node-2:
+              ansible_host: 10.0.0.2
+              ansible_port: 2222
+              k3sup_labels:
+                tier: web
+                zone: b
+          vars:
+            k3sup_taints:
+              - gpu=true:NoSchedule
+`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			hosts, err := readHosts(writeHostsFile(t, c.file, c.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(hosts, want) {
+				t.Errorf("want\n%+v\ngot\n%+v", want, hosts)
+			}
+		})
+	}
+}
+
+func Test_readHosts_FormatErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		file    string
+		content string
+		want    string
+	}{
+		{
+			name:    "unknown yaml field",
+			file:    "hosts.yaml",
+			content: "- hostname: node-1\n  usr: ubuntu\n",
+			want:    "field usr not found",
+		},
+		{
+			name:    "unknown csv column",
+			file:    "hosts.csv",
+			content: "hostname,usr\nnode-1,ubuntu\n",
+			want:    `unknown column "usr"`,
+		},
+		{
+			name:    "ansible host pattern",
+			file:    "hosts.ini",
+			content: "[workers]\nnode[01:10]\n",
+			want:    "host patterns",
+		},
+		{
+			name:    "host in server and agent groups",
+			file:    "hosts.ini",
+			content: "[servers]\nnode-1\n[agents]\nnode-1\n",
+			want:    "both a server and an agent group",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := readHosts(writeHostsFile(t, c.file, c.content))
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("want error containing %q, got %v", c.want, err)
+			}
+		})
+	}
+}
+
+func Test_hostsFormat(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"hosts", `[{"ip": "10.0.0.1"}]`, "json"},
+		{"hosts", "[servers]\nnode-1\n", "ini"},
+		{"hosts", "node-1 ansible_host=10.0.0.1\n", "ini"},
+		{"hosts", "- ip: 10.0.0.1\n", "yaml"},
+		{"hosts", "all:\n  hosts:\n", "yaml"},
+		{"hosts", "hostname,ip\nnode-1,10.0.0.1\n", "csv"},
+		{"hosts.yml", "[]", "yaml"},
+	}
+
+	for _, c := range cases {
+		if got := hostsFormat(c.name, []byte(c.content)); got != c.want {
+			t.Errorf("%q: want %s, got %s", c.content, c.want, got)
+		}
+	}
+}
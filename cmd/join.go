@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"path"
@@ -44,7 +45,11 @@ func MakeJoin() *cobra.Command {
   k3sup join --user pi \
     --server-host HOST \
     --host HOST \
-    --k3s-channel latest`,
+    --k3s-channel latest
+
+  # Join a cluster recorded by k3sup install --cluster-name prod,
+  # using its server, version and SSH settings
+  k3sup join --host HOST --cluster prod`,
 		SilenceUsage: true,
 	}
 
@@ -62,6 +67,7 @@ func MakeJoin() *cobra.Command {
 	command.Flags().Int("ssh-port", 22, "The port on which to connect for ssh")
 	command.Flags().Int("server-ssh-port", 22, "The port on which to connect to server for ssh (Default to --ssh-port)")
 	command.Flags().Bool("skip-install", false, "Skip the k3s installer")
+	command.Flags().Bool("skip-preflight", false, "Skip the preflight checks on the host before installing")
 	command.Flags().Bool("sudo", true, "Use sudo for installation. e.g. set to false when using the root user and no sudo is available.")
 
 	command.Flags().Bool("server", false, "Join the cluster as a server rather than as an agent for the embedded etcd mode")
@@ -74,12 +80,17 @@ func MakeJoin() *cobra.Command {
 	command.Flags().String("k3s-version", "", "Set a version to install, overrides k3s-channel")
 	command.Flags().String("k3s-channel", PinnedK3sChannel, "Release channel: stable, latest, or i.e. v1.19")
 
-	command.Flags().String("tls-san", "", "Use an additional IP or hostname for the API server, when using --server flag")
+	command.Flags().StringSlice("tls-san", []string{}, "Use additional IPs or hostnames for the API server, when using --server flag. Repeat the flag or give a comma-separated list")
 
 	command.Flags().String("server-data-dir", "/var/lib/rancher/k3s/", "Override the path used to fetch the node-token from the server")
 
+	addEtcdSnapshotConfigFlags(command)
+	addClusterFlag(command)
+
 	command.RunE = func(command *cobra.Command, args []string) error {
-		fmt.Printf("Running: k3sup join\n")
+		out := command.OutOrStdout()
+
+		fmt.Fprintf(out, "Running: k3sup join\n")
 
 		ip, err := command.Flags().GetIP("ip")
 		if err != nil {
@@ -141,9 +152,9 @@ func MakeJoin() *cobra.Command {
 			return err
 		}
 
-		fmt.Printf("Joining %s => %s\n", host, serverHost)
+		fmt.Fprintf(out, "Joining %s => %s\n", host, serverHost)
 		if len(serverURL) > 0 {
-			fmt.Printf("Server join URL: %s\n", serverURL)
+			fmt.Fprintf(out, "Server join URL: %s\n", serverURL)
 		}
 
 		user, _ := command.Flags().GetString("user")
@@ -211,7 +222,7 @@ func MakeJoin() *cobra.Command {
 
 			getTokenCommand := fmt.Sprintf("%scat %s\n", sudoPrefix, path.Join(dataDir, "/server/node-token"))
 			if printCommand {
-				fmt.Printf("ssh: %s\n", getTokenCommand)
+				fmt.Fprintf(out, "ssh: %s\n", getTokenCommand)
 			}
 
 			streamToStdio := false
@@ -222,9 +233,9 @@ func MakeJoin() *cobra.Command {
 			}
 
 			if len(res.StdErr) > 0 {
-				fmt.Printf("Error or warning getting node-token: %s\n", res.StdErr)
+				fmt.Fprintf(out, "Error or warning getting node-token: %s\n", res.StdErr)
 			} else {
-				fmt.Printf("Received node-token from %s.. ok.\n", serverHost)
+				fmt.Fprintf(out, "Received node-token from %s.. ok.\n", serverHost)
 			}
 
 			// Explicit close of the SSH connection as early as possible
@@ -236,18 +247,72 @@ func MakeJoin() *cobra.Command {
 			nodeToken = strings.TrimSpace(string(res.StdOut))
 		}
 
+		if skipPreflight, _ := command.Flags().GetBool("skip-preflight"); !skipPreflight {
+			role := "agent"
+			if server {
+				role = "server"
+			}
+
+			address := fmt.Sprintf("%s:%d", host, port)
+			sshOperator, sshOperatorDone, errored, err := connectOperator(user, address, sshKeyPath)
+			if errored {
+				return err
+			}
+
+			err = preflight(out, sshOperator, host, role)
+			if sshOperatorDone != nil {
+				sshOperatorDone()
+			}
+			if err != nil {
+				return err
+			}
+		}
+
 		if server {
 
-			tlsSan, _ := command.Flags().GetString("tls-san")
+			tlsSANs, _ := command.Flags().GetStringSlice("tls-san")
 			noExtras, _ := command.Flags().GetBool("no-extras")
 
-			err = setupAdditionalServer(serverHost, host, port, user, sshKeyPath, nodeToken, k3sExtraArgs, k3sVersion, k3sChannel, tlsSan, printCommand, serverURL, noExtras)
+			snapshotConfig, err := readEtcdSnapshotConfig(command)
+			if err != nil {
+				return err
+			}
+
+			var snapshotOperator *operator.SSHOperator
+			if snapshotConfig != nil {
+				address := fmt.Sprintf("%s:%d", host, port)
+				sshOperator, sshOperatorDone, errored, err := connectOperator(user, address, sshKeyPath)
+				if errored {
+					return err
+				}
+				if sshOperatorDone != nil {
+					defer sshOperatorDone()
+				}
+
+				if err := configureEtcdSnapshots(out, sshOperator, sudoPrefix, snapshotConfig, printCommand); err != nil {
+					return err
+				}
+				snapshotOperator = sshOperator
+			}
+
+			err = setupAdditionalServer(out, command.ErrOrStderr(), serverHost, host, port, user, sshKeyPath, nodeToken, k3sExtraArgs, k3sVersion, k3sChannel, tlsSANs, printCommand, serverURL, noExtras)
+			if err == nil && snapshotConfig != nil {
+				err = checkEtcdS3(out, snapshotOperator, sudoPrefix, snapshotConfig, printCommand)
+			}
 		} else {
-			err = setupAgent(serverHost, host, port, user, sshKeyPath, nodeToken, k3sExtraArgs, k3sVersion, k3sChannel, printCommand, serverURL)
+			err = setupAgent(out, command.ErrOrStderr(), serverHost, host, port, user, sshKeyPath, nodeToken, k3sExtraArgs, k3sVersion, k3sChannel, printCommand, serverURL)
 		}
 
 		if err == nil {
-			fmt.Printf("\n%s\n", pkg.SupportMessageShort)
+			role := "agent"
+			if server {
+				role = "server"
+			}
+			if err := recordJoin(command, serverHost, host, role); err != nil {
+				fmt.Fprintf(out, "Unable to record %s in the cluster: %s\n", host, err)
+			}
+
+			fmt.Fprintf(out, "\n%s\n", pkg.SupportMessageShort)
 		}
 
 		return err
@@ -255,6 +320,10 @@ func MakeJoin() *cobra.Command {
 
 	command.PreRunE = func(command *cobra.Command, args []string) error {
 
+		if err := fillFromCluster(command, joinClusterValues); err != nil {
+			return err
+		}
+
 		_, err := command.Flags().GetIP("ip")
 		if err != nil {
 			return err
@@ -280,7 +349,7 @@ func MakeJoin() *cobra.Command {
 			return err
 		}
 
-		tlsSan, err := command.Flags().GetString("tls-san")
+		tlsSANs, err := command.Flags().GetStringSlice("tls-san")
 		if err != nil {
 			return err
 		}
@@ -290,13 +359,21 @@ func MakeJoin() *cobra.Command {
 			return err
 		}
 
-		if len(tlsSan) > 0 || noExtras {
+		snapshotConfig, err := readEtcdSnapshotConfig(command)
+		if err != nil {
+			return err
+		}
+
+		if len(tlsSANs) > 0 || noExtras || snapshotConfig != nil {
 			server, err := command.Flags().GetBool("server")
 			if err != nil {
 				return err
 			}
 
 			if !server {
+				if snapshotConfig != nil {
+					return fmt.Errorf("etcd snapshot flags can only be used with --server")
+				}
 				if noExtras {
 					return fmt.Errorf("--no-extras can only be used with --server")
 				}
@@ -311,7 +388,7 @@ func MakeJoin() *cobra.Command {
 	return command
 }
 
-func setupAdditionalServer(serverHost, host string, port int, user, sshKeyPath, joinToken, k3sExtraArgs, k3sVersion, k3sChannel, tlsSAN string, printCommand bool, serverURL string, noExtras bool) error {
+func setupAdditionalServer(out, errOut io.Writer, serverHost, host string, port int, user, sshKeyPath, joinToken, k3sExtraArgs, k3sVersion, k3sChannel string, tlsSANs []string, printCommand bool, serverURL string, noExtras bool) error {
 	address := fmt.Sprintf("%s:%d", host, port)
 
 	var sshOperator *operator.SSHOperator
@@ -378,31 +455,32 @@ func setupAdditionalServer(serverHost, host string, port int, user, sshKeyPath,
 		k3sExtraArgs,
 		serverAgent,
 		serverURL,
-		tlsSAN,
+		tlsSANs,
 	)
 
 	installAgentServerCommand := fmt.Sprintf("%s | %s", getScript, installk3sExec)
 
 	if printCommand {
-		fmt.Printf("ssh: %s\n", installAgentServerCommand)
+		fmt.Fprintf(out, "ssh: %s\n", installAgentServerCommand)
 	}
 
+	sshOperator.SetOutput(out, errOut)
 	res, err := sshOperator.Execute(installAgentServerCommand)
 	if err != nil {
 		return fmt.Errorf("unable to setup agent: %w", err)
 	}
 
 	if len(res.StdErr) > 0 {
-		fmt.Printf("Logs: %s", res.StdErr)
+		fmt.Fprintf(out, "Logs: %s", res.StdErr)
 	}
 
 	joinRes := string(res.StdOut)
-	fmt.Printf("Output: %s", string(joinRes))
+	fmt.Fprintf(out, "Output: %s", string(joinRes))
 
 	return nil
 }
 
-func setupAgent(serverHost, host string, port int, user, sshKeyPath, joinToken, k3sExtraArgs, k3sVersion, k3sChannel string, printCommand bool, serverURL string) error {
+func setupAgent(out, errOut io.Writer, serverHost, host string, port int, user, sshKeyPath, joinToken, k3sExtraArgs, k3sVersion, k3sChannel string, printCommand bool, serverURL string) error {
 
 	address := fmt.Sprintf("%s:%d", host, port)
 
@@ -459,7 +537,7 @@ func setupAgent(serverHost, host string, port int, user, sshKeyPath, joinToken,
 	serverAgent := false
 
 	// Agents don't expose an API server so don't need a TLS SAN
-	tlsSAN := ""
+	tlsSANs := []string{}
 	installK3sExec := makeJoinExec(
 		serverHost,
 		strings.TrimSpace(joinToken),
@@ -467,15 +545,16 @@ func setupAgent(serverHost, host string, port int, user, sshKeyPath, joinToken,
 		k3sExtraArgs,
 		serverAgent,
 		serverURL,
-		tlsSAN,
+		tlsSANs,
 	)
 
 	installAgentCommand := fmt.Sprintf("%s | %s", getScript, installK3sExec)
 
 	if printCommand {
-		fmt.Printf("ssh: %s\n", installAgentCommand)
+		fmt.Fprintf(out, "ssh: %s\n", installAgentCommand)
 	}
 
+	sshOperator.SetOutput(out, errOut)
 	res, err := sshOperator.Execute(installAgentCommand)
 
 	if err != nil {
@@ -483,11 +562,11 @@ func setupAgent(serverHost, host string, port int, user, sshKeyPath, joinToken,
 	}
 
 	if len(res.StdErr) > 0 {
-		fmt.Printf("Logs: %s", res.StdErr)
+		fmt.Fprintf(out, "Logs: %s", res.StdErr)
 	}
 
 	joinRes := string(res.StdOut)
-	fmt.Printf("Output: %s", string(joinRes))
+	fmt.Fprintf(out, "Output: %s", string(joinRes))
 
 	return nil
 }
@@ -502,7 +581,7 @@ func createVersionStr(k3sVersion, k3sChannel string) string {
 	return installStr
 }
 
-func makeJoinExec(serverIP, joinToken, installStr, k3sExtraArgs string, serverAgent bool, serverURL, tlsSan string) string {
+func makeJoinExec(serverIP, joinToken, installStr, k3sExtraArgs string, serverAgent bool, serverURL string, tlsSANs []string) string {
 
 	installEnvVar := []string{}
 	remoteURL := fmt.Sprintf("https://%s:6443", serverIP)
@@ -516,8 +595,10 @@ func makeJoinExec(serverIP, joinToken, installStr, k3sExtraArgs string, serverAg
 
 	if serverAgent {
 		tlsSANValue := ""
-		if len(tlsSan) > 0 {
-			tlsSANValue = fmt.Sprintf(" --tls-san %s", tlsSan)
+		for _, san := range tlsSANs {
+			if san = strings.TrimSpace(san); len(san) > 0 {
+				tlsSANValue += fmt.Sprintf(" --tls-san %s", san)
+			}
 		}
 		installEnvVar = append(installEnvVar, fmt.Sprintf("INSTALL_K3S_EXEC='server --server %s%s'", remoteURL, tlsSANValue))
 	}
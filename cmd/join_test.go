@@ -12,7 +12,7 @@ type test struct {
 	k3sExtraArgs   string
 	serverAgent    bool
 	installk3sExec string
-	tlsSAN         string
+	tlsSANs        []string
 }
 
 func Test_makeJoinServerExec(t *testing.T) {
@@ -45,7 +45,16 @@ func Test_makeJoinServerExec(t *testing.T) {
 			installk3sExec: "K3S_URL='https://172.27.251.164:6443' K3S_TOKEN='K10c8bc21f68fef3f56d431a08df2e894481ab0a61a3c84cbd639b56449ad15523c::server:9d30861e1ba54177b8e4dd1426076e5d' INSTALL_K3S_VERSION=1.18 INSTALL_K3S_EXEC='server --server https://172.27.251.164:6443 --tls-san 127.0.0.1' sh -s - --node-taint key=value:NoExecute",
 			k3sExtraArgs:   "--node-taint key=value:NoExecute",
 			serverAgent:    true,
-			tlsSAN:         "127.0.0.1",
+			tlsSANs:        []string{"127.0.0.1"},
+		},
+		{
+			title:          "Join Server with multiple TLS SANs",
+			serverIP:       "172.27.251.164",
+			joinToken:      "K10c8bc21f68fef3f56d431a08df2e894481ab0a61a3c84cbd639b56449ad15523c::server:9d30861e1ba54177b8e4dd1426076e5d",
+			installStr:     "INSTALL_K3S_VERSION=1.18",
+			installk3sExec: "K3S_URL='https://172.27.251.164:6443' K3S_TOKEN='K10c8bc21f68fef3f56d431a08df2e894481ab0a61a3c84cbd639b56449ad15523c::server:9d30861e1ba54177b8e4dd1426076e5d' INSTALL_K3S_VERSION=1.18 INSTALL_K3S_EXEC='server --server https://172.27.251.164:6443 --tls-san 192.168.0.100 --tls-san k3s.example.com' sh -s -",
+			serverAgent:    true,
+			tlsSANs:        []string{"192.168.0.100", "k3s.example.com"},
 		},
 		{
 			title:          "Join agent with K3sExtraArgs",
@@ -55,12 +64,12 @@ func Test_makeJoinServerExec(t *testing.T) {
 			installk3sExec: "K3S_URL='https://172.27.251.164:6443' K3S_TOKEN='K10c8bc21f68fef3f56d431a08df2e894481ab0a61a3c84cbd639b56449ad15523c::server:9d30861e1ba54177b8e4dd1426076e5d' INSTALL_K3S_VERSION=1.18 sh -s - --node-ip=192.0.3.4 --node-external-ip=85.159.215.50",
 			k3sExtraArgs:   "--node-ip=192.0.3.4 --node-external-ip=85.159.215.50",
 			serverAgent:    false,
-			tlsSAN:         "127.0.0.1",
+			tlsSANs:        []string{"127.0.0.1"},
 		},
 	}
 	for _, tc := range tests {
 		t.Run(tc.title, func(t *testing.T) {
-			got := makeJoinExec(tc.serverIP, tc.joinToken, tc.installStr, tc.k3sExtraArgs, tc.serverAgent, "", tc.tlsSAN)
+			got := makeJoinExec(tc.serverIP, tc.joinToken, tc.installStr, tc.k3sExtraArgs, tc.serverAgent, "", tc.tlsSANs)
 
 			if got != tc.installk3sExec {
 				t.Errorf("want:\n%s\n, got:\n%s\n", tc.installk3sExec, got)
@@ -94,7 +103,7 @@ func Test_makeJoinAgentExec(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.title, func(t *testing.T) {
-			got := makeJoinExec(tc.serverIP, tc.joinToken, tc.installStr, tc.k3sExtraArgs, tc.serverAgent, "", "")
+			got := makeJoinExec(tc.serverIP, tc.joinToken, tc.installStr, tc.k3sExtraArgs, tc.serverAgent, "", []string{})
 
 			if got != tc.installk3sExec {
 				t.Errorf("want: %s, got: %s", tc.installk3sExec, got)
@@ -0,0 +1,377 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Kubeconfig is the subset of a kubeconfig file that k3sup needs to
+// read and rewrite. Fields which are not modelled are kept in the
+// inline maps, so that they survive a round-trip.
+type Kubeconfig struct {
+	APIVersion     string                 `yaml:"apiVersion,omitempty"`
+	Kind           string                 `yaml:"kind,omitempty"`
+	Preferences    map[string]interface{} `yaml:"preferences"`
+	Clusters       []NamedCluster         `yaml:"clusters"`
+	Contexts       []NamedContext         `yaml:"contexts"`
+	CurrentContext string                 `yaml:"current-context"`
+	Users          []NamedUser            `yaml:"users"`
+	Extra          map[string]interface{} `yaml:",inline"`
+}
+
+// NamedCluster is an entry in the clusters list of a kubeconfig
+type NamedCluster struct {
+	Name    string  `yaml:"name"`
+	Cluster Cluster `yaml:"cluster"`
+}
+
+// Cluster holds the API server endpoint of a cluster
+type Cluster struct {
+	Server string                 `yaml:"server"`
+	Extra  map[string]interface{} `yaml:",inline"`
+}
+
+// NamedContext is an entry in the contexts list of a kubeconfig
+type NamedContext struct {
+	Name    string  `yaml:"name"`
+	Context Context `yaml:"context"`
+}
+
+// Context binds a cluster to a user and optional namespace
+type Context struct {
+	Cluster   string                 `yaml:"cluster"`
+	User      string                 `yaml:"user"`
+	Namespace string                 `yaml:"namespace,omitempty"`
+	Extra     map[string]interface{} `yaml:",inline"`
+}
+
+// NamedUser is an entry in the users list of a kubeconfig, the
+// credentials are kept as-is
+type NamedUser struct {
+	Name string                 `yaml:"name"`
+	User map[string]interface{} `yaml:"user"`
+}
+
+// parseKubeconfig decodes a kubeconfig file
+func parseKubeconfig(data []byte) (*Kubeconfig, error) {
+	config := &Kubeconfig{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("unable to parse kubeconfig: %w", err)
+	}
+
+	return config, nil
+}
+
+// loadKubeconfigFile reads the kubeconfig at path, a missing or empty
+// file gives an empty kubeconfig
+func loadKubeconfigFile(path string) (*Kubeconfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &Kubeconfig{APIVersion: "v1", Kind: "Config"}, nil
+		}
+		return nil, err
+	}
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		return &Kubeconfig{APIVersion: "v1", Kind: "Config"}, nil
+	}
+
+	config, err := parseKubeconfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return config, nil
+}
+
+// marshalKubeconfig encodes a kubeconfig using two spaces for
+// indentation, as kubectl does
+func marshalKubeconfig(config *Kubeconfig) ([]byte, error) {
+	if config.Preferences == nil {
+		config.Preferences = map[string]interface{}{}
+	}
+
+	buf := bytes.Buffer{}
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+
+	if err := encoder.Encode(config); err != nil {
+		return nil, fmt.Errorf("unable to write kubeconfig: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("unable to write kubeconfig: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// rewriteKubeconfig points the kubeconfig written by K3s at host rather
+// than the loopback address, and renames its cluster, user and context
+// from "default" to the value of the --context flag
+func rewriteKubeconfig(kubeconfig string, host string, context string) ([]byte, error) {
+	if context == "" {
+		context = "default"
+	}
+
+	config, err := parseKubeconfig([]byte(kubeconfig))
+	if err != nil {
+		return nil, err
+	}
+
+	clusterNames := map[string]string{}
+	for i, cluster := range config.Clusters {
+		server, err := rewriteServerHost(cluster.Cluster.Server, host)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Clusters[i].Cluster.Server = server
+		clusterNames[cluster.Name] = context
+		config.Clusters[i].Name = context
+	}
+
+	userNames := map[string]string{}
+	for i, user := range config.Users {
+		userNames[user.Name] = context
+		config.Users[i].Name = context
+	}
+
+	for i, c := range config.Contexts {
+		if name, ok := clusterNames[c.Context.Cluster]; ok {
+			config.Contexts[i].Context.Cluster = name
+		}
+		if name, ok := userNames[c.Context.User]; ok {
+			config.Contexts[i].Context.User = name
+		}
+
+		if c.Name == config.CurrentContext {
+			config.CurrentContext = context
+		}
+		config.Contexts[i].Name = context
+	}
+
+	return marshalKubeconfig(config)
+}
+
+// rewriteServerHost replaces the host in a server URL such as
+// https://127.0.0.1:6443, keeping the scheme and port. IPv6 addresses
+// are bracketed.
+func rewriteServerHost(server, host string) (string, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse server URL %q: %w", server, err)
+	}
+
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+	if port := u.Port(); len(port) > 0 {
+		u.Host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		u.Host = "[" + host + "]"
+	} else {
+		u.Host = host
+	}
+
+	return u.String(), nil
+}
+
+// parseAPIServerURL checks the value of --api-server-url, which must
+// give the scheme and host of the API server
+func parseAPIServerURL(apiServerURL string) (*url.URL, error) {
+	u, err := url.Parse(apiServerURL)
+	if err != nil {
+		return nil, fmt.Errorf("--api-server-url is invalid: %w", err)
+	}
+
+	if u.Scheme != "https" || len(u.Hostname()) == 0 {
+		return nil, fmt.Errorf("--api-server-url must be of the form https://host:port, got: %q", apiServerURL)
+	}
+
+	if len(u.Path) > 0 && u.Path != "/" {
+		return nil, fmt.Errorf("--api-server-url must not have a path, got: %q", apiServerURL)
+	}
+
+	return u, nil
+}
+
+// kubeconfigServer returns the server URL of the first cluster in a
+// kubeconfig
+func kubeconfigServer(kubeconfig []byte) (string, error) {
+	config, err := parseKubeconfig(kubeconfig)
+	if err != nil {
+		return "", err
+	}
+
+	if len(config.Clusters) == 0 {
+		return "", fmt.Errorf("no clusters found in kubeconfig")
+	}
+
+	return config.Clusters[0].Cluster.Server, nil
+}
+
+// setKubeconfigServer sets the server URL of every cluster in a
+// kubeconfig to server
+func setKubeconfigServer(kubeconfig []byte, server string) ([]byte, error) {
+	config, err := parseKubeconfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range config.Clusters {
+		config.Clusters[i].Cluster.Server = strings.TrimSuffix(server, "/")
+	}
+
+	return marshalKubeconfig(config)
+}
+
+// mergeKubeconfig adds the clusters, contexts and users from incoming to
+// existing. Entries with the same name are replaced rather than kept, so
+// that running install or get-config again updates a stale context.
+// The current-context is only changed when useContext is set, or when
+// existing has none.
+func mergeKubeconfig(existing, incoming *Kubeconfig, useContext bool) *Kubeconfig {
+	if len(existing.APIVersion) == 0 {
+		existing.APIVersion = incoming.APIVersion
+	}
+	if len(existing.Kind) == 0 {
+		existing.Kind = incoming.Kind
+	}
+
+	for _, cluster := range incoming.Clusters {
+		existing.Clusters = upsertCluster(existing.Clusters, cluster)
+	}
+	for _, user := range incoming.Users {
+		existing.Users = upsertUser(existing.Users, user)
+	}
+	for _, c := range incoming.Contexts {
+		existing.Contexts = upsertContext(existing.Contexts, c)
+	}
+
+	if len(incoming.CurrentContext) > 0 &&
+		(useContext || len(existing.CurrentContext) == 0) {
+		existing.CurrentContext = incoming.CurrentContext
+	}
+
+	return existing
+}
+
+func upsertCluster(clusters []NamedCluster, cluster NamedCluster) []NamedCluster {
+	for i := range clusters {
+		if clusters[i].Name == cluster.Name {
+			clusters[i] = cluster
+			return clusters
+		}
+	}
+	return append(clusters, cluster)
+}
+
+func upsertUser(users []NamedUser, user NamedUser) []NamedUser {
+	for i := range users {
+		if users[i].Name == user.Name {
+			users[i] = user
+			return users
+		}
+	}
+	return append(users, user)
+}
+
+func upsertContext(contexts []NamedContext, c NamedContext) []NamedContext {
+	for i := range contexts {
+		if contexts[i].Name == c.Name {
+			contexts[i] = c
+			return contexts
+		}
+	}
+	return append(contexts, c)
+}
+
+// backupConfig copies the file at path to a timestamped file alongside
+// it, and returns the name of the copy. Nothing is done if the file does
+// not exist.
+func backupConfig(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	backup := fmt.Sprintf("%s.%s.bak", path, time.Now().Format("20060102-150405"))
+	if err := os.WriteFile(backup, data, 0600); err != nil {
+		return "", fmt.Errorf("could not back up kubeconfig to %s: %w", backup, err)
+	}
+
+	return backup, nil
+}
+
+// removeContext deletes the named context from config, along with the
+// cluster and user it refers to when no other context uses them. If it
+// was the current-context, the first remaining context is used instead.
+func removeContext(config *Kubeconfig, name string) error {
+	var removed *NamedContext
+
+	contexts := []NamedContext{}
+	for i, c := range config.Contexts {
+		if c.Name == name {
+			removed = &config.Contexts[i]
+			continue
+		}
+		contexts = append(contexts, c)
+	}
+
+	if removed == nil {
+		return fmt.Errorf("context %s not found", name)
+	}
+
+	clusterInUse, userInUse := false, false
+	for _, c := range contexts {
+		if c.Context.Cluster == removed.Context.Cluster {
+			clusterInUse = true
+		}
+		if c.Context.User == removed.Context.User {
+			userInUse = true
+		}
+	}
+
+	if !clusterInUse {
+		clusters := []NamedCluster{}
+		for _, cluster := range config.Clusters {
+			if cluster.Name != removed.Context.Cluster {
+				clusters = append(clusters, cluster)
+			}
+		}
+		config.Clusters = clusters
+	}
+
+	if !userInUse {
+		users := []NamedUser{}
+		for _, user := range config.Users {
+			if user.Name != removed.Context.User {
+				users = append(users, user)
+			}
+		}
+		config.Users = users
+	}
+
+	config.Contexts = contexts
+
+	if config.CurrentContext == name {
+		config.CurrentContext = ""
+		if len(contexts) > 0 {
+			config.CurrentContext = contexts[0].Name
+		}
+	}
+
+	return nil
+}
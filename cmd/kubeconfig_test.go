@@ -0,0 +1,255 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const existingKubeconfig = `apiVersion: v1
+kind: Config
+preferences: {}
+clusters:
+  - name: minikube
+    cluster:
+      server: https://192.168.49.2:8443
+  - name: k3s-prod
+    cluster:
+      server: https://10.0.0.1:6443
+contexts:
+  - name: minikube
+    context:
+      cluster: minikube
+      user: minikube
+      namespace: default
+  - name: k3s-prod
+    context:
+      cluster: k3s-prod
+      user: k3s-prod
+current-context: minikube
+users:
+  - name: minikube
+    user:
+      token: abc
+  - name: k3s-prod
+    user:
+      token: stale
+`
+
+func Test_mergeKubeconfig_ReplacesSameName(t *testing.T) {
+	existing, err := parseKubeconfig([]byte(existingKubeconfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k3s, err := rewriteKubeconfig(kubeconfigExample, "10.0.0.2", "k3s-prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	incoming, err := parseKubeconfig(k3s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged := mergeKubeconfig(existing, incoming, false)
+
+	if len(merged.Clusters) != 2 || len(merged.Contexts) != 2 || len(merged.Users) != 2 {
+		t.Fatalf("want 2 clusters, contexts and users, got: %d, %d, %d",
+			len(merged.Clusters), len(merged.Contexts), len(merged.Users))
+	}
+
+	if got := merged.Clusters[1].Cluster.Server; got != "https://10.0.0.2:6443" {
+		t.Errorf("want stale cluster to be replaced, got server: %q", got)
+	}
+	if _, ok := merged.Users[1].User["token"]; ok {
+		t.Errorf("want stale user to be replaced, got: %v", merged.Users[1].User)
+	}
+	if merged.Contexts[0].Context.Namespace != "default" {
+		t.Errorf("want other contexts to be kept, got: %+v", merged.Contexts[0])
+	}
+	if merged.CurrentContext != "minikube" {
+		t.Errorf("want current-context: %q, got: %q", "minikube", merged.CurrentContext)
+	}
+}
+
+func Test_mergeKubeconfig_UseContext(t *testing.T) {
+	existing, err := parseKubeconfig([]byte(existingKubeconfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k3s, err := rewriteKubeconfig(kubeconfigExample, "10.0.0.3", "k3s-dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	incoming, err := parseKubeconfig(k3s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged := mergeKubeconfig(existing, incoming, true)
+
+	if len(merged.Contexts) != 3 {
+		t.Fatalf("want 3 contexts, got: %d", len(merged.Contexts))
+	}
+	if merged.CurrentContext != "k3s-dev" {
+		t.Errorf("want current-context: %q, got: %q", "k3s-dev", merged.CurrentContext)
+	}
+}
+
+func Test_mergeConfigs_MissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+
+	k3s, err := rewriteKubeconfig(kubeconfigExample, "10.0.0.3", "k3s-dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := mergeConfigs(os.Stdout, path, k3s, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := parseKubeconfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.CurrentContext != "k3s-dev" {
+		t.Errorf("want current-context: %q, got: %q", "k3s-dev", merged.CurrentContext)
+	}
+}
+
+func Test_backupConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config")
+
+	backup, err := backupConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backup) > 0 {
+		t.Fatalf("want no backup for a missing file, got: %s", backup)
+	}
+
+	if err := os.WriteFile(path, []byte(existingKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	backup, err = backupConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(backup, path+".") || !strings.HasSuffix(backup, ".bak") {
+		t.Fatalf("unexpected backup name: %s", backup)
+	}
+
+	data, err := os.ReadFile(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != existingKubeconfig {
+		t.Errorf("backup does not match the original file")
+	}
+}
+
+func Test_removeContext(t *testing.T) {
+	config, err := parseKubeconfig([]byte(existingKubeconfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeContext(config, "minikube"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Contexts) != 1 || config.Contexts[0].Name != "k3s-prod" {
+		t.Fatalf("want only k3s-prod context, got: %+v", config.Contexts)
+	}
+	if len(config.Clusters) != 1 || config.Clusters[0].Name != "k3s-prod" {
+		t.Errorf("want only k3s-prod cluster, got: %+v", config.Clusters)
+	}
+	if len(config.Users) != 1 || config.Users[0].Name != "k3s-prod" {
+		t.Errorf("want only k3s-prod user, got: %+v", config.Users)
+	}
+	if config.CurrentContext != "k3s-prod" {
+		t.Errorf("want current-context: %q, got: %q", "k3s-prod", config.CurrentContext)
+	}
+}
+
+func Test_removeContext_KeepsSharedEntries(t *testing.T) {
+	config, err := parseKubeconfig([]byte(existingKubeconfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.Contexts = append(config.Contexts, NamedContext{
+		Name:    "k3s-prod-kube-system",
+		Context: Context{Cluster: "k3s-prod", User: "k3s-prod", Namespace: "kube-system"},
+	})
+
+	if err := removeContext(config, "k3s-prod"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Clusters) != 2 || len(config.Users) != 2 {
+		t.Errorf("want shared cluster and user to be kept, got: %d clusters, %d users",
+			len(config.Clusters), len(config.Users))
+	}
+	if config.CurrentContext != "minikube" {
+		t.Errorf("want current-context: %q, got: %q", "minikube", config.CurrentContext)
+	}
+}
+
+func Test_removeContext_NotFound(t *testing.T) {
+	config, err := parseKubeconfig([]byte(existingKubeconfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeContext(config, "missing"); err == nil {
+		t.Fatal("want an error for a missing context")
+	}
+}
+
+func Test_parseAPIServerURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"https://k3s.example.com:6443", false},
+		{"https://[2001:db8::1]:6443", false},
+		{"https://10.0.0.1", false},
+		{"http://k3s.example.com:6443", true},
+		{"k3s.example.com:6443", true},
+		{"https://k3s.example.com:6443/api", true},
+	}
+
+	for _, tc := range tests {
+		_, err := parseAPIServerURL(tc.url)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("parseAPIServerURL(%q) want error: %v, got: %v", tc.url, tc.wantErr, err)
+		}
+	}
+}
+
+func Test_setKubeconfigServer(t *testing.T) {
+	rewritten, err := rewriteKubeconfig(kubeconfigExample, "10.0.0.1", "k3s-prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := setKubeconfigServer(rewritten, "https://k3s.example.com:443/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := kubeconfigServer(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "https://k3s.example.com:443"; server != want {
+		t.Errorf("want server: %q, got: %q", want, server)
+	}
+}
@@ -25,6 +25,9 @@ server or agent to join the cluster.
 `,
 		Example: `  # Get the node token from the server and pipe it to a file
   k3sup node-token --ip IP --user USER > token.txt
+
+  # Get the node token from a cluster recorded by k3sup install
+  k3sup node-token --cluster prod > token.txt
 `,
 		SilenceUsage: true,
 	}
@@ -41,8 +44,13 @@ server or agent to join the cluster.
 
 	command.Flags().Bool("print-command", false, "Print the command to be executed")
 	command.Flags().String("server-data-dir", "/var/lib/rancher/k3s/", "Override the path used to fetch the node-token from the server")
+	addClusterFlag(command)
 
 	command.PreRunE = func(command *cobra.Command, args []string) error {
+		if err := fillFromCluster(command, serverClusterValues); err != nil {
+			return err
+		}
+
 		local, err := command.Flags().GetBool("local")
 		if err != nil {
 			return err
@@ -0,0 +1,275 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// planDocument is the resolved plan written by plan --output json or
+// yaml, and read by apply --plan
+type planDocument struct {
+	Steps []planStep `json:"steps" yaml:"steps"`
+}
+
+// planRenderers render the steps of a plan in formats other than the
+// default shell script
+var planRenderers = map[string]func([]planStep) (string, error){
+	"json":           renderPlanJSON,
+	"yaml":           renderPlanYAML,
+	"makefile":       renderPlanMakefile,
+	"github-actions": renderPlanGitHubActions,
+}
+
+func renderPlanJSON(steps []planStep) (string, error) {
+	data, err := json.MarshalIndent(planDocument{Steps: steps}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data) + "\n", nil
+}
+
+func renderPlanYAML(steps []planStep) (string, error) {
+	return marshalYAML(planDocument{Steps: steps})
+}
+
+func marshalYAML(v interface{}) (string, error) {
+	buf := bytes.Buffer{}
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(v); err != nil {
+		return "", err
+	}
+	if err := encoder.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// readPlanDocument reads a plan written by plan --output json or yaml
+func readPlanDocument(name string) ([]planStep, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON is also valid YAML
+	doc := planDocument{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("unable to read the plan in %s: %w", name, err)
+	}
+
+	if len(doc.Steps) == 0 {
+		return nil, fmt.Errorf("no steps found in the plan in %s", name)
+	}
+	for i, step := range doc.Steps {
+		if len(step.Name) == 0 || len(step.Host.Address()) == 0 {
+			return nil, fmt.Errorf("step %d of the plan in %s needs a name and a host", i+1, name)
+		}
+		if (i == 0) != (step.Command == "install") || (i > 0 && step.Command != "join") {
+			return nil, fmt.Errorf("the plan in %s must install the first server, then join each other node", name)
+		}
+	}
+
+	return doc.Steps, nil
+}
+
+var unsafeMakeTarget = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+func makeTarget(name string) string {
+	return "k3s-" + unsafeMakeTarget.ReplaceAllString(name, "_")
+}
+
+// shellCommand gives the command line for args, quoting where needed
+func shellCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellArg(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// nodeTokenCommand gives the k3sup node-token command for the first
+// server of a plan
+func nodeTokenCommand(primary planStep) string {
+	args := []string{"k3sup", "node-token"}
+	for _, flag := range primary.connectionFlags() {
+		args = append(args, flag.args()...)
+	}
+	if dataDir := k3sExtraArg(flagValue(primary.Flags, "k3s-extra-args"), "--data-dir", ""); len(dataDir) > 0 {
+		args = append(args, "--server-data-dir", dataDir)
+	}
+	return shellCommand(args)
+}
+
+// renderPlanMakefile gives a Makefile with a target per host, which
+// depends on the targets the step depends on, so that make -j runs the
+// agents in parallel. The node token is kept in a file readable only by
+// the user.
+func renderPlanMakefile(steps []planStep) (string, error) {
+	const tokenFile = ".k3sup-node-token"
+
+	targets := make([]string, len(steps))
+	for i, step := range steps {
+		targets[i] = makeTarget(step.Name)
+	}
+
+	out := strings.Builder{}
+	out.WriteString("# Generated by k3sup plan, run with: make -j 5\n\n")
+	fmt.Fprintf(&out, ".PHONY: all clean %s\n\n", strings.Join(targets, " "))
+	fmt.Fprintf(&out, "all: %s\n\n", strings.Join(targets, " "))
+
+	for i, step := range steps {
+		deps := []string{}
+		for _, dep := range step.DependsOn {
+			deps = append(deps, makeTarget(dep))
+		}
+
+		fmt.Fprintf(&out, "%s:", targets[i])
+		if len(deps) > 0 {
+			fmt.Fprintf(&out, " %s", strings.Join(deps, " "))
+		}
+		out.WriteString("\n")
+
+		args := append([]string{"k3sup"}, step.Args()...)
+		if i > 0 {
+			args = append(args, "--node-token-path", tokenFile)
+		}
+		fmt.Fprintf(&out, "\t%s\n", makeEscape(shellCommand(args)))
+		if i == 0 {
+			fmt.Fprintf(&out, "\tumask 077 && %s > %s\n", makeEscape(nodeTokenCommand(step)), tokenFile)
+		}
+		out.WriteString("\n")
+	}
+
+	fmt.Fprintf(&out, "clean:\n\trm -f %s\n", tokenFile)
+
+	return out.String(), nil
+}
+
+func makeEscape(s string) string {
+	return strings.ReplaceAll(s, "$", "$$")
+}
+
+type githubWorkflow struct {
+	Name string               `yaml:"name"`
+	On   map[string]yaml.Node `yaml:"on"`
+	Jobs map[string]githubJob `yaml:"jobs"`
+}
+
+type githubJob struct {
+	Name     string          `yaml:"name"`
+	RunsOn   string          `yaml:"runs-on"`
+	Needs    []string        `yaml:"needs,omitempty"`
+	Strategy *githubStrategy `yaml:"strategy,omitempty"`
+	Steps    []githubStep    `yaml:"steps"`
+}
+
+type githubStrategy struct {
+	FailFast    bool         `yaml:"fail-fast"`
+	MaxParallel int          `yaml:"max-parallel,omitempty"`
+	Matrix      githubMatrix `yaml:"matrix"`
+}
+
+type githubMatrix struct {
+	Include []githubMatrixEntry `yaml:"include"`
+}
+
+type githubMatrixEntry struct {
+	Name string `yaml:"name"`
+	Role string `yaml:"role"`
+	Args string `yaml:"args"`
+}
+
+type githubStep struct {
+	Name string            `yaml:"name"`
+	Run  string            `yaml:"run"`
+	Env  map[string]string `yaml:"env,omitempty"`
+}
+
+// renderPlanGitHubActions gives a GitHub Actions workflow which installs
+// the first server, then joins the other servers one at a time, then the
+// agents as a job matrix. The SSH key is read from the SSH_PRIVATE_KEY
+// secret of the repository.
+func renderPlanGitHubActions(steps []planStep) (string, error) {
+	setup := []githubStep{
+		{
+			Name: "Install k3sup",
+			Run:  "curl -sLS https://get.k3sup.dev | sh\nsudo install k3sup /usr/local/bin/\n",
+		},
+		{
+			Name: "Add the SSH key",
+			Run:  "mkdir -p ~/.ssh\necho \"$SSH_PRIVATE_KEY\" > ~/.ssh/id_rsa\nchmod 600 ~/.ssh/id_rsa\n",
+			Env:  map[string]string{"SSH_PRIVATE_KEY": "${{ secrets.SSH_PRIVATE_KEY }}"},
+		},
+	}
+
+	primary := steps[0]
+	jobs := map[string]githubJob{
+		"primary": {
+			Name:   "Install " + primary.Name,
+			RunsOn: "ubuntu-latest",
+			Steps: append(append([]githubStep{}, setup...), githubStep{
+				Name: "Install the first server",
+				Run:  shellCommand(append([]string{"k3sup"}, primary.Args()...)) + "\n",
+			}),
+		},
+	}
+
+	joinStep := githubStep{
+		Name: "Join ${{ matrix.name }}",
+		Run: fmt.Sprintf("NODE_TOKEN=$(%s)\necho \"::add-mask::$NODE_TOKEN\"\nk3sup ${{ matrix.args }} --node-token \"$NODE_TOKEN\"\n",
+			nodeTokenCommand(primary)),
+	}
+
+	servers := []githubMatrixEntry{}
+	agents := []githubMatrixEntry{}
+	for _, step := range steps[1:] {
+		entry := githubMatrixEntry{Name: step.Name, Role: step.Role, Args: shellCommand(step.Args())}
+		if step.Role == "server" {
+			servers = append(servers, entry)
+		} else {
+			agents = append(agents, entry)
+		}
+	}
+
+	needs := []string{"primary"}
+	if len(servers) > 0 {
+		jobs["servers"] = githubJob{
+			Name:     "Join ${{ matrix.name }}",
+			RunsOn:   "ubuntu-latest",
+			Needs:    needs,
+			Strategy: &githubStrategy{MaxParallel: 1, Matrix: githubMatrix{Include: servers}},
+			Steps:    append(append([]githubStep{}, setup...), joinStep),
+		}
+		needs = []string{"servers"}
+	}
+	if len(agents) > 0 {
+		jobs["agents"] = githubJob{
+			Name:     "Join ${{ matrix.name }}",
+			RunsOn:   "ubuntu-latest",
+			Needs:    needs,
+			Strategy: &githubStrategy{Matrix: githubMatrix{Include: agents}},
+			Steps:    append(append([]githubStep{}, setup...), joinStep),
+		}
+	}
+
+	workflow := githubWorkflow{
+		Name: "k3sup",
+		On:   map[string]yaml.Node{"workflow_dispatch": {Kind: yaml.MappingNode, Tag: "!!map"}},
+		Jobs: jobs,
+	}
+
+	rendered, err := marshalYAML(workflow)
+	if err != nil {
+		return "", err
+	}
+	return "# Generated by k3sup plan, add the SSH key as the SSH_PRIVATE_KEY secret\n" + rendered, nil
+}
@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func makeTestPlanSteps() []planStep {
+	hosts := []Host{
+		{Hostname: "node-1", IP: "10.0.0.1"},
+		{Hostname: "node-2", IP: "10.0.0.2"},
+		{Hostname: "node-3", IP: "10.0.0.3", Labels: map[string]string{"tier": "web"}},
+		{IP: "10.0.0.4"},
+	}
+
+	return makePlanSteps(hosts, planOptions{
+		Servers:         2,
+		User:            "ubuntu",
+		ServerExtraArgs: "--disable traefik",
+		LocalPath:       "kubeconfig",
+		Context:         "default",
+		Sudo:            true,
+	})
+}
+
+func Test_makePlanSteps_DependsOn(t *testing.T) {
+	steps := makeTestPlanSteps()
+
+	want := [][]string{nil, {"node-1"}, {"node-2"}, {"node-2"}}
+	for i, step := range steps {
+		if !reflect.DeepEqual(step.DependsOn, want[i]) {
+			t.Errorf("step %d: want depends_on %v, got %v", i, want[i], step.DependsOn)
+		}
+	}
+}
+
+func Test_readPlanDocument(t *testing.T) {
+	steps := makeTestPlanSteps()
+
+	for _, format := range []string{"json", "yaml"} {
+		t.Run(format, func(t *testing.T) {
+			rendered, err := planRenderers[format](steps)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readPlanDocument(writeHostsFile(t, "plan."+format, rendered))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, steps) {
+				t.Errorf("want\n%+v\ngot\n%+v", steps, got)
+			}
+		})
+	}
+}
+
+func Test_readPlanDocument_Errors(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"empty", `{"steps": []}`, "no steps found"},
+		{"unknown field", `{"steps": [{"name": "a", "host": {"ip": "10.0.0.1"}, "command": "install", "cmd": "x"}]}`, "field cmd not found"},
+		{"join first", `{"steps": [{"name": "a", "host": {"ip": "10.0.0.1"}, "command": "join"}]}`, "must install the first server"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := readPlanDocument(writeHostsFile(t, "plan.json", c.content))
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("want error containing %q, got %v", c.want, err)
+			}
+		})
+	}
+}
+
+func Test_renderPlanMakefile(t *testing.T) {
+	got, err := renderPlanMakefile(makeTestPlanSteps())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"all: k3s-node-1 k3s-node-2 k3s-node-3 k3s-10.0.0.4\n",
+		"k3s-node-1:\n\tk3sup install --host 10.0.0.1 --user ubuntu --cluster --local-path kubeconfig --context default --k3s-extra-args '--disable traefik'\n" +
+			"\tumask 077 && k3sup node-token --host 10.0.0.1 --user ubuntu > .k3sup-node-token\n",
+		"k3s-node-2: k3s-node-1\n\tk3sup join --host 10.0.0.2 --user ubuntu --server-host 10.0.0.1 --server --k3s-extra-args '--disable traefik' --node-token-path .k3sup-node-token\n",
+		"k3s-10.0.0.4: k3s-node-2\n",
+		"--k3s-extra-args '--node-label tier=web'",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("want Makefile to contain\n%q\ngot\n%s", want, got)
+		}
+	}
+}
+
+func Test_renderPlanGitHubActions(t *testing.T) {
+	rendered, err := renderPlanGitHubActions(makeTestPlanSteps())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	workflow := githubWorkflow{}
+	if err := yaml.Unmarshal([]byte(rendered), &workflow); err != nil {
+		t.Fatalf("invalid YAML: %s\n%s", err, rendered)
+	}
+
+	servers, agents := workflow.Jobs["servers"], workflow.Jobs["agents"]
+	if !reflect.DeepEqual(servers.Needs, []string{"primary"}) || !reflect.DeepEqual(agents.Needs, []string{"servers"}) {
+		t.Errorf("want servers after primary and agents after servers, got %v and %v", servers.Needs, agents.Needs)
+	}
+	if servers.Strategy.MaxParallel != 1 {
+		t.Errorf("want servers to join one at a time, got max-parallel %d", servers.Strategy.MaxParallel)
+	}
+	if len(agents.Strategy.Matrix.Include) != 2 || agents.Strategy.Matrix.Include[0].Name != "node-3" {
+		t.Errorf("want a matrix entry for each agent, got %+v", agents.Strategy.Matrix.Include)
+	}
+	if _, ok := workflow.On["workflow_dispatch"]; !ok {
+		t.Errorf("want the workflow to be run manually, got %+v", workflow.On)
+	}
+}
@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// planIssue is a problem found in a plan. Warnings only fail the plan
+// with --strict.
+type planIssue struct {
+	Warning bool
+	Message string
+}
+
+// validatePlan checks the steps of a plan for problems with the etcd
+// quorum, duplicate hosts and inconsistent settings. requestedServers is
+// the value of --servers, or 0 when it is not known.
+func validatePlan(steps []planStep, requestedServers int) []planIssue {
+	issues := []planIssue{}
+	warn := func(format string, a ...interface{}) {
+		issues = append(issues, planIssue{Warning: true, Message: fmt.Sprintf(format, a...)})
+	}
+	fail := func(format string, a ...interface{}) {
+		issues = append(issues, planIssue{Message: fmt.Sprintf(format, a...)})
+	}
+
+	if len(steps) == 0 {
+		fail("no hosts are planned")
+		return issues
+	}
+
+	addresses := map[string]string{}
+	hostnames := map[string]string{}
+	servers, autoRoles, autoAgents := 0, 0, 0
+	for _, step := range steps {
+		if other, ok := addresses[step.Host.Address()]; ok {
+			fail("%s is planned twice, for %s and %s", step.Host.Address(), other, step.Name)
+		} else {
+			addresses[step.Host.Address()] = step.Name
+		}
+
+		if len(step.Host.Hostname) > 0 {
+			if other, ok := hostnames[step.Host.Hostname]; ok {
+				fail("hostname %s is used by both %s and %s", step.Host.Hostname, other, step.Host.Address())
+			} else {
+				hostnames[step.Host.Hostname] = step.Host.Address()
+			}
+		}
+
+		if step.Role == "server" {
+			servers++
+		}
+		if len(step.Host.Role) == 0 {
+			autoRoles++
+			if step.Role == "agent" {
+				autoAgents++
+			}
+		}
+	}
+
+	if servers == 0 {
+		fail("no servers are planned, so the agents have no server to join")
+		return issues
+	}
+	if steps[0].Role != "server" {
+		fail("the first step must install a server, not an %s", steps[0].Role)
+	}
+
+	// Hosts without a role all became servers, so there were not enough
+	// of them, or --limit cut into the servers
+	if requestedServers > servers && autoRoles > 0 && autoAgents == 0 {
+		warn("only %d of the %d servers given by --servers are planned, check --limit and the number of hosts", servers, requestedServers)
+	}
+
+	if servers%2 == 0 {
+		warn("%d servers are planned, an even number adds no fault tolerance to etcd over %d servers, and etcd loses quorum if %d are down",
+			servers, servers-1, servers/2)
+	}
+
+	if servers > 1 && !planHasTLSSAN(steps[0]) {
+		warn("%d servers are planned without --tls-san, so the API server's certificate only covers each server's own address, add the address of a load balancer or DNS name",
+			servers)
+	}
+
+	return issues
+}
+
+func planHasTLSSAN(step planStep) bool {
+	return len(flagValue(step.Flags, "tls-san")) > 0 ||
+		len(k3sExtraArg(flagValue(step.Flags, "k3s-extra-args"), "--tls-san", "")) > 0
+}
+
+// reportPlanIssues writes each issue to w, and gives an error when there
+// are errors, or warnings with strict
+func reportPlanIssues(w io.Writer, issues []planIssue, strict bool) error {
+	errors, warnings := 0, 0
+	for _, issue := range issues {
+		if issue.Warning {
+			warnings++
+			fmt.Fprintf(w, "Warning: %s\n", issue.Message)
+		} else {
+			errors++
+			fmt.Fprintf(w, "Error: %s\n", issue.Message)
+		}
+	}
+
+	if errors > 0 || (strict && warnings > 0) {
+		found := []string{}
+		if errors > 0 {
+			found = append(found, plural(errors, "error"))
+		}
+		if warnings > 0 {
+			found = append(found, plural(warnings, "warning"))
+		}
+		return fmt.Errorf("the plan has %s", strings.Join(found, " and "))
+	}
+
+	return nil
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func makeTestHosts(n int) []Host {
+	hosts := []Host{}
+	for i := 1; i <= n; i++ {
+		hosts = append(hosts, Host{Hostname: fmt.Sprintf("node-%d", i), IP: fmt.Sprintf("10.0.0.%d", i)})
+	}
+	return hosts
+}
+
+func Test_validatePlan(t *testing.T) {
+	cases := []struct {
+		name    string
+		hosts   []Host
+		options planOptions
+		want    []string
+	}{
+		{
+			name:    "three servers with a TLS SAN",
+			hosts:   makeTestHosts(5),
+			options: planOptions{Servers: 3, TLSSAN: "k3s.example.com"},
+			want:    []string{},
+		},
+		{
+			name:    "single server",
+			hosts:   makeTestHosts(3),
+			options: planOptions{Servers: 1},
+			want:    []string{},
+		},
+		{
+			name:    "even number of servers",
+			hosts:   makeTestHosts(5),
+			options: planOptions{Servers: 4, TLSSAN: "k3s.example.com"},
+			want:    []string{"Warning: 4 servers are planned, an even number"},
+		},
+		{
+			name:    "limit in the middle of the servers",
+			hosts:   makeTestHosts(5),
+			options: planOptions{Servers: 3, Limit: 2, TLSSAN: "k3s.example.com"},
+			want:    []string{"Warning: only 2 of the 3 servers", "Warning: 2 servers are planned"},
+		},
+		{
+			name:    "no TLS SAN",
+			hosts:   makeTestHosts(3),
+			options: planOptions{Servers: 3},
+			want:    []string{"Warning: 3 servers are planned without --tls-san"},
+		},
+		{
+			name:    "TLS SAN in the extra args",
+			hosts:   makeTestHosts(3),
+			options: planOptions{Servers: 3, ServerExtraArgs: "--tls-san k3s.example.com"},
+			want:    []string{},
+		},
+		{
+			name:    "duplicate IP and hostname",
+			hosts:   []Host{{Hostname: "a", IP: "10.0.0.1"}, {Hostname: "b", IP: "10.0.0.1"}, {Hostname: "a", IP: "10.0.0.3"}},
+			options: planOptions{Servers: 1},
+			want:    []string{"Error: 10.0.0.1 is planned twice", "Error: hostname a is used by both"},
+		},
+		{
+			name:    "agents without a server",
+			hosts:   []Host{{IP: "10.0.0.1", Role: "agent"}, {IP: "10.0.0.2", Role: "agent"}},
+			options: planOptions{Servers: 1},
+			want:    []string{"Error: no servers are planned"},
+		},
+		{
+			name:    "explicit roles with fewer servers than --servers",
+			hosts:   []Host{{IP: "10.0.0.1", Role: "server"}, {IP: "10.0.0.2", Role: "agent"}},
+			options: planOptions{Servers: 3},
+			want:    []string{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			issues := validatePlan(makePlanSteps(c.hosts, c.options), c.options.Servers)
+
+			out := &bytes.Buffer{}
+			reportPlanIssues(out, issues, false)
+			lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+			if out.Len() == 0 {
+				lines = []string{}
+			}
+
+			if len(lines) != len(c.want) {
+				t.Fatalf("want %d issues, got %d:\n%s", len(c.want), len(lines), out.String())
+			}
+			for i, want := range c.want {
+				if !strings.HasPrefix(lines[i], want) {
+					t.Errorf("issue %d: want prefix %q, got %q", i, want, lines[i])
+				}
+			}
+		})
+	}
+}
+
+func Test_reportPlanIssues(t *testing.T) {
+	warning := []planIssue{{Warning: true, Message: "even"}}
+
+	if err := reportPlanIssues(&bytes.Buffer{}, warning, false); err != nil {
+		t.Errorf("want warnings to pass, got %s", err)
+	}
+
+	err := reportPlanIssues(&bytes.Buffer{}, warning, true)
+	if err == nil || err.Error() != "the plan has 1 warning" {
+		t.Errorf("want warnings to fail with strict, got %v", err)
+	}
+
+	err = reportPlanIssues(&bytes.Buffer{}, append(warning, planIssue{Message: "duplicate"}, planIssue{Message: "duplicate"}), false)
+	if err == nil || err.Error() != "the plan has 2 errors and 1 warning" {
+		t.Errorf("want errors to fail, got %v", err)
+	}
+}
@@ -1,9 +1,12 @@
 package cmd
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/alexellis/k3sup/pkg"
 	"github.com/spf13/cobra"
@@ -22,6 +25,24 @@ Examples JSON input file:
 {"hostname": "node-2", "ip": "192.168.128.103"},
 {"hostname": "node-3", "ip": "192.168.128.104"}]
 
+Each host may also set "user", "ssh_port", "ssh_key", "role" (server
+or agent), "labels", "taints", "k3s_extra_args", "node_ip" and
+"external_ip", which override the flags for that host. Hosts without
+a role make up the rest of --servers, then are added as agents.
+
+The devices file can also be a YAML list with the same fields, a CSV
+file with a header row naming the fields, or an Ansible inventory in
+INI or YAML format. For an Ansible inventory, hosts in groups such as
+servers, masters, agents or workers get that role, ansible_host,
+ansible_user, ansible_port and ansible_ssh_private_key_file set how to
+connect, and the other fields are read from variables prefixed with
+"k3sup_", i.e. k3sup_labels.
+
+The plan is checked before it is printed. Duplicate hosts or hostnames
+and agents without a server are errors. An even number of servers,
+fewer servers than --servers, and more than one server without a
+--tls-san are warnings, which only fail the plan with --strict.
+
 ` + pkg.SupportMessageShort + `
 `,
 		Example: `  # Generate an installation script where the first
@@ -31,6 +52,18 @@ Examples JSON input file:
 
   # Override the TLS SAN, for HA with 5 servers specified
   k3sup plan hosts.json --servers 5 --tls-san $SAN_IP
+
+  # Read the hosts from Terraform, with the instances of the
+  # aws_instance.server resource as servers
+  k3sup plan --from-terraform terraform.tfstate \
+    --terraform-server aws_instance.server \
+    --terraform-agent aws_instance.agent
+
+  # Per-host settings in the devices file
+  [{"hostname": "node-1", "ip": "10.0.0.2", "role": "server",
+    "user": "ubuntu", "taints": ["CriticalAddonsOnly=true:NoExecute"]},
+   {"hostname": "node-2", "ip": "10.0.0.3", "ssh_port": 2222,
+    "labels": {"tier": "web"}, "node_ip": "192.168.0.3"}]
 `,
 		SilenceUsage: true,
 	}
@@ -44,152 +77,398 @@ Examples JSON input file:
 	command.Flags().String("tls-san", "", "SAN for TLS certificates, can be a comma-separated list")
 	command.Flags().String("server-k3s-extra-args", "", "Extra arguments to be passed into the k3s server")
 	command.Flags().String("agent-k3s-extra-args", "", "Extra arguments to be passed into the k3s agent")
+	command.Flags().String("k3s-version", "", "Version of K3s to install on every host, i.e. v1.30.2+k3s1, the stable channel is used when not given")
 
 	// Background
 	command.Flags().Bool("background", false, "Run the installation in the background for all agents/nodes after the first server is up")
 
+	addTerraformFlags(command)
+
+	command.Flags().StringP("output", "o", "script", "Output format: script, json, yaml, makefile or github-actions")
+	command.Flags().Bool("strict", false, "Fail on warnings found when validating the plan, as well as errors, i.e. for CI")
+
 	command.Flags().Int("limit", 0, "Maximum number of nodes to use from the devices file, 0 to use all devices")
 
 	command.Flags().Bool("merge", true, `Merge the config with existing kubeconfig if it already exists.
 Provide the --local-path flag with --merge if a kubeconfig already exists in some other directory`)
 
-	command.RunE = func(cmd *cobra.Command, args []string) error {
-
-		if len(args) == 0 {
-			return fmt.Errorf("give a path to a JSON file containing a list of devices")
+	command.PreRunE = func(cmd *cobra.Command, args []string) error {
+		output, _ := cmd.Flags().GetString("output")
+		if _, ok := planRenderers[output]; !ok && output != "script" {
+			return fmt.Errorf("--output must be script, json, yaml, makefile or github-actions, got: %q", output)
 		}
+		return nil
+	}
 
-		nodeLimit, _ := cmd.Flags().GetInt("limit")
-		name := args[0]
-		data, err := os.ReadFile(name)
+	command.RunE = func(cmd *cobra.Command, args []string) error {
+
+		hosts, err := readPlanHosts(cmd, args)
 		if err != nil {
 			return err
 		}
 
+		options := planOptions{Sudo: true}
+		options.Servers, _ = cmd.Flags().GetInt("servers")
+		options.Limit, _ = cmd.Flags().GetInt("limit")
+		options.User, _ = cmd.Flags().GetString("user")
+		options.SSHKey, _ = cmd.Flags().GetString("ssh-key")
+		options.TLSSAN, _ = cmd.Flags().GetString("tls-san")
+		options.ServerExtraArgs, _ = cmd.Flags().GetString("server-k3s-extra-args")
+		options.AgentExtraArgs, _ = cmd.Flags().GetString("agent-k3s-extra-args")
+		options.LocalPath, _ = cmd.Flags().GetString("local-path")
+		options.Context, _ = cmd.Flags().GetString("context")
+		options.K3sVersion, _ = cmd.Flags().GetString("k3s-version")
+		if merge, _ := cmd.Flags().GetBool("merge"); merge {
+			if _, err := os.Stat(options.LocalPath); err == nil {
+				options.Merge = true
+			}
+		}
 		background, _ := cmd.Flags().GetBool("background")
-		merge, _ := cmd.Flags().GetBool("merge")
 
-		var hosts []Host
-		if err = json.Unmarshal(data, &hosts); err != nil {
+		output, _ := cmd.Flags().GetString("output")
+
+		strict, _ := cmd.Flags().GetBool("strict")
+
+		steps := makePlanSteps(hosts, options)
+
+		// Issues go to stderr, so that the output can be redirected
+		if err := reportPlanIssues(os.Stderr, validatePlan(steps, options.Servers), strict); err != nil {
 			return err
 		}
 
-		serverK3sExtraArgs, _ := cmd.Flags().GetString("server-k3s-extra-args")
-		agentK3sExtraArgs, _ := cmd.Flags().GetString("agent-k3s-extra-args")
+		if output == "script" {
+			fmt.Printf("%s\n", renderPlanScript(steps, background))
+			return nil
+		}
 
-		servers, _ := cmd.Flags().GetInt("servers")
-		kubeconfig, _ := cmd.Flags().GetString("local-path")
-		contextName, _ := cmd.Flags().GetString("context")
-		user, _ := cmd.Flags().GetString("user")
-		tlsSan, _ := cmd.Flags().GetString("tls-san")
+		rendered, err := planRenderers[output](steps)
+		if err != nil {
+			return err
+		}
+		fmt.Print(rendered)
+
+		return nil
+	}
 
-		tlsSanStr := ""
-		if len(tlsSan) > 0 {
-			tlsSanStr = fmt.Sprintf(` \
---tls-san %s`, tlsSan)
+	return command
+}
+
+// Host is a device to install K3s on, read from the devices file. All
+// fields other than the hostname and IP override the flags for the host.
+type Host struct {
+	Hostname     string            `json:"hostname" yaml:"hostname"`
+	IP           string            `json:"ip" yaml:"ip"`
+	User         string            `json:"user,omitempty" yaml:"user,omitempty"`
+	SSHPort      int               `json:"ssh_port,omitempty" yaml:"ssh_port,omitempty"`
+	SSHKey       string            `json:"ssh_key,omitempty" yaml:"ssh_key,omitempty"`
+	Role         string            `json:"role,omitempty" yaml:"role,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Taints       []string          `json:"taints,omitempty" yaml:"taints,omitempty"`
+	K3sExtraArgs string            `json:"k3s_extra_args,omitempty" yaml:"k3s_extra_args,omitempty"`
+	NodeIP       string            `json:"node_ip,omitempty" yaml:"node_ip,omitempty"`
+	ExternalIP   string            `json:"external_ip,omitempty" yaml:"external_ip,omitempty"`
+}
+
+// Address is where to connect to the host, its IP when given, otherwise
+// its hostname
+func (h Host) Address() string {
+	if len(h.IP) > 0 {
+		return h.IP
+	}
+	return h.Hostname
+}
+
+// hostRoles gives the role of each host. Hosts with a role keep it, then
+// those without make up the rest of servers, in order, then are agents.
+func hostRoles(hosts []Host, servers int) []string {
+	remaining := servers
+	for _, host := range hosts {
+		if host.Role == "server" {
+			remaining--
 		}
+	}
+
+	roles := make([]string, len(hosts))
+	for i, host := range hosts {
+		switch {
+		case len(host.Role) > 0:
+			roles[i] = host.Role
+		case remaining > 0:
+			roles[i] = "server"
+			remaining--
+		default:
+			roles[i] = "agent"
+		}
+	}
+	return roles
+}
 
-		sshKey, _ := cmd.Flags().GetString("ssh-key")
+// planOptions are the settings shared by every node in a plan
+type planOptions struct {
+	Servers         int
+	Limit           int
+	User            string
+	SSHKey          string
+	TLSSAN          string
+	ServerExtraArgs string
+	AgentExtraArgs  string
+	LocalPath       string
+	Context         string
+	Merge           bool
+	Sudo            bool
+	K3sVersion      string
+}
 
-		sshKeySt := ""
-		if len(sshKey) > 0 {
-			sshKeySt = fmt.Sprintf(` \
---ssh-key %s`, sshKey)
+// planFlag is a flag of a k3sup command, a flag without a value is a
+// boolean which is set
+type planFlag struct {
+	Name  string `json:"name" yaml:"name"`
+	Value string `json:"value,omitempty" yaml:"value,omitempty"`
+
+	// Bool marks a boolean flag with a value, which has to be joined to
+	// its name, i.e. --sudo=false
+	Bool bool `json:"bool,omitempty" yaml:"bool,omitempty"`
+}
+
+// args gives the command line arguments for the flag
+func (f planFlag) args() []string {
+	switch {
+	case f.Bool:
+		return []string{"--" + f.Name + "=" + f.Value}
+	case len(f.Value) == 0:
+		return []string{"--" + f.Name}
+	default:
+		return []string{"--" + f.Name, f.Value}
+	}
+}
+
+// planStep is the k3sup command which installs K3s on one host
+type planStep struct {
+	// Name is how the step's host is shown in output
+	Name      string     `json:"name" yaml:"name"`
+	Host      Host       `json:"host" yaml:"host"`
+	Role      string     `json:"role" yaml:"role"`
+	Command   string     `json:"command" yaml:"command"`
+	Flags     []planFlag `json:"flags" yaml:"flags"`
+	DependsOn []string   `json:"depends_on,omitempty" yaml:"depends_on,omitempty"`
+
+	// The SSH settings for the host, for commands other than Command
+	User    string `json:"user" yaml:"user"`
+	SSHPort int    `json:"ssh_port,omitempty" yaml:"ssh_port,omitempty"`
+	SSHKey  string `json:"ssh_key,omitempty" yaml:"ssh_key,omitempty"`
+	Sudo    bool   `json:"sudo" yaml:"sudo"`
+}
+
+// Args gives the arguments to run the step with k3sup
+func (s planStep) Args() []string {
+	args := []string{s.Command}
+	for _, flag := range s.Flags {
+		args = append(args, flag.args()...)
+	}
+	return args
+}
+
+// connectionFlags gives the flags for other k3sup commands to connect to
+// the step's host
+func (s planStep) connectionFlags() []planFlag {
+	flags := []planFlag{{Name: "host", Value: s.Host.Address()}, {Name: "user", Value: s.User}}
+	if s.SSHPort > 0 {
+		flags = append(flags, planFlag{Name: "ssh-port", Value: strconv.Itoa(s.SSHPort)})
+	}
+	if len(s.SSHKey) > 0 {
+		flags = append(flags, planFlag{Name: "ssh-key", Value: s.SSHKey})
+	}
+	if !s.Sudo {
+		flags = append(flags, planFlag{Name: "sudo", Value: "false", Bool: true})
+	}
+	return flags
+}
+
+// makePlanSteps gives a step to install the first server, then a step to
+// join each additional server, then each agent. Join steps do not include
+// the node token, which is only known once the first server is up.
+func makePlanSteps(hosts []Host, options planOptions) []planStep {
+	if options.Limit > 0 && len(hosts) > options.Limit {
+		hosts = hosts[:options.Limit]
+	}
+
+	roles := hostRoles(hosts, options.Servers)
+
+	servers := []planStep{}
+	agents := []planStep{}
+	for i, host := range hosts {
+		step := planStep{
+			Name:    host.Hostname,
+			Host:    host,
+			Role:    roles[i],
+			User:    options.User,
+			SSHPort: host.SSHPort,
+			SSHKey:  options.SSHKey,
+			Sudo:    options.Sudo,
+		}
+		if len(step.Name) == 0 {
+			step.Name = host.Address()
+		}
+		if len(host.User) > 0 {
+			step.User = host.User
+		}
+		if len(host.SSHKey) > 0 {
+			step.SSHKey = host.SSHKey
 		}
 
-		mergeStr := ""
-		if merge {
-			if _, err := os.Stat(kubeconfig); err == nil {
-				mergeStr = " \n--merge"
-			}
+		if step.Role == "server" {
+			servers = append(servers, step)
+		} else {
+			agents = append(agents, step)
 		}
+	}
+
+	steps := append(servers, agents...)
+	lastServer := planStep{}
+	if len(servers) > 0 {
+		lastServer = servers[len(servers)-1]
+	}
+	for i := range steps {
+		step := &steps[i]
 
-		bgStr := ""
-		if background {
-			bgStr = " &"
+		extraArgs := options.AgentExtraArgs
+		if step.Role == "server" {
+			extraArgs = options.ServerExtraArgs
 		}
 
-		serversAdded := 0
-		var primaryServer Host
-		script := "#!/bin/sh\n\n"
+		if i == 0 {
+			step.Command = "install"
+			step.Flags = append(step.connectionFlags(),
+				planFlag{Name: "cluster"},
+				planFlag{Name: "local-path", Value: options.LocalPath},
+				planFlag{Name: "context", Value: options.Context})
+		} else {
+			step.Command = "join"
+			step.Flags = append(step.connectionFlags(), planFlag{Name: "server-host", Value: steps[0].Host.Address()})
+			if step.Role == "server" {
+				step.Flags = append(step.Flags, planFlag{Name: "server"})
+			}
+
+			// Servers join one at a time, then agents once all servers are up
+			step.DependsOn = []string{steps[i-1].Name}
+			if step.Role == "agent" {
+				step.DependsOn = []string{lastServer.Name}
+			}
+		}
 
-		serverExtraArgsSt := ""
-		if len(serverK3sExtraArgs) > 0 {
-			serverExtraArgsSt = fmt.Sprintf(` \
---k3s-extra-args "%s"`, serverK3sExtraArgs)
+		if len(options.K3sVersion) > 0 {
+			step.Flags = append(step.Flags, planFlag{Name: "k3s-version", Value: options.K3sVersion})
+		}
+		if step.Role == "server" && len(options.TLSSAN) > 0 {
+			step.Flags = append(step.Flags, planFlag{Name: "tls-san", Value: options.TLSSAN})
+		}
+		if hostArgs := hostK3sExtraArgs(extraArgs, step.Host); len(hostArgs) > 0 {
+			step.Flags = append(step.Flags, planFlag{Name: "k3s-extra-args", Value: hostArgs})
 		}
-		agentExtraArgsSt := ""
-		if len(agentK3sExtraArgs) > 0 {
-			agentExtraArgsSt = fmt.Sprintf(` \
---k3s-extra-args "%s"`, agentK3sExtraArgs)
+		if i == 0 && options.Merge {
+			step.Flags = append(step.Flags, planFlag{Name: "merge"})
 		}
+	}
 
-		for i, host := range hosts {
-			if serversAdded == 0 {
+	return steps
+}
 
-				script += `echo "Setting up primary server 1"
-`
+// hostK3sExtraArgs adds the host's own K3s arguments, labels, taints and
+// IPs to extraArgs
+func hostK3sExtraArgs(extraArgs string, host Host) string {
+	args := []string{}
+	if len(extraArgs) > 0 {
+		args = append(args, extraArgs)
+	}
+	if len(host.K3sExtraArgs) > 0 {
+		args = append(args, host.K3sExtraArgs)
+	}
 
-				script += fmt.Sprintf(`k3sup install --host %s \
---user %s \
---cluster \
---local-path %s \
---context %s%s%s%s%s
-`,
-					host.IP,
-					user,
-					kubeconfig,
-					contextName,
-					tlsSanStr,
-					serverExtraArgsSt,
-					sshKeySt,
-					mergeStr)
-
-				script += fmt.Sprintf(`
-echo "Fetching the server's node-token into memory"
+	keys := make([]string, 0, len(host.Labels))
+	for key := range host.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		args = append(args, fmt.Sprintf("--node-label %s=%s", key, host.Labels[key]))
+	}
 
-export NODE_TOKEN=$(k3sup node-token --host %s --user %s%s)
-`, host.IP, user, sshKeySt)
-
-				serversAdded = 1
-				primaryServer = host
-			} else if serversAdded < servers {
-				script += fmt.Sprintf("\necho \"Setting up additional server: %d\"\n", serversAdded+1)
-
-				script += fmt.Sprintf(`k3sup join \
---host %s \
---server-host %s \
---server \
---node-token "$NODE_TOKEN" \
---user %s%s%s%s%s
-`, host.IP, primaryServer.IP, user, tlsSanStr, serverExtraArgsSt, sshKeySt, bgStr)
-
-				serversAdded++
-			} else {
-				script += fmt.Sprintf("\necho \"Setting up worker: %d\"\n", (i+1)-serversAdded)
-
-				script += fmt.Sprintf(`k3sup join \
---host %s \
---server-host %s \
---node-token "$NODE_TOKEN" \
---user %s%s%s%s
-`, host.IP, primaryServer.IP, user, agentExtraArgsSt, sshKeySt, bgStr)
-			}
+	for _, taint := range host.Taints {
+		args = append(args, "--node-taint "+taint)
+	}
+	if len(host.NodeIP) > 0 {
+		args = append(args, "--node-ip "+host.NodeIP)
+	}
+	if len(host.ExternalIP) > 0 {
+		args = append(args, "--node-external-ip "+host.ExternalIP)
+	}
 
-			if nodeLimit > 0 && i+1 >= nodeLimit {
-				break
+	return strings.Join(args, " ")
+}
+
+// renderPlanScript gives a shell script which runs each step, with the
+// node token fetched into $NODE_TOKEN after the first server is up
+func renderPlanScript(steps []planStep, background bool) string {
+	script := "#!/bin/sh\n"
+
+	bgStr := ""
+	if background {
+		bgStr = " &"
+	}
+
+	servers := 0
+	for i, step := range steps {
+		lines := []string{"k3sup " + step.Command}
+		for _, flag := range step.Flags {
+			args := []string{}
+			for _, arg := range flag.args() {
+				args = append(args, shellArg(arg))
 			}
+			lines = append(lines, strings.Join(args, " "))
 		}
 
-		fmt.Printf("%s\n", script)
+		if i == 0 {
+			servers++
+			script += "\necho \"Setting up primary server 1\"\n"
+			script += strings.Join(lines, " \\\n") + "\n"
 
-		return nil
+			script += fmt.Sprintf(`
+echo "Fetching the server's node-token into memory"
+
+export NODE_TOKEN=$(%s)
+`, nodeTokenCommand(step))
+			continue
+		}
+
+		lines = append(lines, `--node-token "$NODE_TOKEN"`)
+		if step.Role == "server" {
+			servers++
+			script += fmt.Sprintf("\necho \"Setting up additional server: %d\"\n", servers)
+		} else {
+			script += fmt.Sprintf("\necho \"Setting up worker: %d\"\n", i+1-servers)
+		}
+		script += strings.Join(lines, " \\\n") + bgStr + "\n"
 	}
 
-	return command
+	return script
 }
 
-type Host struct {
-	Hostname string `json:"hostname"`
-	IP       string `json:"ip"`
+func flagValue(flags []planFlag, name string) string {
+	for _, flag := range flags {
+		if flag.Name == name {
+			return flag.Value
+		}
+	}
+	return ""
+}
+
+var safeShellArg = regexp.MustCompile(`^[A-Za-z0-9_./:,=@+%~-]+$`)
+
+// shellArg quotes s for the shell when it contains anything other than
+// plain characters
+func shellArg(s string) string {
+	if safeShellArg.MatchString(s) {
+		return s
+	}
+	return shellQuote(s)
 }
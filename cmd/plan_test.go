@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_makePlanSteps(t *testing.T) {
+	hosts := []Host{
+		{Hostname: "node-1", IP: "10.0.0.1"},
+		{Hostname: "node-2", IP: "10.0.0.2"},
+		{IP: "10.0.0.3"},
+		{Hostname: "node-4", IP: "10.0.0.4"},
+	}
+
+	steps := makePlanSteps(hosts, planOptions{
+		Servers:        2,
+		User:           "ubuntu",
+		SSHKey:         "~/.ssh/k3s",
+		TLSSAN:         "k3s.example.com",
+		AgentExtraArgs: "--node-label tier=web",
+		LocalPath:      "kubeconfig",
+		Context:        "k3s",
+		Sudo:           true,
+	})
+
+	want := []struct {
+		name string
+		role string
+		args string
+	}{
+		{"node-1", "server", "install --host 10.0.0.1 --user ubuntu --ssh-key ~/.ssh/k3s --cluster --local-path kubeconfig --context k3s --tls-san k3s.example.com"},
+		{"node-2", "server", "join --host 10.0.0.2 --user ubuntu --ssh-key ~/.ssh/k3s --server-host 10.0.0.1 --server --tls-san k3s.example.com"},
+		{"10.0.0.3", "agent", "join --host 10.0.0.3 --user ubuntu --ssh-key ~/.ssh/k3s --server-host 10.0.0.1 --k3s-extra-args --node-label tier=web"},
+		{"node-4", "agent", "join --host 10.0.0.4 --user ubuntu --ssh-key ~/.ssh/k3s --server-host 10.0.0.1 --k3s-extra-args --node-label tier=web"},
+	}
+
+	if len(steps) != len(want) {
+		t.Fatalf("want %d steps, got %d", len(want), len(steps))
+	}
+	for i, w := range want {
+		if steps[i].Name != w.name {
+			t.Errorf("step %d: want name %q, got %q", i, w.name, steps[i].Name)
+		}
+		if steps[i].Role != w.role {
+			t.Errorf("step %d: want role %q, got %q", i, w.role, steps[i].Role)
+		}
+		if got := strings.Join(steps[i].Args(), " "); got != w.args {
+			t.Errorf("step %d: want args\n%q\ngot\n%q", i, w.args, got)
+		}
+	}
+}
+
+func Test_makePlanSteps_Limit(t *testing.T) {
+	hosts := []Host{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}, {IP: "10.0.0.3"}}
+
+	steps := makePlanSteps(hosts, planOptions{Servers: 1, Limit: 2, User: "root", Sudo: false})
+
+	if len(steps) != 2 {
+		t.Fatalf("want 2 steps, got %d", len(steps))
+	}
+	if steps[1].Role != "agent" {
+		t.Errorf("want the second host as an agent, got %q", steps[1].Role)
+	}
+	if !strings.Contains(strings.Join(steps[0].Args(), " "), "--sudo=false") {
+		t.Errorf("want --sudo=false, got %q", steps[0].Args())
+	}
+}
+
+func Test_makePlanSteps_PerHost(t *testing.T) {
+	hosts := []Host{
+		{Hostname: "agent-1", IP: "10.0.0.1", Role: "agent"},
+		{Hostname: "server-1", IP: "10.0.0.2", Role: "server", User: "ubuntu", SSHPort: 2222,
+			Taints: []string{"CriticalAddonsOnly=true:NoExecute"}},
+		{Hostname: "node-3", SSHKey: "~/.ssh/edge",
+			Labels:       map[string]string{"zone": "b", "tier": "web"},
+			K3sExtraArgs: "--kubelet-arg max-pods=200",
+			NodeIP:       "192.168.0.3", ExternalIP: "203.0.113.3"},
+	}
+
+	steps := makePlanSteps(hosts, planOptions{
+		Servers:         1,
+		User:            "root",
+		ServerExtraArgs: "--disable traefik",
+		AgentExtraArgs:  "--node-label worker=true",
+		LocalPath:       "kubeconfig",
+		Context:         "default",
+		Sudo:            true,
+	})
+
+	want := []string{
+		"install --host 10.0.0.2 --user ubuntu --ssh-port 2222 --cluster --local-path kubeconfig --context default --k3s-extra-args --disable traefik --node-taint CriticalAddonsOnly=true:NoExecute",
+		"join --host 10.0.0.1 --user root --server-host 10.0.0.2 --k3s-extra-args --node-label worker=true",
+		"join --host node-3 --user root --ssh-key ~/.ssh/edge --server-host 10.0.0.2 --k3s-extra-args --node-label worker=true --kubelet-arg max-pods=200 --node-label tier=web --node-label zone=b --node-ip 192.168.0.3 --node-external-ip 203.0.113.3",
+	}
+
+	if len(steps) != len(want) {
+		t.Fatalf("want %d steps, got %d", len(want), len(steps))
+	}
+	for i, w := range want {
+		if got := strings.Join(steps[i].Args(), " "); got != w {
+			t.Errorf("step %d: want args\n%q\ngot\n%q", i, w, got)
+		}
+	}
+}
+
+func Test_hostRoles(t *testing.T) {
+	hosts := []Host{{IP: "a"}, {IP: "b", Role: "agent"}, {IP: "c", Role: "server"}, {IP: "d"}, {IP: "e"}}
+
+	got := strings.Join(hostRoles(hosts, 3), ",")
+	want := "server,agent,server,server,agent"
+	if got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+}
+
+func Test_renderPlanScript(t *testing.T) {
+	hosts := []Host{
+		{Hostname: "node-1", IP: "10.0.0.1", SSHPort: 2222},
+		{Hostname: "node-2", IP: "10.0.0.2"},
+	}
+
+	steps := makePlanSteps(hosts, planOptions{
+		Servers:        1,
+		User:           "ubuntu",
+		AgentExtraArgs: "--node-label worker=true",
+		LocalPath:      "kubeconfig",
+		Context:        "default",
+		Sudo:           true,
+	})
+
+	got := renderPlanScript(steps, true)
+
+	want := `#!/bin/sh
+
+echo "Setting up primary server 1"
+k3sup install \
+--host 10.0.0.1 \
+--user ubuntu \
+--ssh-port 2222 \
+--cluster \
+--local-path kubeconfig \
+--context default
+
+echo "Fetching the server's node-token into memory"
+
+export NODE_TOKEN=$(k3sup node-token --host 10.0.0.1 --user ubuntu --ssh-port 2222)
+
+echo "Setting up worker: 1"
+k3sup join \
+--host 10.0.0.2 \
+--user ubuntu \
+--server-host 10.0.0.1 \
+--k3s-extra-args '--node-label worker=true' \
+--node-token "$NODE_TOKEN" &
+`
+	if got != want {
+		t.Errorf("want\n%s\ngot\n%s", want, got)
+	}
+}
+
+func Test_planFlag_args(t *testing.T) {
+	tests := []struct {
+		flag planFlag
+		want []string
+	}{
+		{flag: planFlag{Name: "merge"}, want: []string{"--merge"}},
+		{flag: planFlag{Name: "user", Value: "ubuntu"}, want: []string{"--user", "ubuntu"}},
+		{flag: planFlag{Name: "sudo", Value: "false", Bool: true}, want: []string{"--sudo=false"}},
+	}
+
+	for _, tc := range tests {
+		if got := tc.flag.args(); !reflect.DeepEqual(tc.want, got) {
+			t.Errorf("%s: want %q, got %q", tc.flag.Name, tc.want, got)
+		}
+	}
+
+	steps := makePlanSteps([]Host{{IP: "10.0.0.1"}}, planOptions{Servers: 1, User: "root", Sudo: false})
+	if got := flagValue(steps[0].Flags, "sudo"); got != "false" {
+		t.Errorf("want sudo to be false, got %q", got)
+	}
+	if script := renderPlanScript(steps, false); !strings.Contains(script, "--sudo=false \\\n") {
+		t.Errorf("want --sudo=false in the script, got:\n%s", script)
+	}
+}
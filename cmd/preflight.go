@@ -0,0 +1,402 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alexellis/k3sup/pkg"
+	operator "github.com/alexellis/k3sup/pkg/operator"
+	"github.com/spf13/cobra"
+)
+
+const (
+	preflightPass = "pass"
+	preflightWarn = "warn"
+	preflightFail = "fail"
+)
+
+// Memory in MB for the memory check. A board sold with 512MB reports less
+// as its total, once the kernel and firmware have taken their share, so
+// only less than minimumMemoryMB fails.
+const (
+	minimumMemoryMB = 400
+	agentMemoryMB   = 512
+	serverMemoryMB  = 2048
+)
+
+// preflightScript prints facts about a host as key=value lines, it only
+// reads state so does not need sudo
+const preflightScript = `echo "arch=$(uname -m)"
+echo "mem_kb=$(awk '/^MemTotal:/ {print $2}' /proc/meminfo 2>/dev/null)"
+echo "swap_kb=$(awk '/^SwapTotal:/ {print $2}' /proc/meminfo 2>/dev/null)"
+if command -v curl >/dev/null 2>&1; then echo "curl=yes"; else echo "curl=no"; fi
+if command -v k3s >/dev/null 2>&1 || [ -x /usr/local/bin/k3s ]; then echo "k3s=yes"; else echo "k3s=no"; fi
+if command -v rke2 >/dev/null 2>&1 || [ -d /var/lib/rancher/rke2 ]; then echo "rke2=yes"; else echo "rke2=no"; fi
+if [ -f /sys/fs/cgroup/cgroup.controllers ]; then
+  if grep -qw memory /sys/fs/cgroup/cgroup.controllers; then echo "cgroup_memory=yes"; else echo "cgroup_memory=no"; fi
+elif [ -f /proc/cgroups ]; then
+  if awk '$1 == "memory" && $4 == "1" {found=1} END {exit !found}' /proc/cgroups; then echo "cgroup_memory=yes"; else echo "cgroup_memory=no"; fi
+else
+  echo "cgroup_memory=unknown"
+fi
+echo "ntp_synced=$(timedatectl show -p NTPSynchronized --value 2>/dev/null || echo unknown)"
+echo "time=$(date +%s)"
+if command -v ss >/dev/null 2>&1; then
+  echo "listening=$(ss -Hltn 2>/dev/null | awk '{n=split($4,a,":"); print a[n]}' | tr '\n' ',')"
+elif command -v netstat >/dev/null 2>&1; then
+  echo "listening=$(netstat -ltn 2>/dev/null | awk '{n=split($4,a,":"); print a[n]}' | tr '\n' ',')"
+else
+  echo "listening=unknown"
+fi
+`
+
+// preflightFacts are gathered from a host before installing K3s
+type preflightFacts struct {
+	Arch           string
+	MemoryKB       int64
+	SwapKB         int64
+	Curl           bool
+	K3s            bool
+	RKE2           bool
+	CgroupMemory   string
+	NTPSynced      string
+	Time           time.Time
+	ListeningKnown bool
+	Listening      map[int]bool
+}
+
+// preflightCheck is the result of one check, with a status of pass,
+// warn or fail
+type preflightCheck struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// MakePreflight creates the preflight command
+func MakePreflight() *cobra.Command {
+	var command = &cobra.Command{
+		Use:   "preflight",
+		Short: "Check a host is ready for K3s",
+		Long: `Check a host is ready for K3s before installing, by gathering facts
+over SSH such as the architecture, memory, swap, ports in use, cgroups,
+existing installations and the clock.
+
+The same checks are run by install and join, unless --skip-preflight is
+given.
+
+` + pkg.SupportMessageShort + `
+`,
+		Example: `  # Check a host before installing a server
+  k3sup preflight --host HOST --user USER
+
+  # Check a host before joining it as an agent
+  k3sup preflight --host HOST --role agent
+
+  # Print the results as JSON
+  k3sup preflight --host HOST --output json`,
+		SilenceUsage: true,
+	}
+
+	command.Flags().IP("ip", net.ParseIP("127.0.0.1"), "Public IP of node")
+	command.Flags().String("user", "root", "Username for SSH login")
+	command.Flags().String("host", "", "Public hostname of node")
+	command.Flags().String("ssh-key", "~/.ssh/id_rsa", "The ssh key to use for remote login")
+	command.Flags().Int("ssh-port", 22, "The port on which to connect for ssh")
+	command.Flags().Bool("local", false, "Check the local machine without using ssh")
+	command.Flags().String("role", "server", "Role the host will have: server or agent")
+	command.Flags().StringP("output", "o", "table", "Output format: table or json")
+
+	command.PreRunE = func(command *cobra.Command, args []string) error {
+		role, _ := command.Flags().GetString("role")
+		if role != "server" && role != "agent" {
+			return fmt.Errorf("--role must be server or agent, got: %q", role)
+		}
+
+		output, _ := command.Flags().GetString("output")
+		if output != "table" && output != "json" {
+			return fmt.Errorf("--output must be table or json, got: %q", output)
+		}
+
+		return nil
+	}
+
+	command.RunE = func(command *cobra.Command, args []string) error {
+		local, _ := command.Flags().GetBool("local")
+		role, _ := command.Flags().GetString("role")
+		output, _ := command.Flags().GetString("output")
+
+		ip, _ := command.Flags().GetIP("ip")
+		host, _ := command.Flags().GetString("host")
+		if len(host) == 0 {
+			host = ip.String()
+		}
+
+		var op operator.CommandOperator
+		if local {
+			op = operator.ExecOperator{}
+		} else {
+			port, _ := command.Flags().GetInt("ssh-port")
+			user, _ := command.Flags().GetString("user")
+			sshKey, _ := command.Flags().GetString("ssh-key")
+
+			address := fmt.Sprintf("%s:%d", host, port)
+			sshOperator, sshOperatorDone, errored, err := connectOperator(user, address, expandPath(sshKey))
+			if errored {
+				return err
+			}
+			if sshOperatorDone != nil {
+				defer sshOperatorDone()
+			}
+			op = sshOperator
+		}
+
+		checks, err := runPreflight(op, role)
+		if err != nil {
+			return err
+		}
+
+		if output == "json" {
+			result := struct {
+				Host   string           `json:"host"`
+				Role   string           `json:"role"`
+				Passed bool             `json:"passed"`
+				Checks []preflightCheck `json:"checks"`
+			}{
+				Host:   host,
+				Role:   role,
+				Passed: !preflightFailed(checks),
+				Checks: checks,
+			}
+
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(result); err != nil {
+				return err
+			}
+		} else {
+			printPreflight(os.Stdout, host, checks)
+		}
+
+		if preflightFailed(checks) {
+			return fmt.Errorf("preflight checks failed for %s", host)
+		}
+
+		return nil
+	}
+
+	return command
+}
+
+// runPreflight gathers facts about a host with op, and checks whether it
+// can run K3s with the given role
+func runPreflight(op operator.CommandOperator, role string) ([]preflightCheck, error) {
+	res, err := op.ExecuteStdio(preflightScript, false)
+	if err != nil {
+		return nil, fmt.Errorf("unable to gather preflight facts: %w", err)
+	}
+
+	facts := parsePreflightFacts(string(res.StdOut))
+
+	return evaluatePreflight(facts, role, time.Now()), nil
+}
+
+// preflight runs the checks for install and join, and prints them. An
+// error is returned if any check failed.
+func preflight(out io.Writer, op operator.CommandOperator, host, role string) error {
+	fmt.Fprintf(out, "Running preflight checks on %s\n", host)
+
+	checks, err := runPreflight(op, role)
+	if err != nil {
+		return err
+	}
+
+	printPreflight(out, host, checks)
+
+	if preflightFailed(checks) {
+		return fmt.Errorf("preflight checks failed for %s, fix the issues above or use --skip-preflight", host)
+	}
+
+	return nil
+}
+
+func parsePreflightFacts(out string) preflightFacts {
+	facts := preflightFacts{
+		Listening: map[int]bool{},
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "arch":
+			facts.Arch = value
+		case "mem_kb":
+			facts.MemoryKB, _ = strconv.ParseInt(value, 10, 64)
+		case "swap_kb":
+			facts.SwapKB, _ = strconv.ParseInt(value, 10, 64)
+		case "curl":
+			facts.Curl = value == "yes"
+		case "k3s":
+			facts.K3s = value == "yes"
+		case "rke2":
+			facts.RKE2 = value == "yes"
+		case "cgroup_memory":
+			facts.CgroupMemory = value
+		case "ntp_synced":
+			facts.NTPSynced = value
+		case "time":
+			if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+				facts.Time = time.Unix(seconds, 0)
+			}
+		case "listening":
+			if value == "unknown" {
+				continue
+			}
+			facts.ListeningKnown = true
+			for _, p := range strings.Split(value, ",") {
+				if port, err := strconv.Atoi(strings.TrimSpace(p)); err == nil {
+					facts.Listening[port] = true
+				}
+			}
+		}
+	}
+
+	return facts
+}
+
+// preflightPorts gives the TCP ports which K3s listens on for a role
+func preflightPorts(role string) []int {
+	if role == "server" {
+		return []int{6443, 10250, 2379, 2380}
+	}
+	return []int{10250}
+}
+
+func evaluatePreflight(facts preflightFacts, role string, now time.Time) []preflightCheck {
+	checks := []preflightCheck{}
+
+	switch facts.Arch {
+	case "x86_64", "amd64", "aarch64", "arm64", "armv7l", "s390x":
+		checks = append(checks, preflightCheck{"architecture", preflightPass, facts.Arch})
+	case "":
+		checks = append(checks, preflightCheck{"architecture", preflightWarn, "unable to detect the architecture"})
+	default:
+		checks = append(checks, preflightCheck{"architecture", preflightFail, fmt.Sprintf("%s is not supported by K3s", facts.Arch)})
+	}
+
+	memoryMB := facts.MemoryKB / 1024
+	recommendedMB := int64(agentMemoryMB)
+	if role == "server" {
+		recommendedMB = serverMemoryMB
+	}
+	switch {
+	case facts.MemoryKB == 0:
+		checks = append(checks, preflightCheck{"memory", preflightWarn, "unable to read the total memory"})
+	case memoryMB < minimumMemoryMB:
+		checks = append(checks, preflightCheck{"memory", preflightFail, fmt.Sprintf("%dMB, at least %dMB is required", memoryMB, minimumMemoryMB)})
+	case memoryMB < recommendedMB:
+		checks = append(checks, preflightCheck{"memory", preflightWarn, fmt.Sprintf("%dMB, %dMB is recommended for a %s", memoryMB, recommendedMB, role)})
+	default:
+		checks = append(checks, preflightCheck{"memory", preflightPass, fmt.Sprintf("%dMB", memoryMB)})
+	}
+
+	if facts.SwapKB > 0 {
+		checks = append(checks, preflightCheck{"swap", preflightWarn, fmt.Sprintf("%dMB of swap is enabled", facts.SwapKB/1024)})
+	} else {
+		checks = append(checks, preflightCheck{"swap", preflightPass, "disabled"})
+	}
+
+	if facts.ListeningKnown {
+		inUse := []string{}
+		for _, port := range preflightPorts(role) {
+			if facts.Listening[port] {
+				inUse = append(inUse, strconv.Itoa(port))
+			}
+		}
+
+		switch {
+		case len(inUse) == 0:
+			checks = append(checks, preflightCheck{"ports", preflightPass, "free"})
+		case facts.K3s:
+			checks = append(checks, preflightCheck{"ports", preflightWarn, fmt.Sprintf("%s in use by the existing K3s installation", strings.Join(inUse, ", "))})
+		default:
+			checks = append(checks, preflightCheck{"ports", preflightFail, fmt.Sprintf("%s already in use", strings.Join(inUse, ", "))})
+		}
+	} else {
+		checks = append(checks, preflightCheck{"ports", preflightWarn, "unable to list ports in use, neither ss nor netstat was found"})
+	}
+
+	switch facts.CgroupMemory {
+	case "yes":
+		checks = append(checks, preflightCheck{"cgroups", preflightPass, "memory cgroup enabled"})
+	case "no":
+		checks = append(checks, preflightCheck{"cgroups", preflightFail, "memory cgroup is not enabled, on a Raspberry Pi add \"cgroup_memory=1 cgroup_enable=memory\" to /boot/cmdline.txt and reboot"})
+	default:
+		checks = append(checks, preflightCheck{"cgroups", preflightWarn, "unable to detect the memory cgroup"})
+	}
+
+	switch {
+	case facts.RKE2:
+		checks = append(checks, preflightCheck{"existing install", preflightFail, "RKE2 is installed, uninstall it first"})
+	case facts.K3s:
+		checks = append(checks, preflightCheck{"existing install", preflightWarn, "K3s is already installed and will be reconfigured"})
+	default:
+		checks = append(checks, preflightCheck{"existing install", preflightPass, "none"})
+	}
+
+	if facts.Curl {
+		checks = append(checks, preflightCheck{"curl", preflightPass, "installed"})
+	} else {
+		checks = append(checks, preflightCheck{"curl", preflightFail, "curl is required to download the K3s installer"})
+	}
+
+	switch {
+	case facts.Time.IsZero():
+		checks = append(checks, preflightCheck{"clock", preflightWarn, "unable to read the time"})
+	case absDuration(now.Sub(facts.Time)) > time.Second*30:
+		checks = append(checks, preflightCheck{"clock", preflightWarn, fmt.Sprintf("differs from this machine by %s", absDuration(now.Sub(facts.Time)).Round(time.Second))})
+	case facts.NTPSynced == "no":
+		checks = append(checks, preflightCheck{"clock", preflightWarn, "NTP is not synchronised"})
+	default:
+		checks = append(checks, preflightCheck{"clock", preflightPass, "in sync"})
+	}
+
+	return checks
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+func preflightFailed(checks []preflightCheck) bool {
+	for _, check := range checks {
+		if check.Status == preflightFail {
+			return true
+		}
+	}
+	return false
+}
+
+func printPreflight(w io.Writer, host string, checks []preflightCheck) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "HOST\tCHECK\tSTATUS\tMESSAGE\n")
+	for _, check := range checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", host, check.Name, strings.ToUpper(check.Status), check.Message)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+const preflightOutputPi = `arch=armv7l
+mem_kb=948000
+swap_kb=102396
+curl=yes
+k3s=no
+rke2=no
+cgroup_memory=no
+ntp_synced=yes
+time=1700000000
+listening=22,6443,
+`
+
+func Test_parsePreflightFacts(t *testing.T) {
+	facts := parsePreflightFacts(preflightOutputPi)
+
+	if facts.Arch != "armv7l" {
+		t.Errorf("want arch: armv7l, got: %s", facts.Arch)
+	}
+	if facts.MemoryKB != 948000 || facts.SwapKB != 102396 {
+		t.Errorf("unexpected memory or swap: %d, %d", facts.MemoryKB, facts.SwapKB)
+	}
+	if !facts.Curl || facts.K3s || facts.RKE2 {
+		t.Errorf("unexpected curl, k3s or rke2: %v, %v, %v", facts.Curl, facts.K3s, facts.RKE2)
+	}
+	if !facts.ListeningKnown || !facts.Listening[6443] || !facts.Listening[22] || facts.Listening[10250] {
+		t.Errorf("unexpected listening ports: %v", facts.Listening)
+	}
+	if facts.Time.Unix() != 1700000000 {
+		t.Errorf("unexpected time: %v", facts.Time)
+	}
+}
+
+func Test_evaluatePreflight_Pi(t *testing.T) {
+	facts := parsePreflightFacts(preflightOutputPi)
+	checks := evaluatePreflight(facts, "server", time.Unix(1700000100, 0))
+
+	want := map[string]string{
+		"architecture":     preflightPass,
+		"memory":           preflightWarn,
+		"swap":             preflightWarn,
+		"ports":            preflightFail,
+		"cgroups":          preflightFail,
+		"existing install": preflightPass,
+		"curl":             preflightPass,
+		"clock":            preflightWarn,
+	}
+
+	for _, check := range checks {
+		if want[check.Name] != check.Status {
+			t.Errorf("check %q want: %s, got: %s (%s)", check.Name, want[check.Name], check.Status, check.Message)
+		}
+	}
+
+	if !preflightFailed(checks) {
+		t.Errorf("want preflight to fail")
+	}
+}
+
+func Test_evaluatePreflight_ExistingK3sAgent(t *testing.T) {
+	facts := parsePreflightFacts(`arch=x86_64
+mem_kb=4000000
+swap_kb=0
+curl=yes
+k3s=yes
+rke2=no
+cgroup_memory=yes
+ntp_synced=yes
+time=1700000000
+listening=10250,
+`)
+
+	checks := evaluatePreflight(facts, "agent", time.Unix(1700000000, 0))
+
+	for _, check := range checks {
+		if check.Status == preflightFail {
+			t.Errorf("check %q failed: %s", check.Name, check.Message)
+		}
+		if check.Name == "ports" && check.Status != preflightWarn {
+			t.Errorf("want ports in use by K3s to warn, got: %s", check.Status)
+		}
+	}
+}
+
+func Test_evaluatePreflight_RKE2(t *testing.T) {
+	facts := parsePreflightFacts("arch=x86_64\nrke2=yes\ncurl=no\n")
+	checks := evaluatePreflight(facts, "agent", time.Now())
+
+	failed := map[string]bool{}
+	for _, check := range checks {
+		if check.Status == preflightFail {
+			failed[check.Name] = true
+		}
+	}
+
+	if !failed["existing install"] || !failed["curl"] {
+		t.Errorf("want existing install and curl to fail, got: %v", failed)
+	}
+}
+
+func Test_evaluatePreflight_Memory(t *testing.T) {
+	cases := []struct {
+		memoryKB int64
+		role     string
+		want     string
+	}{
+		// A board sold with 512MB
+		{memoryKB: 443000, role: "agent", want: preflightWarn},
+		{memoryKB: 300000, role: "agent", want: preflightFail},
+		{memoryKB: 1024000, role: "agent", want: preflightPass},
+		{memoryKB: 1024000, role: "server", want: preflightWarn},
+	}
+
+	for _, c := range cases {
+		for _, check := range evaluatePreflight(preflightFacts{MemoryKB: c.memoryKB}, c.role, time.Now()) {
+			if check.Name == "memory" && check.Status != c.want {
+				t.Errorf("%dKB for a %s, want: %s, got: %s (%s)", c.memoryKB, c.role, c.want, check.Status, check.Message)
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+	"github.com/spf13/cobra"
+)
+
+// executeCommand runs command with op without streaming its output. An
+// error is returned when the command cannot be run, or exits non-zero.
+func executeCommand(op operator.CommandOperator, command string, printCommand bool) (operator.CommandRes, error) {
+	return executeCommandTo(os.Stdout, op, command, printCommand)
+}
+
+// executeCommandTo is executeCommand, printing the command to out
+func executeCommandTo(out io.Writer, op operator.CommandOperator, command string, printCommand bool) (operator.CommandRes, error) {
+	if printCommand {
+		fmt.Fprintf(out, "ssh: %s\n", command)
+	}
+
+	res, err := op.ExecuteStdio(command, false)
+	if err != nil {
+		return res, err
+	}
+
+	if res.ExitCode != 0 {
+		stderr := strings.TrimSpace(string(res.StdErr))
+		if len(stderr) == 0 {
+			stderr = strings.TrimSpace(string(res.StdOut))
+		}
+		return res, fmt.Errorf("exit code %d: %s", res.ExitCode, stderr)
+	}
+
+	return res, nil
+}
+
+// writeFileCommand gives a shell command which writes data to filePath
+// with the given mode, creating its directory if needed. The mode is set
+// before anything is written, so that secrets are never readable by
+// other users.
+func writeFileCommand(sudoPrefix, filePath string, data []byte, mode string) string {
+	return fmt.Sprintf("%smkdir -p %s && %sinstall -m %s /dev/null %s && cat <<'K3SUP_EOF' | %stee %s > /dev/null\n%sK3SUP_EOF\n",
+		sudoPrefix, path.Dir(filePath),
+		sudoPrefix, mode, filePath,
+		sudoPrefix, filePath,
+		ensureTrailingNewline(string(data)))
+}
+
+// shellQuote quotes s as a single argument for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func ensureTrailingNewline(s string) string {
+	if len(s) > 0 && !strings.HasSuffix(s, "\n") {
+		return s + "\n"
+	}
+	return s
+}
+
+// addServerFlags adds the flags to connect to a single server over SSH
+func addServerFlags(command *cobra.Command) {
+	command.Flags().IP("ip", net.ParseIP("127.0.0.1"), "Public IP of a server")
+	command.Flags().String("host", "", "Public hostname of a server")
+	addSSHFlags(command)
+	command.Flags().String("server-data-dir", "/var/lib/rancher/k3s/", "Data directory of K3s on the server")
+}
+
+// addSSHFlags adds the flags to connect over SSH, for commands which
+// give their servers with flags of their own
+func addSSHFlags(command *cobra.Command) {
+	command.Flags().String("user", "root", "Username for SSH login")
+	command.Flags().String("ssh-key", "~/.ssh/id_rsa", "The ssh key to use for remote login")
+	command.Flags().Int("ssh-port", 22, "The port on which to connect for ssh")
+	command.Flags().Bool("sudo", true, "Use sudo for commands. e.g. set to false when using the root user and no sudo is available.")
+	command.Flags().Bool("print-command", false, "Print the commands to be executed")
+}
+
+// serverOptions gives the sudo prefix and whether to print commands
+func serverOptions(command *cobra.Command) (string, bool) {
+	useSudo, _ := command.Flags().GetBool("sudo")
+	printCommand, _ := command.Flags().GetBool("print-command")
+
+	sudoPrefix := ""
+	if useSudo {
+		sudoPrefix = "sudo "
+	}
+	return sudoPrefix, printCommand
+}
+
+// connectServer connects to the server given by addServerFlags
+func connectServer(command *cobra.Command) (operator.CommandOperator, func(), error) {
+	ip, _ := command.Flags().GetIP("ip")
+	host, _ := command.Flags().GetString("host")
+	if len(host) == 0 {
+		host = ip.String()
+	}
+	return connectServerHost(command, host)
+}
+
+// connectServerHost connects to host with the flags given by addSSHFlags
+func connectServerHost(command *cobra.Command, host string) (operator.CommandOperator, func(), error) {
+	user, _ := command.Flags().GetString("user")
+	sshKey, _ := command.Flags().GetString("ssh-key")
+	port, _ := command.Flags().GetInt("ssh-port")
+
+	address := fmt.Sprintf("%s:%d", host, port)
+	sshOperator, sshOperatorDone, errored, err := connectOperator(user, address, expandPath(sshKey))
+	if errored {
+		return nil, nil, err
+	}
+
+	done := func() {
+		if sshOperatorDone != nil {
+			sshOperatorDone()
+		}
+	}
+	return sshOperator, done, nil
+}
+
+// connectHost connects to host over SSH, using the user, port and key
+// given for the host in the devices file, or else the defaults
+func connectHost(host Host, user string, port int, sshKey string) (*operator.SSHOperator, DoneFunc, error) {
+	if len(host.User) > 0 {
+		user = host.User
+	}
+	if host.SSHPort > 0 {
+		port = host.SSHPort
+	}
+	if len(host.SSHKey) > 0 {
+		sshKey = host.SSHKey
+	}
+
+	address := fmt.Sprintf("%s:%d", host.Address(), port)
+	sshOperator, sshOperatorDone, errored, err := connectOperator(user, address, expandPath(sshKey))
+	if errored {
+		return nil, nil, fmt.Errorf("%s: %w", address, err)
+	}
+	if sshOperatorDone == nil {
+		sshOperatorDone = func() {}
+	}
+	return sshOperator, sshOperatorDone, nil
+}
@@ -0,0 +1,202 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+)
+
+// scopedRoles maps the values accepted by --role to the built-in
+// Kubernetes ClusterRoles which are bound for the user
+var scopedRoles = map[string]string{
+	"view":  "view",
+	"edit":  "edit",
+	"admin": "admin",
+}
+
+// scopedUserNamespace holds the ServiceAccount for a user when no
+// --namespace is given and access is granted cluster-wide
+const scopedUserNamespace = "default"
+
+var dns1123Label = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+func validateScopedUser(userName, role, namespace string) error {
+	if len(userName) > 63 || !dns1123Label.MatchString(userName) {
+		return fmt.Errorf("--user-name must be a lower-case DNS label such as \"alice\", got: %q", userName)
+	}
+
+	if _, ok := scopedRoles[role]; !ok {
+		return fmt.Errorf("--role must be one of view, edit or admin, got: %q", role)
+	}
+
+	if len(namespace) > 0 && (len(namespace) > 63 || !dns1123Label.MatchString(namespace)) {
+		return fmt.Errorf("--namespace must be a valid namespace name, got: %q", namespace)
+	}
+
+	return nil
+}
+
+func scopedBindingName(userName string) string {
+	return "k3sup-" + userName
+}
+
+// makeScopedUserManifest gives a ServiceAccount for userName, bound to
+// role within namespace using a RoleBinding, or across the cluster with
+// a ClusterRoleBinding when namespace is empty
+func makeScopedUserManifest(userName, role, namespace string) string {
+	saNamespace := namespace
+	if len(saNamespace) == 0 {
+		saNamespace = scopedUserNamespace
+	}
+
+	labels := fmt.Sprintf(`  labels:
+    app.kubernetes.io/managed-by: k3sup
+    k3sup.dev/user: %s
+`, userName)
+
+	manifest := fmt.Sprintf(`apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: %s
+  namespace: %s
+%s---
+`, userName, saNamespace, labels)
+
+	if len(namespace) > 0 {
+		manifest += fmt.Sprintf(`apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: %s
+  namespace: %s
+%s`, scopedBindingName(userName), namespace, labels)
+	} else {
+		manifest += fmt.Sprintf(`apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: %s
+%s`, scopedBindingName(userName), labels)
+	}
+
+	manifest += fmt.Sprintf(`roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: %s
+subjects:
+- kind: ServiceAccount
+  name: %s
+  namespace: %s
+`, scopedRoles[role], userName, saNamespace)
+
+	return manifest
+}
+
+// createScopedUser applies the ServiceAccount and binding for userName
+// on the server, then creates a token for it which expires after ttl
+func createScopedUser(op operator.CommandOperator, sudoPrefix, userName, role, namespace string, ttl time.Duration, printCommand bool) (string, error) {
+	saNamespace := namespace
+	if len(saNamespace) == 0 {
+		saNamespace = scopedUserNamespace
+	}
+
+	// Checked first, so that nothing is created when the RoleBinding
+	// would fail
+	if len(namespace) > 0 {
+		namespaceCommand := fmt.Sprintf("%sk3s kubectl get namespace %s -o name\n", sudoPrefix, namespace)
+		if _, err := executeCommand(op, namespaceCommand, printCommand); err != nil {
+			return "", fmt.Errorf("namespace %s was not found, create it first: %w", namespace, err)
+		}
+	}
+
+	if _, err := executeCommand(op, makeScopedUserApplyCommand(sudoPrefix, userName, role, namespace), printCommand); err != nil {
+		return "", fmt.Errorf("unable to create user %s: %w", userName, err)
+	}
+
+	tokenCommand := fmt.Sprintf("%sk3s kubectl create token %s --namespace %s --duration %s\n",
+		sudoPrefix, userName, saNamespace, ttl)
+
+	res, err := executeCommand(op, tokenCommand, printCommand)
+	if err != nil {
+		return "", fmt.Errorf("unable to create a token for user %s: %w", userName, err)
+	}
+
+	token := strings.TrimSpace(string(res.StdOut))
+	if len(token) == 0 {
+		return "", fmt.Errorf("no token returned for user %s", userName)
+	}
+
+	return token, nil
+}
+
+// makeScopedUserApplyCommand writes the manifest for userName to a
+// temporary file readable only by the SSH user, then applies it
+func makeScopedUserApplyCommand(sudoPrefix, userName, role, namespace string) string {
+	manifestPath := "$tmp/" + userName + ".yaml"
+	return "set -e\ntmp=$(mktemp -d)\ntrap 'rm -rf \"$tmp\"' EXIT\n" +
+		writeFileCommand("", manifestPath, []byte(makeScopedUserManifest(userName, role, namespace)), "0600") +
+		fmt.Sprintf("%sk3s kubectl apply -f %s\n", sudoPrefix, manifestPath)
+}
+
+// scopedUserContext gives the name of the context for userName, so that
+// merging it does not replace the admin's context
+func scopedUserContext(userName, context string) string {
+	return userName + "@" + context
+}
+
+// revokeScopedUser deletes the ServiceAccount and binding for userName,
+// which also invalidates any tokens issued for it. An error is returned
+// when neither was found, i.e. when the user was created in a namespace
+// which was not given.
+func revokeScopedUser(op operator.CommandOperator, sudoPrefix, userName, namespace string, printCommand bool) error {
+	saNamespace := namespace
+	if len(saNamespace) == 0 {
+		saNamespace = scopedUserNamespace
+	}
+
+	binding := fmt.Sprintf("clusterrolebinding %s", scopedBindingName(userName))
+	if len(namespace) > 0 {
+		binding = fmt.Sprintf("rolebinding %s --namespace %s", scopedBindingName(userName), namespace)
+	}
+
+	revokeCommand := fmt.Sprintf("%sk3s kubectl delete %s --ignore-not-found && %sk3s kubectl delete serviceaccount %s --namespace %s --ignore-not-found\n",
+		sudoPrefix, binding, sudoPrefix, userName, saNamespace)
+
+	res, err := executeCommand(op, revokeCommand, printCommand)
+	if err != nil {
+		return fmt.Errorf("unable to revoke user %s: %w", userName, err)
+	}
+
+	if !strings.Contains(string(res.StdOut), " deleted") {
+		if len(namespace) == 0 {
+			return fmt.Errorf("no ServiceAccount or ClusterRoleBinding found for user %s, give --namespace if its access was limited to a namespace", userName)
+		}
+		return fmt.Errorf("no ServiceAccount or RoleBinding found for user %s in namespace %s", userName, namespace)
+	}
+
+	return nil
+}
+
+// scopeKubeconfig replaces the cluster-admin credentials in a kubeconfig
+// with token, and sets the default namespace of each context
+func scopeKubeconfig(kubeconfig []byte, token, namespace string) ([]byte, error) {
+	config, err := parseKubeconfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range config.Users {
+		config.Users[i].User = map[string]interface{}{
+			"token": token,
+		}
+	}
+
+	if len(namespace) > 0 {
+		for i := range config.Contexts {
+			config.Contexts[i].Context.Namespace = namespace
+		}
+	}
+
+	return marshalKubeconfig(config)
+}
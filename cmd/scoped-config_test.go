@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+)
+
+func Test_makeScopedUserManifest_Namespace(t *testing.T) {
+	got := makeScopedUserManifest("alice", "edit", "dev")
+
+	for _, want := range []string{
+		"kind: ServiceAccount\nmetadata:\n  name: alice\n  namespace: dev\n",
+		"kind: RoleBinding\nmetadata:\n  name: k3sup-alice\n  namespace: dev\n",
+		"  kind: ClusterRole\n  name: edit\n",
+		"- kind: ServiceAccount\n  name: alice\n  namespace: dev\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("want manifest to contain:\n%s\ngot:\n%s", want, got)
+		}
+	}
+
+	if strings.Contains(got, "ClusterRoleBinding") {
+		t.Errorf("want a RoleBinding only, got:\n%s", got)
+	}
+}
+
+func Test_makeScopedUserManifest_ClusterWide(t *testing.T) {
+	got := makeScopedUserManifest("bob", "view", "")
+
+	for _, want := range []string{
+		"kind: ServiceAccount\nmetadata:\n  name: bob\n  namespace: default\n",
+		"kind: ClusterRoleBinding\nmetadata:\n  name: k3sup-bob\n",
+		"  kind: ClusterRole\n  name: view\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("want manifest to contain:\n%s\ngot:\n%s", want, got)
+		}
+	}
+}
+
+func Test_validateScopedUser(t *testing.T) {
+	tests := []struct {
+		userName  string
+		role      string
+		namespace string
+		wantErr   bool
+	}{
+		{"alice", "view", "", false},
+		{"alice", "admin", "dev", false},
+		{"Alice", "view", "", true},
+		{"alice", "cluster-admin", "", true},
+		{"alice", "view", "Dev_1", true},
+	}
+
+	for _, tc := range tests {
+		err := validateScopedUser(tc.userName, tc.role, tc.namespace)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("validateScopedUser(%q, %q, %q) want error: %v, got: %v",
+				tc.userName, tc.role, tc.namespace, tc.wantErr, err)
+		}
+	}
+}
+
+func Test_scopeKubeconfig(t *testing.T) {
+	rewritten, err := rewriteKubeconfig(kubeconfigExample, "192.168.0.25", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := scopeKubeconfig(rewritten, "token-value", "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := parseKubeconfig(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Users) != 1 || config.Users[0].User["token"] != "token-value" {
+		t.Fatalf("want the user to only have the token, got: %+v", config.Users)
+	}
+	if _, ok := config.Users[0].User["password"]; ok {
+		t.Errorf("want admin credentials to be removed, got: %+v", config.Users[0].User)
+	}
+	if config.Contexts[0].Context.Namespace != "dev" {
+		t.Errorf("want namespace: %q, got: %q", "dev", config.Contexts[0].Context.Namespace)
+	}
+	if config.Clusters[0].Cluster.Extra["certificate-authority-data"] != "DATA+OMITTED" {
+		t.Errorf("want the cluster CA to be kept, got: %+v", config.Clusters[0].Cluster)
+	}
+}
+
+func Test_makeScopedUserApplyCommand(t *testing.T) {
+	got := makeScopedUserApplyCommand("sudo ", "alice", "view", "dev")
+
+	for _, want := range []string{
+		"set -e\ntmp=$(mktemp -d)\n",
+		"install -m 0600 /dev/null $tmp/alice.yaml && cat <<'K3SUP_EOF' | tee $tmp/alice.yaml > /dev/null\n",
+		"kind: RoleBinding\n",
+		"K3SUP_EOF\nsudo k3s kubectl apply -f $tmp/alice.yaml\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("want command to contain:\n%s\ngot:\n%s", want, got)
+		}
+	}
+}
+
+func Test_scopedUserContext(t *testing.T) {
+	if got := scopedUserContext("alice", "default"); got != "alice@default" {
+		t.Fatalf("want alice@default, got %s", got)
+	}
+}
+
+// testOperator returns res, or the result of respond when it is set, for
+// every command, and records the commands
+type testOperator struct {
+	res      operator.CommandRes
+	respond  func(command string) operator.CommandRes
+	commands []string
+}
+
+func (o *testOperator) Execute(command string) (operator.CommandRes, error) {
+	return o.ExecuteStdio(command, false)
+}
+
+func (o *testOperator) ExecuteStdio(command string, stream bool) (operator.CommandRes, error) {
+	o.commands = append(o.commands, command)
+	if o.respond != nil {
+		return o.respond(command), nil
+	}
+	return o.res, nil
+}
+
+func Test_revokeScopedUser(t *testing.T) {
+	op := &testOperator{res: operator.CommandRes{StdOut: []byte("rolebinding.rbac.authorization.k8s.io \"k3sup-alice\" deleted\nserviceaccount \"alice\" deleted\n")}}
+	if err := revokeScopedUser(op, "sudo ", "alice", "dev", false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(op.commands[0], "rolebinding k3sup-alice --namespace dev") {
+		t.Errorf("want the RoleBinding deleted, got %q", op.commands[0])
+	}
+
+	// Nothing found, i.e. the user was created in a namespace
+	op = &testOperator{}
+	err := revokeScopedUser(op, "sudo ", "alice", "", false)
+	if err == nil || !strings.Contains(err.Error(), "--namespace") {
+		t.Fatalf("want an error suggesting --namespace, got %v", err)
+	}
+}
+
+func Test_makeRevokeCommand(t *testing.T) {
+	command := MakeGetConfig()
+	if err := command.ParseFlags([]string{"--cluster", "prod", "--user", "ubuntu", "--user-name", "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := makeRevokeCommand(command, "alice", "dev")
+	want := "k3sup get-config \\\n  --cluster=prod \\\n  --user=ubuntu \\\n  --user-name alice \\\n  --namespace dev \\\n  --revoke"
+	if got != want {
+		t.Errorf("want\n%s\ngot\n%s", want, got)
+	}
+}
@@ -0,0 +1,311 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// terraformIPAttributes are tried in order for the IP of a host, when
+// --terraform-ip-attribute is not given, covering the common providers
+var terraformIPAttributes = []string{
+	"public_ip",
+	"ipv4_address",
+	"access_ip_v4",
+	"ip_address",
+	"ip",
+	"private_ip",
+	"network_interface.0.access_config.0.nat_ip",
+	"network_interface.0.network_ip",
+	"default_ip_address",
+}
+
+// terraformHostnameAttributes are tried in order for the hostname of a
+// host, when --terraform-hostname-attribute is not given
+var terraformHostnameAttributes = []string{
+	"tags.Name",
+	"hostname",
+	"name",
+}
+
+// terraformMapping selects which resources or outputs of Terraform are
+// servers and agents, and which of their attributes to use
+type terraformMapping struct {
+	Servers           []string
+	Agents            []string
+	IPAttribute       string
+	HostnameAttribute string
+}
+
+type terraformState struct {
+	Version   int                        `json:"version"`
+	Outputs   map[string]terraformOutput `json:"outputs"`
+	Resources []terraformResource        `json:"resources"`
+}
+
+type terraformOutput struct {
+	Value interface{} `json:"value"`
+}
+
+type terraformResource struct {
+	Module    string              `json:"module"`
+	Mode      string              `json:"mode"`
+	Type      string              `json:"type"`
+	Name      string              `json:"name"`
+	Instances []terraformInstance `json:"instances"`
+}
+
+type terraformInstance struct {
+	IndexKey   interface{}            `json:"index_key"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+func addTerraformFlags(command *cobra.Command) {
+	command.Flags().String("from-terraform", "", "Read the hosts from a terraform.tfstate file, or the output of terraform output -json, instead of a devices file")
+	command.Flags().StringSlice("terraform-server", []string{}, "Resource type, resource address or output name whose hosts are servers, repeat the flag or give a comma-separated list")
+	command.Flags().StringSlice("terraform-agent", []string{}, "Resource type, resource address or output name whose hosts are agents, repeat the flag or give a comma-separated list")
+	command.Flags().String("terraform-ip-attribute", "", "Attribute with the IP of each host, i.e. private_ip or network_interface.0.network_ip, common attributes are tried when not given")
+	command.Flags().String("terraform-hostname-attribute", "", "Attribute with the hostname of each host, i.e. tags.Name, common attributes are tried when not given")
+}
+
+// readPlanHosts reads the hosts from the devices file given in args, or
+// from Terraform with --from-terraform
+func readPlanHosts(command *cobra.Command, args []string) ([]Host, error) {
+	tfPath, _ := command.Flags().GetString("from-terraform")
+	if len(tfPath) == 0 {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("give a path to a devices file, in JSON, YAML, CSV or Ansible inventory format, or use --from-terraform")
+		}
+		return readHosts(args[0])
+	}
+
+	if len(args) > 0 {
+		return nil, fmt.Errorf("give either a devices file or --from-terraform, not both")
+	}
+
+	mapping := terraformMapping{}
+	mapping.Servers, _ = command.Flags().GetStringSlice("terraform-server")
+	mapping.Agents, _ = command.Flags().GetStringSlice("terraform-agent")
+	mapping.IPAttribute, _ = command.Flags().GetString("terraform-ip-attribute")
+	mapping.HostnameAttribute, _ = command.Flags().GetString("terraform-hostname-attribute")
+	if len(mapping.Servers) == 0 {
+		return nil, fmt.Errorf("give the resources or outputs of the servers with --terraform-server")
+	}
+
+	return readTerraformHosts(tfPath, mapping)
+}
+
+// readTerraformHosts reads the hosts from a Terraform state file, or from
+// the output of terraform output -json. Servers come first, in the order
+// of the mapping.
+func readTerraformHosts(name string, mapping terraformMapping) ([]Host, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	state := terraformState{}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", name, err)
+	}
+	if _, ok := raw["resources"]; ok {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, fmt.Errorf("unable to read %s: %w", name, err)
+		}
+	} else if err := json.Unmarshal(data, &state.Outputs); err != nil {
+		return nil, fmt.Errorf("unable to read the outputs in %s: %w", name, err)
+	}
+
+	hosts := []Host{}
+	for _, selection := range []struct {
+		role      string
+		selectors []string
+	}{{"server", mapping.Servers}, {"agent", mapping.Agents}} {
+		for _, selector := range selection.selectors {
+			selected, err := state.hosts(selector, mapping)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			for _, host := range selected {
+				host.Role = selection.role
+				hosts = append(hosts, host)
+			}
+		}
+	}
+
+	if err := validateHosts(hosts); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return hosts, nil
+}
+
+// hosts gives the hosts of the resources or output matching selector
+func (s terraformState) hosts(selector string, mapping terraformMapping) ([]Host, error) {
+	outputName := strings.TrimPrefix(selector, "output.")
+	if output, ok := s.Outputs[outputName]; ok {
+		return terraformOutputHosts(outputName, output.Value, mapping)
+	}
+
+	hosts := []Host{}
+	found := false
+	for _, resource := range s.Resources {
+		if resource.Mode != "managed" || !resource.matches(selector) {
+			continue
+		}
+		found = true
+
+		for _, instance := range resource.Instances {
+			address := resource.address()
+			hostname := resource.Name
+			if instance.IndexKey != nil {
+				address += fmt.Sprintf("[%v]", instance.IndexKey)
+				hostname += fmt.Sprintf("-%v", instance.IndexKey)
+			}
+
+			host, err := terraformHost(address, instance.Attributes, mapping)
+			if err != nil {
+				return nil, err
+			}
+			if len(host.Hostname) == 0 {
+				host.Hostname = hostname
+			}
+			hosts = append(hosts, host)
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("no resource or output found for %q", selector)
+	}
+
+	return hosts, nil
+}
+
+func (r terraformResource) address() string {
+	address := r.Type + "." + r.Name
+	if len(r.Module) > 0 {
+		address = r.Module + "." + address
+	}
+	return address
+}
+
+// matches reports whether selector is the resource's type, its type and
+// name, or its full address within a module
+func (r terraformResource) matches(selector string) bool {
+	return selector == r.Type || selector == r.Type+"."+r.Name || selector == r.address()
+}
+
+// terraformOutputHosts reads the hosts from the value of an output, which
+// may be an IP, a list of IPs or objects, or a map of hostnames to IPs or
+// objects
+func terraformOutputHosts(name string, value interface{}, mapping terraformMapping) ([]Host, error) {
+	switch v := value.(type) {
+	case string:
+		return []Host{{IP: v}}, nil
+	case []interface{}:
+		hosts := []Host{}
+		for i, item := range v {
+			host, err := terraformOutputHost(fmt.Sprintf("output %s[%d]", name, i), item, mapping)
+			if err != nil {
+				return nil, err
+			}
+			hosts = append(hosts, host)
+		}
+		return hosts, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		hosts := []Host{}
+		for _, key := range keys {
+			host, err := terraformOutputHost(fmt.Sprintf("output %s[%q]", name, key), v[key], mapping)
+			if err != nil {
+				return nil, err
+			}
+			if len(host.Hostname) == 0 {
+				host.Hostname = key
+			}
+			hosts = append(hosts, host)
+		}
+		return hosts, nil
+	}
+
+	return nil, fmt.Errorf("output %s must be an IP, a list or a map, got: %T", name, value)
+}
+
+func terraformOutputHost(address string, item interface{}, mapping terraformMapping) (Host, error) {
+	switch v := item.(type) {
+	case string:
+		return Host{IP: v}, nil
+	case map[string]interface{}:
+		return terraformHost(address, v, mapping)
+	}
+	return Host{}, fmt.Errorf("%s must be an IP or an object, got: %T", address, item)
+}
+
+// terraformHost makes a host from the attributes of a resource, or an
+// object in an output
+func terraformHost(address string, attributes map[string]interface{}, mapping terraformMapping) (Host, error) {
+	ipAttributes := terraformIPAttributes
+	if len(mapping.IPAttribute) > 0 {
+		ipAttributes = []string{mapping.IPAttribute}
+	}
+	hostnameAttributes := terraformHostnameAttributes
+	if len(mapping.HostnameAttribute) > 0 {
+		hostnameAttributes = []string{mapping.HostnameAttribute}
+	}
+
+	host := Host{
+		IP:       firstTerraformAttribute(attributes, ipAttributes),
+		Hostname: firstTerraformAttribute(attributes, hostnameAttributes),
+	}
+	if len(host.IP) == 0 {
+		return Host{}, fmt.Errorf("no IP found for %s in %s, choose the attribute with --terraform-ip-attribute",
+			address, strings.Join(ipAttributes, ", "))
+	}
+
+	return host, nil
+}
+
+func firstTerraformAttribute(attributes map[string]interface{}, paths []string) string {
+	for _, path := range paths {
+		if value := terraformAttribute(attributes, path); len(value) > 0 {
+			return value
+		}
+	}
+	return ""
+}
+
+// terraformAttribute gives the string at a dotted path within attributes,
+// where numbers index into lists, i.e. network_interface.0.network_ip
+func terraformAttribute(attributes map[string]interface{}, path string) string {
+	var current interface{} = attributes
+	for _, part := range strings.Split(path, ".") {
+		switch v := current.(type) {
+		case map[string]interface{}:
+			current = v[part]
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return ""
+			}
+			current = v[i]
+		default:
+			return ""
+		}
+	}
+
+	if value, ok := current.(string); ok {
+		return value
+	}
+	return ""
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testTerraformState = `{
+  "version": 4,
+  "terraform_version": "1.6.0",
+  "outputs": {
+    "lb_ip": {"value": "203.0.113.10", "type": "string"}
+  },
+  "resources": [
+    {
+      "mode": "data",
+      "type": "aws_instance",
+      "name": "existing",
+      "instances": [{"attributes": {"public_ip": "203.0.113.99"}}]
+    },
+    {
+      "mode": "managed",
+      "type": "aws_instance",
+      "name": "server",
+      "instances": [
+        {"index_key": 0, "attributes": {"public_ip": "203.0.113.1", "private_ip": "10.0.0.1", "tags": {"Name": "k3s-server-1"}}},
+        {"index_key": 1, "attributes": {"public_ip": "203.0.113.2", "private_ip": "10.0.0.2", "tags": {"Name": "k3s-server-2"}}}
+      ]
+    },
+    {
+      "module": "module.edge",
+      "mode": "managed",
+      "type": "google_compute_instance",
+      "name": "agent",
+      "instances": [
+        {"index_key": "a", "attributes": {"network_interface": [{"network_ip": "10.1.0.5", "access_config": []}]}}
+      ]
+    }
+  ]
+}`
+
+func Test_readTerraformHosts_State(t *testing.T) {
+	name := writeHostsFile(t, "terraform.tfstate", testTerraformState)
+
+	hosts, err := readTerraformHosts(name, terraformMapping{
+		Servers: []string{"aws_instance.server"},
+		Agents:  []string{"module.edge.google_compute_instance.agent"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Host{
+		{Hostname: "k3s-server-1", IP: "203.0.113.1", Role: "server"},
+		{Hostname: "k3s-server-2", IP: "203.0.113.2", Role: "server"},
+		{Hostname: "agent-a", IP: "10.1.0.5", Role: "agent"},
+	}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("want\n%+v\ngot\n%+v", want, hosts)
+	}
+}
+
+func Test_readTerraformHosts_Attributes(t *testing.T) {
+	name := writeHostsFile(t, "terraform.tfstate", testTerraformState)
+
+	hosts, err := readTerraformHosts(name, terraformMapping{
+		Servers:           []string{"aws_instance"},
+		IPAttribute:       "private_ip",
+		HostnameAttribute: "tags.Name",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hosts) != 2 || hosts[0].IP != "10.0.0.1" || hosts[1].IP != "10.0.0.2" {
+		t.Errorf("want the private IPs of the managed instances, got %+v", hosts)
+	}
+}
+
+func Test_readTerraformHosts_Outputs(t *testing.T) {
+	name := writeHostsFile(t, "outputs.json", `{
+  "server_ips": {"sensitive": false, "type": ["list", "string"], "value": ["10.0.0.1"]},
+  "agents": {"sensitive": false, "type": ["map", "string"], "value": {"worker-2": "10.0.0.3", "worker-1": "10.0.0.2"}},
+  "gpus": {"sensitive": false, "value": [{"name": "gpu-1", "ip": "10.0.0.9"}]}
+}`)
+
+	hosts, err := readTerraformHosts(name, terraformMapping{
+		Servers: []string{"server_ips"},
+		Agents:  []string{"output.agents", "gpus"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Host{
+		{IP: "10.0.0.1", Role: "server"},
+		{Hostname: "worker-1", IP: "10.0.0.2", Role: "agent"},
+		{Hostname: "worker-2", IP: "10.0.0.3", Role: "agent"},
+		{Hostname: "gpu-1", IP: "10.0.0.9", Role: "agent"},
+	}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("want\n%+v\ngot\n%+v", want, hosts)
+	}
+}
+
+func Test_readTerraformHosts_Errors(t *testing.T) {
+	name := writeHostsFile(t, "terraform.tfstate", testTerraformState)
+
+	cases := []struct {
+		name    string
+		mapping terraformMapping
+		want    string
+	}{
+		{
+			name:    "unknown resource",
+			mapping: terraformMapping{Servers: []string{"aws_instance.missing"}},
+			want:    `no resource or output found for "aws_instance.missing"`,
+		},
+		{
+			name:    "data sources are not hosts",
+			mapping: terraformMapping{Servers: []string{"aws_instance.existing"}},
+			want:    "no resource or output found",
+		},
+		{
+			name:    "no IP attribute",
+			mapping: terraformMapping{Servers: []string{"aws_instance.server"}, IPAttribute: "ipv6_address"},
+			want:    "no IP found for aws_instance.server[0]",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := readTerraformHosts(name, c.mapping)
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("want error containing %q, got %v", c.want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+)
+
+// fetchServingCertificate makes a TLS handshake with address and returns
+// the leaf certificate it serves. No SNI is sent, so that K3s does not
+// add the name we connected with to its certificate.
+func fetchServingCertificate(address string, timeout time.Duration) (*x509.Certificate, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	client := tls.Client(conn, &tls.Config{
+		InsecureSkipVerify: true,
+	})
+	if err := client.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake with %s failed: %w", address, err)
+	}
+
+	certs := client.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate served by %s", address)
+	}
+
+	return certs[0], nil
+}
+
+// missingSANs returns the names, IP addresses or hostnames, which are
+// not valid for cert
+func missingSANs(cert *x509.Certificate, names []string) []string {
+	missing := []string{}
+	for _, name := range names {
+		if err := cert.VerifyHostname(name); err != nil {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// checkServingCertificate fetches the certificate served at address and
+// reports which of names it does not cover. It is retried a few times,
+// since K3s may still be starting up.
+func checkServingCertificate(address string, names []string) ([]string, error) {
+	var cert *x509.Certificate
+	var err error
+
+	attempts := 5
+	for i := 0; i < attempts; i++ {
+		cert, err = fetchServingCertificate(address, time.Second*5)
+		if err == nil {
+			break
+		}
+		if i < attempts-1 {
+			time.Sleep(time.Second * 2)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return missingSANs(cert, names), nil
+}
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_missingSANs(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	address := strings.TrimPrefix(server.URL, "https://")
+
+	cert, err := fetchServingCertificate(address, time.Second*5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The httptest certificate is valid for 127.0.0.1, ::1 and *.example.com
+	got := missingSANs(cert, []string{"127.0.0.1", "k3s.example.com", "k3s.example.net", "192.168.0.1"})
+	want := []string{"k3s.example.net", "192.168.0.1"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+}
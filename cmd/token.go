@@ -0,0 +1,364 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/alexellis/k3sup/pkg"
+	operator "github.com/alexellis/k3sup/pkg/operator"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// k3sServiceEnv is where the K3s installer keeps the K3S_TOKEN of a
+// server which joined the cluster
+const k3sServiceEnv = "/etc/systemd/system/k3s.service.env"
+
+// tokenProbeScript prints the K3s unit, config.yaml, and whether the
+// service's environment file sets K3S_TOKEN, so that the places a
+// server's token is set can be found
+const tokenProbeScript = `cat /etc/systemd/system/k3s.service
+echo K3SUP_CONFIG
+%[1]scat /etc/rancher/k3s/config.yaml 2>/dev/null || true
+echo K3SUP_ENV
+if %[1]sgrep -q '^K3S_TOKEN=' ` + k3sServiceEnv + ` 2>/dev/null; then echo yes; fi
+`
+
+// tokenScriptCommand runs a script as root with the new token in the
+// K3S_NEW_TOKEN variable. The token is written to a file only root can
+// read, so that it is never on a command line, where ps would show it.
+const tokenScriptCommand = `set -e
+tmp=$(%[1]smktemp -d)
+trap '%[1]srm -rf "$tmp"' EXIT
+%[2]s%[3]s%[1]ssh "$tmp/token.sh" "$tmp/token.env" 2>&1
+`
+
+// rotateTokenScript rotates the token with k3s token rotate, which reads
+// the current and new tokens from K3S_TOKEN and K3S_NEW_TOKEN
+const rotateTokenScript = `set -e
+set -a
+. "$1"
+K3S_TOKEN=$(cat %[1]s)
+exec k3s token rotate --data-dir %[2]s
+`
+
+// updateServiceTokenScript replaces the K3S_TOKEN in the service's
+// environment file with K3S_NEW_TOKEN
+const updateServiceTokenScript = `set -e
+. "$1"
+env=` + k3sServiceEnv + `
+grep -v '^K3S_TOKEN=' "$env" > "$env.k3sup" || true
+echo "K3S_TOKEN='$K3S_NEW_TOKEN'" >> "$env.k3sup"
+chmod 600 "$env.k3sup"
+mv -f "$env.k3sup" "$env"
+`
+
+var tokenValue = regexp.MustCompile(`^[A-Za-z0-9:._-]+$`)
+
+// MakeToken creates the token parent command
+func MakeToken() *cobra.Command {
+	var command = &cobra.Command{
+		Use:   "token",
+		Short: "Manage bootstrap tokens and rotate the server token",
+		Long: `Create, list and delete time-limited bootstrap tokens for joining
+nodes, and rotate the server token.
+
+Bootstrap tokens expire after their TTL, so can be given out to join
+agents instead of the permanent token printed by node-token.
+
+` + pkg.SupportMessageShort + `
+`,
+		SilenceUsage: true,
+	}
+
+	return command
+}
+
+// MakeTokenCreate creates the token create command
+func MakeTokenCreate() *cobra.Command {
+	var command = &cobra.Command{
+		Use:   "create",
+		Short: "Create a bootstrap token",
+		Example: `  # Create a token to join agents which expires in an hour
+  k3sup token create --host SERVER_IP --ttl 1h \
+    --description "Agents for rack 2"`,
+		SilenceUsage: true,
+	}
+
+	addServerFlags(command)
+	command.Flags().Duration("ttl", time.Hour*24, "Time until the token expires")
+	command.Flags().String("description", "", "Description of what the token is for")
+
+	command.RunE = func(command *cobra.Command, args []string) error {
+		ttl, _ := command.Flags().GetDuration("ttl")
+		description, _ := command.Flags().GetString("description")
+
+		tokenArgs := fmt.Sprintf("create --ttl %s", ttl)
+		if len(description) > 0 {
+			tokenArgs += " --description " + shellQuote(description)
+		}
+
+		return runToken(command, tokenArgs)
+	}
+
+	return command
+}
+
+// MakeTokenList creates the token list command
+func MakeTokenList() *cobra.Command {
+	var command = &cobra.Command{
+		Use:          "list",
+		Short:        "List bootstrap tokens",
+		Example:      `  k3sup token list --host SERVER_IP`,
+		SilenceUsage: true,
+	}
+
+	addServerFlags(command)
+
+	command.RunE = func(command *cobra.Command, args []string) error {
+		return runToken(command, "list")
+	}
+
+	return command
+}
+
+// MakeTokenDelete creates the token delete command
+func MakeTokenDelete() *cobra.Command {
+	var command = &cobra.Command{
+		Use:          "delete TOKEN_ID",
+		Short:        "Delete bootstrap tokens",
+		Example:      `  k3sup token delete --host SERVER_IP abc123`,
+		SilenceUsage: true,
+	}
+
+	addServerFlags(command)
+
+	command.PreRunE = func(command *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return fmt.Errorf("give the ID of at least one token to delete")
+		}
+		for _, arg := range args {
+			if !tokenValue.MatchString(arg) {
+				return fmt.Errorf("invalid token ID: %q", arg)
+			}
+		}
+		return nil
+	}
+
+	command.RunE = func(command *cobra.Command, args []string) error {
+		return runToken(command, "delete "+strings.Join(args, " "))
+	}
+
+	return command
+}
+
+// MakeTokenRotate creates the token rotate command
+func MakeTokenRotate() *cobra.Command {
+	var command = &cobra.Command{
+		Use:   "rotate",
+		Short: "Rotate the server token, and restart each server",
+		Long: `Rotate the server token with k3s token rotate on the first server, then
+restart every server one at a time, waiting for each to be ready.
+
+Servers which joined the cluster have the new token written to
+` + k3sServiceEnv + ` before they are restarted. Agents
+keep working, and new nodes must join with the new token, which can be
+fetched with k3sup node-token.
+
+Every server is checked first, and nothing is rotated when a server
+sets its token with --token or --token-file in its systemd unit or in
+config.yaml, as those would keep the old token and the server would not
+start again. The tokens are passed to each server in a file only root
+can read, rather than on the command line.
+
+` + pkg.SupportMessageShort + `
+`,
+		Example:      `  k3sup token rotate --server SERVER_1,SERVER_2,SERVER_3`,
+		SilenceUsage: true,
+	}
+
+	command.Flags().StringSlice("server", []string{}, "Hostname or IP of each server, repeat the flag or give a comma-separated list")
+	command.Flags().String("user", "root", "Username for SSH login")
+	command.Flags().String("ssh-key", "~/.ssh/id_rsa", "The ssh key to use for remote login")
+	command.Flags().Int("ssh-port", 22, "The port on which to connect for ssh")
+	command.Flags().Bool("sudo", true, "Use sudo for commands. e.g. set to false when using the root user and no sudo is available.")
+	command.Flags().Bool("print-command", false, "Print the commands to be executed")
+	command.Flags().String("server-data-dir", "/var/lib/rancher/k3s/", "Data directory of K3s on each server")
+
+	command.Flags().String("new-token", "", "The new server token, a random token is generated when not given")
+
+	command.Flags().Int("attempts", 60, "Number of attempts to check if a server is ready after restarting it")
+	command.Flags().Duration("pause", time.Second*2, "Pause between checking a server for readiness")
+
+	command.PreRunE = func(command *cobra.Command, args []string) error {
+		servers, _ := command.Flags().GetStringSlice("server")
+		if len(servers) == 0 {
+			return fmt.Errorf("give every server with --server")
+		}
+
+		newToken, _ := command.Flags().GetString("new-token")
+		if len(newToken) > 0 && !tokenValue.MatchString(newToken) {
+			return fmt.Errorf("--new-token may only contain letters, digits and the characters :._-")
+		}
+
+		return nil
+	}
+
+	command.RunE = func(command *cobra.Command, args []string) error {
+		servers, _ := command.Flags().GetStringSlice("server")
+		user, _ := command.Flags().GetString("user")
+		sshKey, _ := command.Flags().GetString("ssh-key")
+		port, _ := command.Flags().GetInt("ssh-port")
+		dataDir, _ := command.Flags().GetString("server-data-dir")
+		newToken, _ := command.Flags().GetString("new-token")
+		attempts, _ := command.Flags().GetInt("attempts")
+		pause, _ := command.Flags().GetDuration("pause")
+		sudoPrefix, printCommand := serverOptions(command)
+
+		if len(newToken) == 0 {
+			var err error
+			if newToken, err = generateToken(); err != nil {
+				return err
+			}
+		}
+
+		sshKeyPath := expandPath(sshKey)
+
+		operators := []operator.CommandOperator{}
+		for _, server := range servers {
+			address := fmt.Sprintf("%s:%d", server, port)
+			sshOperator, sshOperatorDone, errored, err := connectOperator(user, address, sshKeyPath)
+			if errored {
+				return fmt.Errorf("%s: %w", server, err)
+			}
+			if sshOperatorDone != nil {
+				defer sshOperatorDone()
+			}
+			operators = append(operators, sshOperator)
+		}
+
+		// Each server is checked before the token is rotated, as one
+		// which cannot be updated would not start again afterwards
+		serviceEnv := make([]bool, len(servers))
+		for i, server := range servers {
+			res, err := executeCommand(operators[i], fmt.Sprintf(tokenProbeScript, sudoPrefix), printCommand)
+			if err != nil {
+				return fmt.Errorf("%s: unable to find where the token is set: %w", server, err)
+			}
+
+			var fixed []string
+			serviceEnv[i], fixed, err = tokenLocations(string(res.StdOut))
+			if err != nil {
+				return fmt.Errorf("%s: %w", server, err)
+			}
+			if len(fixed) > 0 {
+				return fmt.Errorf("%s sets its token in %s, which k3sup cannot update, remove it from there and restart K3s before rotating the token",
+					server, strings.Join(fixed, " and "))
+			}
+		}
+
+		// The tokens are not printed, even with --print-command
+		rotateScript := fmt.Sprintf(rotateTokenScript, shellQuote(path.Join(dataDir, "server/token")), shellQuote(dataDir))
+		if _, err := executeCommand(operators[0], makeTokenScriptCommand(sudoPrefix, newToken, rotateScript), false); err != nil {
+			return fmt.Errorf("unable to rotate the token: %w", err)
+		}
+		fmt.Printf("Rotated the server token on %s\n", servers[0])
+
+		for i, server := range servers {
+			fmt.Printf("[%d/%d] Restarting K3s on %s\n", i+1, len(servers), server)
+
+			if serviceEnv[i] {
+				if _, err := executeCommand(operators[i], makeTokenScriptCommand(sudoPrefix, newToken, updateServiceTokenScript), false); err != nil {
+					return fmt.Errorf("%s: unable to update %s: %w", server, k3sServiceEnv, err)
+				}
+			}
+
+			if _, err := executeCommand(operators[i], fmt.Sprintf("%ssystemctl restart k3s\n", sudoPrefix), printCommand); err != nil {
+				return fmt.Errorf("%s: unable to restart K3s: %w", server, err)
+			}
+
+			if err := waitForServerReady(operators[i], sudoPrefix, attempts, pause, printCommand); err != nil {
+				return fmt.Errorf("%s: %w", server, err)
+			}
+		}
+
+		fmt.Printf("Rotated the server token, get the new node token with: k3sup node-token --host %s\n", servers[0])
+
+		return nil
+	}
+
+	return command
+}
+
+// runToken runs k3s token with tokenArgs on the server and prints its output
+func runToken(command *cobra.Command, tokenArgs string) error {
+	dataDir, _ := command.Flags().GetString("server-data-dir")
+	sudoPrefix, printCommand := serverOptions(command)
+
+	op, done, err := connectServer(command)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	tokenCommand := fmt.Sprintf("%sk3s token %s --data-dir %s 2>&1\n", sudoPrefix, tokenArgs, dataDir)
+	res, err := executeCommand(op, tokenCommand, printCommand)
+	if err != nil {
+		return fmt.Errorf("unable to run k3s token: %w", err)
+	}
+
+	fmt.Print(ensureTrailingNewline(string(res.StdOut)))
+
+	return nil
+}
+
+// makeTokenScriptCommand gives a command to run script as root, with the
+// new token in a file only root can read
+func makeTokenScriptCommand(sudoPrefix, newToken, script string) string {
+	return fmt.Sprintf(tokenScriptCommand, sudoPrefix,
+		writeFileCommand(sudoPrefix, "$tmp/token.env", []byte("K3S_NEW_TOKEN="+newToken), "0600"),
+		writeFileCommand(sudoPrefix, "$tmp/token.sh", []byte(script), "0700"))
+}
+
+// tokenLocations reads the output of tokenProbeScript, and gives whether
+// the service's environment file sets K3S_TOKEN, and the places which set
+// the token which cannot be updated
+func tokenLocations(out string) (bool, []string, error) {
+	unit, rest, _ := strings.Cut(out, "K3SUP_CONFIG\n")
+	config, env, _ := strings.Cut(rest, "K3SUP_ENV\n")
+
+	fixed := []string{}
+	unitArgs := parseK3sArgs(unitExecArgs(unit))
+	for _, name := range []string{"token", "t", "token-file"} {
+		if _, ok := unitArgs[name]; ok {
+			fixed = append(fixed, "the ExecStart of k3s.service")
+			break
+		}
+	}
+
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(config), &values); err != nil {
+		return false, nil, fmt.Errorf("unable to read config.yaml: %w", err)
+	}
+	for _, name := range []string{"token", "t", "token-file"} {
+		if _, ok := values[name]; ok {
+			fixed = append(fixed, "/etc/rancher/k3s/config.yaml")
+			break
+		}
+	}
+
+	return strings.TrimSpace(env) == "yes", fixed, nil
+}
+
+func generateToken() (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
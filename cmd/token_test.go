@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_makeTokenScriptCommand(t *testing.T) {
+	got := makeTokenScriptCommand("sudo ", "K10new::server:abc", updateServiceTokenScript)
+
+	for _, want := range []string{
+		"tmp=$(sudo mktemp -d)\n",
+		"sudo install -m 0600 /dev/null $tmp/token.env && cat <<'K3SUP_EOF' | sudo tee $tmp/token.env > /dev/null\nK3S_NEW_TOKEN=K10new::server:abc\nK3SUP_EOF\n",
+		"sudo install -m 0700 /dev/null $tmp/token.sh",
+		`sudo sh "$tmp/token.sh" "$tmp/token.env" 2>&1` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("want %q in:\n%s", want, got)
+		}
+	}
+
+	// The token is only written through the heredoc, never as an argument
+	if strings.Count(got, "K10new::server:abc") != 1 {
+		t.Errorf("want the token once, in the heredoc, got:\n%s", got)
+	}
+}
+
+func Test_tokenLocations(t *testing.T) {
+	tests := []struct {
+		title     string
+		out       string
+		wantEnv   bool
+		wantFixed []string
+	}{
+		{
+			title:     "joined through the environment file",
+			out:       testK3sUnit + "K3SUP_CONFIG\nwrite-kubeconfig-mode: \"0644\"\nK3SUP_ENV\nyes\n",
+			wantEnv:   true,
+			wantFixed: []string{},
+		},
+		{
+			title:     "first server without a token",
+			out:       testK3sUnit + "K3SUP_CONFIG\nK3SUP_ENV\n",
+			wantFixed: []string{},
+		},
+		{
+			title:     "token in ExecStart and config.yaml",
+			out:       "ExecStart=/usr/local/bin/k3s \\\n    server \\\n\t'--token' \\\n\t'K10old' \\\n\nK3SUP_CONFIG\ntoken-file: /etc/k3s-token\nK3SUP_ENV\n",
+			wantFixed: []string{"the ExecStart of k3s.service", "/etc/rancher/k3s/config.yaml"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.title, func(t *testing.T) {
+			env, fixed, err := tokenLocations(tc.out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if env != tc.wantEnv || !reflect.DeepEqual(tc.wantFixed, fixed) {
+				t.Fatalf("want %v %q, got %v %q", tc.wantEnv, tc.wantFixed, env, fixed)
+			}
+		})
+	}
+}
+
+func Test_generateToken(t *testing.T) {
+	first, err := generateToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := generateToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(first) != 64 {
+		t.Errorf("want 64 characters, got %d", len(first))
+	}
+	if first == second {
+		t.Errorf("want a different token each time")
+	}
+	if !tokenValue.MatchString(first) {
+		t.Errorf("generated token %q is not valid", first)
+	}
+}
+
+func Test_shellQuote(t *testing.T) {
+	tests := map[string]string{
+		"Agents for rack 2": `'Agents for rack 2'`,
+		"Alex's agents":     `'Alex'\''s agents'`,
+		"$(reboot)":         `'$(reboot)'`,
+	}
+
+	for in, want := range tests {
+		if got := shellQuote(in); got != want {
+			t.Errorf("%q: want %s, got %s", in, want, got)
+		}
+	}
+}
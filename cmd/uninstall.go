@@ -0,0 +1,344 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/alexellis/k3sup/pkg"
+	operator "github.com/alexellis/k3sup/pkg/operator"
+	"github.com/spf13/cobra"
+)
+
+const (
+	etcdRemoveAnnotation  = "etcd.k3s.cattle.io/remove"
+	etcdRemovedAnnotation = "etcd.k3s.cattle.io/removed-node-name"
+	etcdRoleLabel         = "node-role.kubernetes.io/etcd=true"
+)
+
+// detectRoleScript prints the role of the node, and whether it runs
+// embedded etcd, based upon which uninstall script the K3s installer
+// left behind
+const detectRoleScript = `if [ -x /usr/local/bin/k3s-uninstall.sh ]; then echo "role=server"; elif [ -x /usr/local/bin/k3s-agent-uninstall.sh ]; then echo "role=agent"; else echo "role=none"; fi
+if [ -d %s ]; then echo "etcd=yes"; else echo "etcd=no"; fi
+echo "hostname=$(hostname)"
+`
+
+// nodeInstallation is what was found on a node before uninstalling it
+type nodeInstallation struct {
+	Role     string
+	Etcd     bool
+	Hostname string
+}
+
+// MakeUninstall creates the uninstall command
+func MakeUninstall() *cobra.Command {
+	var command = &cobra.Command{
+		Use:   "uninstall",
+		Short: "Uninstall K3s from a server or agent",
+		Long: `Uninstall K3s from a node which was set up with install or join.
+
+The role of the node is detected, then k3s-uninstall.sh is run for a
+server, or k3s-agent-uninstall.sh for an agent.
+
+A server which is a member of an embedded etcd cluster is removed from
+etcd through another, healthy server given with --server-ip or
+--server-host, before it is uninstalled, so that the cluster keeps
+quorum. When a server is given, the Node object is also deleted. The
+last member of etcd, such as a single server started with
+--cluster-init, is uninstalled along with its cluster, so needs no
+other server.
+
+` + pkg.SupportMessageShort + `
+`,
+		Example: `  # Uninstall an agent, and delete its Node from the cluster
+  k3sup uninstall --ip AGENT_IP --server-ip SERVER_IP
+
+  # Remove a server from an HA cluster with embedded etcd
+  k3sup uninstall --ip SERVER_2 --server-ip SERVER_1 --user ubuntu
+
+  # Uninstall the only server of a cluster started with --cluster-init
+  k3sup uninstall --ip SERVER_IP --user ubuntu
+
+  # Uninstall a single server, and remove its context from
+  # the local kubeconfig
+  k3sup uninstall --ip SERVER_IP --context k3s-prod \
+    --local-path ~/.kube/config
+
+  # Remove a node of a cluster recorded by k3sup install, through
+  # another of its servers
+  k3sup uninstall --host NODE_IP --cluster prod`,
+		SilenceUsage: true,
+	}
+
+	command.Flags().IP("ip", net.ParseIP("127.0.0.1"), "Public IP of node to uninstall")
+	command.Flags().IP("server-ip", net.ParseIP("127.0.0.1"), "Public IP of a healthy k3s server, used to remove the node from the cluster")
+
+	command.Flags().String("host", "", "Public hostname of node to uninstall")
+	command.Flags().String("server-host", "", "Public hostname of a healthy k3s server, used to remove the node from the cluster")
+
+	command.Flags().String("user", "root", "Username for SSH login")
+	command.Flags().String("server-user", "root", "Server username for SSH login (Default to --user)")
+
+	command.Flags().String("ssh-key", "~/.ssh/id_rsa", "The ssh key to use for remote login")
+	command.Flags().Int("ssh-port", 22, "The port on which to connect for ssh")
+	command.Flags().Int("server-ssh-port", 22, "The port on which to connect to server for ssh (Default to --ssh-port)")
+	command.Flags().Bool("sudo", true, "Use sudo for commands. e.g. set to false when using the root user and no sudo is available.")
+	command.Flags().Bool("local", false, "Uninstall K3s from the local machine without using ssh")
+	command.Flags().Bool("print-command", false, "Print the commands to be executed")
+
+	command.Flags().String("node-name", "", "Name of the Node in the cluster, if different from the node's hostname")
+	command.Flags().String("server-data-dir", "/var/lib/rancher/k3s/", "Data directory of K3s on the node")
+
+	command.Flags().String("context", "", "Remove this context from the local kubeconfig after uninstalling")
+	command.Flags().String("local-path", "kubeconfig", "Local path of the kubeconfig file to remove the context from")
+
+	command.Flags().Int("attempts", 30, "Number of attempts to check that the node was removed from etcd")
+	command.Flags().Duration("pause", time.Second*2, "Pause between checking that the node was removed from etcd")
+	addClusterFlag(command)
+
+	command.PreRunE = func(command *cobra.Command, args []string) error {
+		return fillFromCluster(command, func(record *clusterRecord) (map[string]string, error) {
+			ip, _ := command.Flags().GetIP("ip")
+			host, _ := command.Flags().GetString("host")
+			if len(host) == 0 {
+				host = ip.String()
+			}
+			return uninstallClusterValues(record, host)
+		})
+	}
+
+	command.RunE = func(command *cobra.Command, args []string) error {
+		local, _ := command.Flags().GetBool("local")
+		useSudo, _ := command.Flags().GetBool("sudo")
+		printCommand, _ := command.Flags().GetBool("print-command")
+		nodeName, _ := command.Flags().GetString("node-name")
+		dataDir, _ := command.Flags().GetString("server-data-dir")
+		context, _ := command.Flags().GetString("context")
+		localKubeconfig, _ := command.Flags().GetString("local-path")
+		attempts, _ := command.Flags().GetInt("attempts")
+		pause, _ := command.Flags().GetDuration("pause")
+
+		user, _ := command.Flags().GetString("user")
+		sshKey, _ := command.Flags().GetString("ssh-key")
+		port, _ := command.Flags().GetInt("ssh-port")
+
+		ip, _ := command.Flags().GetIP("ip")
+		host, _ := command.Flags().GetString("host")
+		if len(host) == 0 {
+			host = ip.String()
+		}
+
+		sudoPrefix := ""
+		if useSudo {
+			sudoPrefix = "sudo "
+		}
+		sshKeyPath := expandPath(sshKey)
+
+		var op operator.CommandOperator
+		if local {
+			op = operator.ExecOperator{}
+		} else {
+			address := fmt.Sprintf("%s:%d", host, port)
+			sshOperator, sshOperatorDone, errored, err := connectOperator(user, address, sshKeyPath)
+			if errored {
+				return err
+			}
+			if sshOperatorDone != nil {
+				defer sshOperatorDone()
+			}
+			op = sshOperator
+		}
+
+		res, err := executeCommand(op, fmt.Sprintf(detectRoleScript, strings.TrimSuffix(dataDir, "/")+"/server/db/etcd"), printCommand)
+		if err != nil {
+			return fmt.Errorf("unable to detect the role of %s: %w", host, err)
+		}
+
+		installation := parseNodeInstallation(string(res.StdOut))
+		if installation.Role == "none" {
+			return fmt.Errorf("K3s is not installed on %s", host)
+		}
+		if len(nodeName) == 0 {
+			nodeName = installation.Hostname
+		}
+
+		fmt.Printf("Found K3s %s %q on %s", installation.Role, nodeName, host)
+		if installation.Etcd {
+			fmt.Printf(", with embedded etcd")
+		}
+		fmt.Println()
+
+		// The node is removed through another server, so that it can be
+		// taken out of etcd whilst the cluster still has quorum
+		var serverOp operator.CommandOperator
+		if command.Flags().Changed("server-ip") || command.Flags().Changed("server-host") {
+			serverIP, _ := command.Flags().GetIP("server-ip")
+			serverHost, _ := command.Flags().GetString("server-host")
+			if len(serverHost) == 0 {
+				serverHost = serverIP.String()
+			}
+
+			serverUser := user
+			if command.Flags().Changed("server-user") {
+				serverUser, _ = command.Flags().GetString("server-user")
+			}
+			serverPort := port
+			if command.Flags().Changed("server-ssh-port") {
+				serverPort, _ = command.Flags().GetInt("server-ssh-port")
+			}
+
+			address := fmt.Sprintf("%s:%d", serverHost, serverPort)
+			sshOperator, sshOperatorDone, errored, err := connectOperator(serverUser, address, sshKeyPath)
+			if errored {
+				return err
+			}
+			if sshOperatorDone != nil {
+				defer sshOperatorDone()
+			}
+
+			if _, err := executeCommand(sshOperator, fmt.Sprintf("%sk3s kubectl get --raw /readyz\n", sudoPrefix), printCommand); err != nil {
+				return fmt.Errorf("server %s is not healthy: %w", serverHost, err)
+			}
+			serverOp = sshOperator
+		}
+
+		// The last member of etcd takes the cluster with it, so there is
+		// nothing to remove it from
+		lastMember := false
+		if installation.Etcd {
+			countOp := serverOp
+			if countOp == nil {
+				countOp = op
+			}
+			members, err := countEtcdMembers(countOp, sudoPrefix, printCommand)
+			if err != nil && serverOp == nil {
+				return fmt.Errorf("%s is a member of an etcd cluster, give a healthy server with --server-ip or --server-host so that it can be removed from etcd first: %w", host, err)
+			} else if err != nil {
+				return err
+			}
+
+			lastMember = members <= 1
+			if lastMember {
+				fmt.Printf("%s is the last member of etcd, the cluster will be removed with it\n", nodeName)
+			} else if serverOp == nil {
+				return fmt.Errorf("%s is one of %d members of an etcd cluster, give a healthy server with --server-ip or --server-host so that it can be removed from etcd first", host, members)
+			}
+		}
+
+		if installation.Etcd && !lastMember {
+			fmt.Printf("Removing %s from etcd\n", nodeName)
+			if err := removeEtcdMember(serverOp, sudoPrefix, nodeName, attempts, pause, printCommand); err != nil {
+				return err
+			}
+		}
+
+		uninstallCommand := fmt.Sprintf("%s%s\n", sudoPrefix, uninstallScript(installation.Role))
+		fmt.Printf("Running: %s", uninstallCommand)
+		if _, err := executeCommand(op, uninstallCommand, printCommand); err != nil {
+			return fmt.Errorf("unable to uninstall K3s from %s: %w", host, err)
+		}
+
+		// The Node is deleted after uninstalling, otherwise the kubelet
+		// would register it again
+		if serverOp != nil && !lastMember {
+			deleteCommand := fmt.Sprintf("%sk3s kubectl delete node %s --ignore-not-found\n", sudoPrefix, nodeName)
+			if _, err := executeCommand(serverOp, deleteCommand, printCommand); err != nil {
+				return fmt.Errorf("unable to delete node %s: %w", nodeName, err)
+			}
+			fmt.Printf("Deleted node %s from the cluster\n", nodeName)
+		} else if !lastMember {
+			fmt.Printf("Give --server-ip or --server-host to also delete node %s from the cluster\n", nodeName)
+		}
+
+		if len(context) > 0 {
+			if err := forgetConfig(expandPath(localKubeconfig), context); err != nil {
+				return err
+			}
+			fmt.Printf("Removed context %q from %s\n", context, localKubeconfig)
+		}
+
+		if err := recordUninstall(command, host); err != nil {
+			fmt.Printf("Unable to remove %s from the cluster record: %s\n", host, err)
+		}
+
+		fmt.Printf("Uninstalled K3s from %s\n", host)
+
+		return nil
+	}
+
+	return command
+}
+
+// parseNodeInstallation reads the output of detectRoleScript
+func parseNodeInstallation(out string) nodeInstallation {
+	installation := nodeInstallation{Role: "none"}
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "role":
+			installation.Role = value
+		case "etcd":
+			installation.Etcd = value == "yes"
+		case "hostname":
+			installation.Hostname = value
+		}
+	}
+
+	// Only a server runs etcd, the directory may be left over otherwise
+	if installation.Role != "server" {
+		installation.Etcd = false
+	}
+
+	return installation
+}
+
+// uninstallScript gives the script the K3s installer writes for the role
+func uninstallScript(role string) string {
+	if role == "agent" {
+		return "/usr/local/bin/k3s-agent-uninstall.sh"
+	}
+	return "/usr/local/bin/k3s-uninstall.sh"
+}
+
+// countEtcdMembers gives the number of Nodes in the cluster which run
+// embedded etcd
+func countEtcdMembers(op operator.CommandOperator, sudoPrefix string, printCommand bool) (int, error) {
+	countCommand := fmt.Sprintf("%sk3s kubectl get nodes -l %s -o name\n", sudoPrefix, etcdRoleLabel)
+	res, err := executeCommand(op, countCommand, printCommand)
+	if err != nil {
+		return 0, fmt.Errorf("unable to count the members of etcd: %w", err)
+	}
+
+	return len(strings.Fields(string(res.StdOut))), nil
+}
+
+// removeEtcdMember asks K3s to remove the node from etcd by annotating its
+// Node, then waits for K3s to confirm the removal
+func removeEtcdMember(op operator.CommandOperator, sudoPrefix, nodeName string, attempts int, pause time.Duration, printCommand bool) error {
+	annotateCommand := fmt.Sprintf("%sk3s kubectl annotate node %s %s=true --overwrite\n",
+		sudoPrefix, nodeName, etcdRemoveAnnotation)
+	if _, err := executeCommand(op, annotateCommand, printCommand); err != nil {
+		return fmt.Errorf("unable to remove %s from etcd: %w", nodeName, err)
+	}
+
+	removedCommand := fmt.Sprintf("%sk3s kubectl get node %s -o jsonpath='{.metadata.annotations.%s}'\n",
+		sudoPrefix, nodeName, strings.ReplaceAll(etcdRemovedAnnotation, ".", `\.`))
+
+	for i := 0; i < attempts; i++ {
+		res, err := executeCommand(op, removedCommand, printCommand && i == 0)
+		if err == nil && len(strings.TrimSpace(string(res.StdOut))) > 0 {
+			return nil
+		}
+
+		fmt.Printf("Waiting for %s to be removed from etcd: %d/%d\n", nodeName, i+1, attempts)
+		time.Sleep(pause)
+	}
+
+	return fmt.Errorf("%s was not removed from etcd after %d attempts", nodeName, attempts)
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import "testing"
+
+func Test_parseNodeInstallation(t *testing.T) {
+	tests := []struct {
+		title string
+		out   string
+		want  nodeInstallation
+	}{
+		{
+			title: "server with embedded etcd",
+			out:   "role=server\netcd=yes\nhostname=k3s-1\n",
+			want:  nodeInstallation{Role: "server", Etcd: true, Hostname: "k3s-1"},
+		},
+		{
+			title: "agent ignores a left over etcd directory",
+			out:   "role=agent\netcd=yes\nhostname=k3s-2\n",
+			want:  nodeInstallation{Role: "agent", Hostname: "k3s-2"},
+		},
+		{
+			title: "not installed",
+			out:   "role=none\netcd=no\nhostname=k3s-3\n",
+			want:  nodeInstallation{Role: "none", Hostname: "k3s-3"},
+		},
+		{
+			title: "no output",
+			out:   "",
+			want:  nodeInstallation{Role: "none"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.title, func(t *testing.T) {
+			got := parseNodeInstallation(tc.out)
+			if tc.want != got {
+				t.Fatalf("want %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func Test_uninstallScript(t *testing.T) {
+	if got := uninstallScript("server"); got != "/usr/local/bin/k3s-uninstall.sh" {
+		t.Errorf("unexpected script for a server: %s", got)
+	}
+	if got := uninstallScript("agent"); got != "/usr/local/bin/k3s-agent-uninstall.sh" {
+		t.Errorf("unexpected script for an agent: %s", got)
+	}
+}
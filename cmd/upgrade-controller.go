@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	operator "github.com/alexellis/k3sup/pkg/operator"
+)
+
+// SystemUpgradeControllerVersion is the release of Rancher's
+// system-upgrade-controller deployed by upgrade --mode controller
+const SystemUpgradeControllerVersion = "v0.14.2"
+
+const (
+	systemUpgradeControllerURL = "https://github.com/rancher/system-upgrade-controller/releases/download"
+	k3sChannelURL              = "https://update.k3s.io/v1-release/channels"
+	upgradePlansManifest       = "k3sup-upgrade-plans.yaml"
+)
+
+// downloadManifestScript downloads a manifest to a temporary file, then
+// installs it into the manifests directory, so that a failed download
+// never leaves an empty or partial manifest for K3s to apply
+const downloadManifestScript = `set -e
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+curl -sfL -o "$tmp/manifest.yaml" %[2]s
+%[1]smkdir -p %[3]s
+%[1]sinstall -m 0600 "$tmp/manifest.yaml" %[4]s
+`
+
+// controllerUpgrade hands the upgrade to the system-upgrade-controller,
+// through the auto-deploy manifests directory of a server
+type controllerUpgrade struct {
+	version      string
+	channel      string
+	concurrency  int
+	drain        bool
+	dataDir      string
+	sudoPrefix   string
+	attempts     int
+	pause        time.Duration
+	printCommand bool
+}
+
+func (u *controllerUpgrade) run(op operator.CommandOperator) error {
+	manifestsDir := path.Join(u.dataDir, "server/manifests")
+
+	fmt.Printf("Deploying system-upgrade-controller %s to %s\n", SystemUpgradeControllerVersion, manifestsDir)
+	for _, name := range []string{"crd.yaml", "system-upgrade-controller.yaml"} {
+		downloadCommand := makeDownloadManifestCommand(u.sudoPrefix,
+			fmt.Sprintf("%s/%s/%s", systemUpgradeControllerURL, SystemUpgradeControllerVersion, name),
+			path.Join(manifestsDir, "system-upgrade-controller-"+name))
+		if _, err := executeCommand(op, downloadCommand, u.printCommand); err != nil {
+			return fmt.Errorf("unable to write %s: %w", name, err)
+		}
+	}
+
+	plans := makeUpgradePlans(u.version, u.channel, u.concurrency, u.drain)
+	plansPath := path.Join(manifestsDir, upgradePlansManifest)
+
+	fmt.Printf("Writing upgrade plans to %s\n", plansPath)
+	if _, err := executeCommand(op, writeFileCommand(u.sudoPrefix, plansPath, []byte(plans), "0600"), u.printCommand); err != nil {
+		return fmt.Errorf("unable to write %s: %w", plansPath, err)
+	}
+
+	version := u.version
+	if len(version) == 0 {
+		var err error
+		if version, err = u.waitForLatestVersion(op); err != nil {
+			return err
+		}
+	}
+
+	return u.waitForNodes(op, version)
+}
+
+// makeDownloadManifestCommand gives the command to download the manifest
+// at url to manifestPath on a server
+func makeDownloadManifestCommand(sudoPrefix, url, manifestPath string) string {
+	return fmt.Sprintf(downloadManifestScript, sudoPrefix, shellQuote(url), shellQuote(path.Dir(manifestPath)), shellQuote(manifestPath))
+}
+
+// waitForLatestVersion waits for the controller to resolve the channel
+// of the server plan to a version
+func (u *controllerUpgrade) waitForLatestVersion(op operator.CommandOperator) (string, error) {
+	versionCommand := fmt.Sprintf("%sk3s kubectl --namespace system-upgrade get plan server-plan -o jsonpath='{.status.latestVersion}'\n", u.sudoPrefix)
+
+	for i := 0; i < u.attempts; i++ {
+		res, err := executeCommand(op, versionCommand, u.printCommand && i == 0)
+		if version := strings.TrimSpace(string(res.StdOut)); err == nil && len(version) > 0 {
+			fmt.Printf("Channel %s resolved to %s\n", u.channel, version)
+			return version, nil
+		}
+
+		fmt.Printf("Waiting for the server plan to resolve a version: %d/%d\n", i+1, u.attempts)
+		time.Sleep(u.pause)
+	}
+
+	return "", fmt.Errorf("the server plan did not resolve a version after %d attempts", u.attempts)
+}
+
+// waitForNodes follows the upgrade until every node is Ready at version.
+// The API server restarts during the upgrade, so errors are retried.
+func (u *controllerUpgrade) waitForNodes(op operator.CommandOperator, version string) error {
+	nodesCommand := fmt.Sprintf(`%sk3s kubectl get nodes -o jsonpath='{range .items[*]}{.metadata.name} {.status.nodeInfo.kubeletVersion} {.status.conditions[?(@.type=="Ready")].status}{"\n"}{end}'`+"\n",
+		u.sudoPrefix)
+
+	attempts := u.attempts
+	last := ""
+	for i := 0; i < attempts; i++ {
+		res, err := executeCommand(op, nodesCommand, u.printCommand && i == 0)
+		if err == nil {
+			pending, total := nodesPendingUpgrade(string(res.StdOut), version)
+
+			// Give each node the same number of attempts as in ssh mode
+			if i == 0 && total > 1 {
+				attempts = u.attempts * total
+			}
+
+			if total > 0 && len(pending) == 0 {
+				fmt.Printf("All %d nodes are Ready at %s\n", total, version)
+				return nil
+			}
+
+			status := fmt.Sprintf("%d/%d nodes are Ready at %s, waiting for: %s",
+				total-len(pending), total, version, strings.Join(pending, ", "))
+			if status != last {
+				fmt.Println(status)
+				last = status
+			}
+		}
+
+		time.Sleep(u.pause)
+	}
+
+	return fmt.Errorf("not all nodes were Ready at %s after %d attempts, check the plans with: kubectl -n system-upgrade get plans,jobs", version, attempts)
+}
+
+// nodesPendingUpgrade reads the name, version and Ready condition of each
+// node, and gives the names of those which are not yet Ready at version
+func nodesPendingUpgrade(out, version string) ([]string, int) {
+	pending := []string{}
+	total := 0
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		total++
+		nodeVersion, ready := parseNodeStatus(strings.Join(fields[1:], " "))
+		if nodeVersion != version || !ready {
+			pending = append(pending, fields[0])
+		}
+	}
+	return pending, total
+}
+
+// makeUpgradePlans gives the Plans for the system-upgrade-controller to
+// upgrade servers one at a time, then agents concurrency at a time. The
+// agent plan waits for the server plan to complete.
+func makeUpgradePlans(version, channel string, concurrency int, drain bool) string {
+	target := fmt.Sprintf("  version: %s\n", version)
+	if len(version) == 0 {
+		target = fmt.Sprintf("  channel: %s/%s\n", k3sChannelURL, channel)
+	}
+
+	drainSpec := ""
+	if drain {
+		drainSpec = `  drain:
+    force: true
+    ignoreDaemonSets: true
+    deleteEmptydirData: true
+`
+	}
+
+	return `apiVersion: upgrade.cattle.io/v1
+kind: Plan
+metadata:
+  name: server-plan
+  namespace: system-upgrade
+  labels:
+    app.kubernetes.io/managed-by: k3sup
+spec:
+  concurrency: 1
+  cordon: true
+` + drainSpec + `  nodeSelector:
+    matchExpressions:
+    - key: node-role.kubernetes.io/control-plane
+      operator: In
+      values:
+      - "true"
+  serviceAccountName: system-upgrade
+  upgrade:
+    image: rancher/k3s-upgrade
+` + target + `---
+apiVersion: upgrade.cattle.io/v1
+kind: Plan
+metadata:
+  name: agent-plan
+  namespace: system-upgrade
+  labels:
+    app.kubernetes.io/managed-by: k3sup
+spec:
+  concurrency: ` + fmt.Sprintf("%d", concurrency) + `
+  cordon: true
+` + drainSpec + `  nodeSelector:
+    matchExpressions:
+    - key: node-role.kubernetes.io/control-plane
+      operator: DoesNotExist
+  prepare:
+    args:
+    - prepare
+    - server-plan
+    image: rancher/k3s-upgrade
+  serviceAccountName: system-upgrade
+  upgrade:
+    image: rancher/k3s-upgrade
+` + target
+}
@@ -0,0 +1,500 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/alexellis/k3sup/pkg"
+	operator "github.com/alexellis/k3sup/pkg/operator"
+	"github.com/spf13/cobra"
+)
+
+const k3sReleaseURL = "https://github.com/k3s-io/k3s/releases/download"
+
+// upgradeBinaryScript downloads the K3s binary for the node's architecture,
+// checks it against the release's checksums, then replaces the installed
+// binary and restarts the service. The flags K3s was installed with are
+// kept in its systemd unit, so are not changed.
+const upgradeBinaryScript = `set -e
+case "$(uname -m)" in
+  x86_64|amd64) suffix=""; arch="amd64" ;;
+  aarch64|arm64) suffix="-arm64"; arch="arm64" ;;
+  armv7l|armv6l|arm) suffix="-armhf"; arch="arm" ;;
+  s390x) suffix="-s390x"; arch="s390x" ;;
+  *) echo "unsupported architecture: $(uname -m)"; exit 1 ;;
+esac
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+curl -sfL -o "$tmp/k3s" "%[1]s/k3s${suffix}"
+curl -sfL -o "$tmp/sha256sum.txt" "%[1]s/sha256sum-${arch}.txt"
+expected=$(grep " k3s${suffix}$" "$tmp/sha256sum.txt" | awk '{print $1}')
+actual=$(sha256sum "$tmp/k3s" | awk '{print $1}')
+if [ -z "$expected" ] || [ "$expected" != "$actual" ]; then echo "checksum mismatch for k3s${suffix}"; exit 1; fi
+chmod 755 "$tmp/k3s"
+%[2]smv -f "$tmp/k3s" /usr/local/bin/k3s
+%[2]ssystemctl restart %[3]s
+`
+
+// upgradeNode is a node to upgrade, and the name of its Node in the cluster
+type upgradeNode struct {
+	Host     Host
+	Role     string
+	NodeName string
+}
+
+// MakeUpgrade creates the upgrade command
+func MakeUpgrade() *cobra.Command {
+	var command = &cobra.Command{
+		Use:   "upgrade",
+		Short: "Upgrade K3s across a cluster, one node at a time",
+		Long: `Upgrade K3s across a cluster with a rolling upgrade.
+
+Servers are upgraded one at a time, then agents in batches of
+--batch-size. Each node is cordoned and drained, then the K3s binary is
+replaced and K3s is restarted. k3sup waits for the node to be Ready at
+the new version before uncordoning it, and stops at the first failure.
+Nodes which already run the version are skipped.
+
+The flags K3s was installed with are kept. Give the nodes with --server
+and --agent, or with a hosts file in the same format as for plan.
+
+With --mode controller, k3sup does not connect to each node. Instead,
+Rancher's system-upgrade-controller and a Plan for servers and for agents
+are written to the auto-deploy manifests directory of the first server,
+then k3sup follows the upgrade until every node is Ready at the new
+version. A channel can be given instead of a version in this mode.
+
+` + pkg.SupportMessageShort + `
+`,
+		Example: `  # Upgrade a single server and two agents
+  k3sup upgrade --k3s-version v1.30.2+k3s1 \
+    --server 192.168.0.100 \
+    --agent 192.168.0.101,192.168.0.102
+
+  # Upgrade the cluster created from a plan, two agents at a time
+  k3sup upgrade --k3s-version v1.30.2+k3s1 \
+    --hosts hosts.json --servers 3 \
+    --batch-size 2 --user ubuntu
+
+  # Upgrade in-cluster with the system-upgrade-controller
+  k3sup upgrade --mode controller --k3s-channel stable \
+    --server 192.168.0.100
+
+  # Upgrade every node of a cluster recorded by k3sup install
+  k3sup upgrade --k3s-version v1.30.2+k3s1 --cluster prod`,
+		SilenceUsage: true,
+	}
+
+	command.Flags().StringSlice("server", []string{}, "Hostname or IP of each server, repeat the flag or give a comma-separated list")
+	command.Flags().StringSlice("agent", []string{}, "Hostname or IP of each agent, repeat the flag or give a comma-separated list")
+	command.Flags().String("hosts", "", "Devices file, as used by plan")
+	command.Flags().Int("servers", 3, "Number of servers in the hosts file, the remaining hosts are agents")
+
+	command.Flags().String("user", "root", "Username for SSH login, unless set for the host in the hosts file")
+	command.Flags().String("ssh-key", "~/.ssh/id_rsa", "The ssh key to use for remote login, unless set for the host in the hosts file")
+	command.Flags().Int("ssh-port", 22, "The port on which to connect for ssh, unless set for the host in the hosts file")
+	command.Flags().Bool("sudo", true, "Use sudo for commands. e.g. set to false when using the root user and no sudo is available.")
+	command.Flags().Bool("print-command", false, "Print the commands to be executed")
+
+	command.Flags().String("mode", "ssh", "How to upgrade: ssh to upgrade each node from k3sup, or controller to use the system-upgrade-controller")
+	command.Flags().String("k3s-version", "", "Version of K3s to upgrade to i.e. v1.30.2+k3s1")
+	command.Flags().String("k3s-channel", "", "Release channel to upgrade to with --mode controller: stable, latest, or i.e. v1.30")
+	command.Flags().String("server-data-dir", "/var/lib/rancher/k3s/", "Data directory of K3s on the server, used with --mode controller")
+	command.Flags().Int("batch-size", 1, "Number of agents to upgrade at a time")
+	command.Flags().Bool("skip-drain", false, "Cordon each node, but do not drain it before upgrading")
+	command.Flags().Duration("drain-timeout", time.Minute*5, "Time to wait for a node to drain")
+
+	command.Flags().Int("attempts", 60, "Number of attempts to check if a node is Ready at the new version")
+	command.Flags().Duration("pause", time.Second*5, "Pause between checking a node for readiness")
+	addClusterFlag(command)
+
+	command.PreRunE = func(command *cobra.Command, args []string) error {
+		if command.Flags().Changed("cluster") && command.Flags().Changed("hosts") {
+			return fmt.Errorf("give either --hosts or --cluster")
+		}
+		if err := fillFromCluster(command, upgradeClusterValues); err != nil {
+			return err
+		}
+
+		mode, _ := command.Flags().GetString("mode")
+		if mode != "ssh" && mode != "controller" {
+			return fmt.Errorf("--mode must be ssh or controller, got: %q", mode)
+		}
+
+		version, _ := command.Flags().GetString("k3s-version")
+		channel, _ := command.Flags().GetString("k3s-channel")
+		if mode == "ssh" {
+			if len(channel) > 0 {
+				return fmt.Errorf("--k3s-channel can only be used with --mode controller")
+			}
+			if len(version) == 0 {
+				return fmt.Errorf("give the version to upgrade to with --k3s-version")
+			}
+		} else if (len(version) == 0) == (len(channel) == 0) {
+			return fmt.Errorf("give either --k3s-version or --k3s-channel")
+		}
+
+		batchSize, _ := command.Flags().GetInt("batch-size")
+		if batchSize < 1 {
+			return fmt.Errorf("--batch-size must be at least 1")
+		}
+
+		hostsFile, _ := command.Flags().GetString("hosts")
+		servers, _ := command.Flags().GetStringSlice("server")
+		agents, _ := command.Flags().GetStringSlice("agent")
+		if len(hostsFile) > 0 && len(servers)+len(agents) > 0 {
+			return fmt.Errorf("give either --hosts, or --server and --agent")
+		}
+		if len(hostsFile) == 0 && len(servers) == 0 {
+			return fmt.Errorf("give at least one server with --server, or a hosts file with --hosts")
+		}
+
+		return nil
+	}
+
+	command.RunE = func(command *cobra.Command, args []string) error {
+		serverAddresses, _ := command.Flags().GetStringSlice("server")
+		agentAddresses, _ := command.Flags().GetStringSlice("agent")
+		hostsFile, _ := command.Flags().GetString("hosts")
+
+		user, _ := command.Flags().GetString("user")
+		sshKey, _ := command.Flags().GetString("ssh-key")
+		port, _ := command.Flags().GetInt("ssh-port")
+		useSudo, _ := command.Flags().GetBool("sudo")
+		printCommand, _ := command.Flags().GetBool("print-command")
+
+		mode, _ := command.Flags().GetString("mode")
+		version, _ := command.Flags().GetString("k3s-version")
+		channel, _ := command.Flags().GetString("k3s-channel")
+		dataDir, _ := command.Flags().GetString("server-data-dir")
+		batchSize, _ := command.Flags().GetInt("batch-size")
+		skipDrain, _ := command.Flags().GetBool("skip-drain")
+		drainTimeout, _ := command.Flags().GetDuration("drain-timeout")
+		attempts, _ := command.Flags().GetInt("attempts")
+		pause, _ := command.Flags().GetDuration("pause")
+
+		servers, err := clusterHosts(command, serverAddresses)
+		if err != nil {
+			return err
+		}
+		agents, err := clusterHosts(command, agentAddresses)
+		if err != nil {
+			return err
+		}
+
+		if len(hostsFile) > 0 {
+			hosts, err := readHosts(hostsFile)
+			if err != nil {
+				return err
+			}
+
+			serverCount, _ := command.Flags().GetInt("servers")
+			servers, agents = splitHosts(hosts, serverCount)
+			if len(servers) == 0 {
+				return fmt.Errorf("no servers found in %s", hostsFile)
+			}
+		}
+
+		sudoPrefix := ""
+		if useSudo {
+			sudoPrefix = "sudo "
+		}
+
+		operators := map[string]operator.CommandOperator{}
+		dones := []DoneFunc{}
+		defer func() {
+			for _, done := range dones {
+				done()
+			}
+		}()
+
+		connect := func(host Host) (operator.CommandOperator, error) {
+			if op, ok := operators[host.Address()]; ok {
+				return op, nil
+			}
+
+			sshOperator, done, err := connectHost(host, user, port, sshKey)
+			if err != nil {
+				return nil, err
+			}
+			dones = append(dones, done)
+			operators[host.Address()] = sshOperator
+			return sshOperator, nil
+		}
+
+		if mode == "controller" {
+			op, err := connect(servers[0])
+			if err != nil {
+				return err
+			}
+
+			upgrader := &controllerUpgrade{
+				version:      version,
+				channel:      channel,
+				concurrency:  batchSize,
+				drain:        !skipDrain,
+				dataDir:      dataDir,
+				sudoPrefix:   sudoPrefix,
+				attempts:     attempts,
+				pause:        pause,
+				printCommand: printCommand,
+			}
+			if err := upgrader.run(op); err != nil {
+				return err
+			}
+
+			if err := recordUpgrade(command, servers[0].Address(), hostAddresses(append(servers, agents...)), version, channel); err != nil {
+				fmt.Printf("Unable to record the new version: %s\n", err)
+			}
+			return nil
+		}
+
+		upgrader := &rollingUpgrade{
+			version:      version,
+			sudoPrefix:   sudoPrefix,
+			skipDrain:    skipDrain,
+			drainTimeout: drainTimeout,
+			attempts:     attempts,
+			pause:        pause,
+			printCommand: printCommand,
+			servers:      servers,
+			connect:      connect,
+		}
+
+		for i, server := range servers {
+			fmt.Printf("[server %d/%d] %s\n", i+1, len(servers), server.Address())
+			if err := upgrader.upgrade([]Host{server}, "server"); err != nil {
+				return err
+			}
+		}
+
+		batches := upgradeBatches(agents, batchSize)
+		for i, batch := range batches {
+			fmt.Printf("[agents %d/%d] %s\n", i+1, len(batches), strings.Join(hostAddresses(batch), ", "))
+			if err := upgrader.upgrade(batch, "agent"); err != nil {
+				return err
+			}
+		}
+
+		fmt.Printf("Upgraded %d servers and %d agents to %s\n", len(servers), len(agents), version)
+
+		if err := recordUpgrade(command, servers[0].Address(), hostAddresses(append(servers, agents...)), version, channel); err != nil {
+			fmt.Printf("Unable to record the new version: %s\n", err)
+		}
+
+		return nil
+	}
+
+	return command
+}
+
+// rollingUpgrade upgrades nodes, using a server to cordon, drain and
+// check each one
+type rollingUpgrade struct {
+	version      string
+	sudoPrefix   string
+	skipDrain    bool
+	drainTimeout time.Duration
+	attempts     int
+	pause        time.Duration
+	printCommand bool
+
+	servers []Host
+	connect func(host Host) (operator.CommandOperator, error)
+}
+
+// controlServer gives a server other than host to run kubectl on, so that
+// the API stays available whilst host restarts. A single server has to
+// be used for its own upgrade.
+func (u *rollingUpgrade) controlServer(host Host) (operator.CommandOperator, error) {
+	for _, server := range u.servers {
+		if server.Address() != host.Address() {
+			return u.connect(server)
+		}
+	}
+	return u.connect(host)
+}
+
+// upgrade upgrades a batch of nodes with the same role, which are all
+// drained before any is upgraded
+func (u *rollingUpgrade) upgrade(hosts []Host, role string) error {
+	control, err := u.controlServer(hosts[0])
+	if err != nil {
+		return err
+	}
+
+	nodes := []upgradeNode{}
+	for _, host := range hosts {
+		op, err := u.connect(host)
+		if err != nil {
+			return err
+		}
+
+		res, err := executeCommand(op, "hostname\n", u.printCommand)
+		if err != nil {
+			return fmt.Errorf("%s: unable to get the hostname: %w", host.Address(), err)
+		}
+		node := upgradeNode{Host: host, Role: role, NodeName: strings.TrimSpace(string(res.StdOut))}
+
+		current, _, err := u.nodeStatus(control, node.NodeName)
+		if err != nil {
+			return fmt.Errorf("%s: %w", host.Address(), err)
+		}
+		if current == u.version {
+			fmt.Printf("%s is already at %s\n", node.NodeName, u.version)
+			continue
+		}
+
+		fmt.Printf("Upgrading %s from %s to %s\n", node.NodeName, current, u.version)
+		nodes = append(nodes, node)
+	}
+
+	for _, node := range nodes {
+		if err := u.drain(control, node.NodeName); err != nil {
+			return fmt.Errorf("%s: %w", node.Host.Address(), err)
+		}
+	}
+
+	for _, node := range nodes {
+		op, err := u.connect(node.Host)
+		if err != nil {
+			return err
+		}
+
+		if _, err := executeCommand(op, makeUpgradeBinaryCommand(u.version, node.Role, u.sudoPrefix), u.printCommand); err != nil {
+			return fmt.Errorf("%s: unable to upgrade K3s: %w", node.Host.Address(), err)
+		}
+	}
+
+	for _, node := range nodes {
+		if err := u.waitForVersion(control, node.NodeName); err != nil {
+			return fmt.Errorf("%s: %w", node.Host.Address(), err)
+		}
+
+		uncordonCommand := fmt.Sprintf("%sk3s kubectl uncordon %s\n", u.sudoPrefix, node.NodeName)
+		if _, err := executeCommand(control, uncordonCommand, u.printCommand); err != nil {
+			return fmt.Errorf("%s: unable to uncordon: %w", node.Host.Address(), err)
+		}
+
+		fmt.Printf("%s is Ready at %s\n", node.NodeName, u.version)
+	}
+
+	return nil
+}
+
+func (u *rollingUpgrade) drain(control operator.CommandOperator, nodeName string) error {
+	cordonCommand := fmt.Sprintf("%sk3s kubectl cordon %s\n", u.sudoPrefix, nodeName)
+	if _, err := executeCommand(control, cordonCommand, u.printCommand); err != nil {
+		return fmt.Errorf("unable to cordon: %w", err)
+	}
+
+	if u.skipDrain {
+		return nil
+	}
+
+	fmt.Printf("Draining %s\n", nodeName)
+	drainCommand := fmt.Sprintf("%sk3s kubectl drain %s --ignore-daemonsets --delete-emptydir-data --timeout=%s\n",
+		u.sudoPrefix, nodeName, u.drainTimeout)
+	if _, err := executeCommand(control, drainCommand, u.printCommand); err != nil {
+		return fmt.Errorf("unable to drain: %w", err)
+	}
+
+	return nil
+}
+
+func (u *rollingUpgrade) nodeStatus(control operator.CommandOperator, nodeName string) (string, bool, error) {
+	statusCommand := fmt.Sprintf(`%sk3s kubectl get node %s -o jsonpath='{.status.nodeInfo.kubeletVersion} {.status.conditions[?(@.type=="Ready")].status}'`+"\n",
+		u.sudoPrefix, nodeName)
+
+	res, err := executeCommand(control, statusCommand, u.printCommand)
+	if err != nil {
+		return "", false, fmt.Errorf("unable to get the status of node %s: %w", nodeName, err)
+	}
+
+	version, ready := parseNodeStatus(string(res.StdOut))
+	return version, ready, nil
+}
+
+// waitForVersion waits for the node to be Ready at the target version,
+// or at any version when there is no target. The control server may be
+// restarting too, so errors are retried.
+func (u *rollingUpgrade) waitForVersion(control operator.CommandOperator, nodeName string) error {
+	target := "Ready"
+	if len(u.version) > 0 {
+		target = "Ready at " + u.version
+	}
+
+	for i := 0; i < u.attempts; i++ {
+		version, ready, err := u.nodeStatus(control, nodeName)
+		if err == nil && ready && (len(u.version) == 0 || version == u.version) {
+			return nil
+		}
+
+		fmt.Printf("Waiting for %s to be %s: %d/%d\n", nodeName, target, i+1, u.attempts)
+		time.Sleep(u.pause)
+	}
+
+	return fmt.Errorf("%s was not %s after %d attempts", nodeName, target, u.attempts)
+}
+
+// makeUpgradeBinaryCommand gives the command to upgrade the binary on a
+// node with the given role
+func makeUpgradeBinaryCommand(version, role, sudoPrefix string) string {
+	service := "k3s"
+	if role == "agent" {
+		service = "k3s-agent"
+	}
+
+	releaseURL := fmt.Sprintf("%s/%s", k3sReleaseURL, url.PathEscape(version))
+
+	return fmt.Sprintf(upgradeBinaryScript, releaseURL, sudoPrefix, service)
+}
+
+// parseNodeStatus reads the kubelet version and Ready condition of a node
+func parseNodeStatus(out string) (string, bool) {
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return "", false
+	}
+
+	return fields[0], len(fields) > 1 && fields[1] == "True"
+}
+
+// upgradeBatches splits hosts into batches of at most size
+func upgradeBatches(hosts []Host, size int) [][]Host {
+	batches := [][]Host{}
+	for start := 0; start < len(hosts); start += size {
+		end := start + size
+		if end > len(hosts) {
+			end = len(hosts)
+		}
+		batches = append(batches, hosts[start:end])
+	}
+	return batches
+}
+
+// splitHosts gives the servers and agents, using the role of each host
+// when set, otherwise the first hosts make up servers
+func splitHosts(hosts []Host, servers int) ([]Host, []Host) {
+	serverHosts := []Host{}
+	agentHosts := []Host{}
+	for i, role := range hostRoles(hosts, servers) {
+		if role == "server" {
+			serverHosts = append(serverHosts, hosts[i])
+		} else {
+			agentHosts = append(agentHosts, hosts[i])
+		}
+	}
+	return serverHosts, agentHosts
+}
+
+// hostAddresses gives the address of each host
+func hostAddresses(hosts []Host) []string {
+	addresses := []string{}
+	for _, host := range hosts {
+		addresses = append(addresses, host.Address())
+	}
+	return addresses
+}
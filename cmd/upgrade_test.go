@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_upgradeBatches(t *testing.T) {
+	a, b, c, d, e := Host{IP: "a"}, Host{IP: "b"}, Host{IP: "c"}, Host{IP: "d"}, Host{IP: "e"}
+
+	got := upgradeBatches([]Host{a, b, c, d, e}, 2)
+	want := [][]Host{{a, b}, {c, d}, {e}}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	if got := upgradeBatches([]Host{}, 2); len(got) != 0 {
+		t.Fatalf("want no batches, got %v", got)
+	}
+}
+
+func Test_parseNodeStatus(t *testing.T) {
+	tests := []struct {
+		out         string
+		wantVersion string
+		wantReady   bool
+	}{
+		{out: "v1.30.2+k3s1 True", wantVersion: "v1.30.2+k3s1", wantReady: true},
+		{out: "v1.30.2+k3s1 Unknown", wantVersion: "v1.30.2+k3s1", wantReady: false},
+		{out: "v1.29.6+k3s2", wantVersion: "v1.29.6+k3s2", wantReady: false},
+		{out: "", wantVersion: "", wantReady: false},
+	}
+
+	for _, tc := range tests {
+		version, ready := parseNodeStatus(tc.out)
+		if version != tc.wantVersion || ready != tc.wantReady {
+			t.Errorf("%q: want %s %v, got %s %v", tc.out, tc.wantVersion, tc.wantReady, version, ready)
+		}
+	}
+}
+
+func Test_makeUpgradeBinaryCommand(t *testing.T) {
+	got := makeUpgradeBinaryCommand("v1.30.2+k3s1", "agent", "sudo ")
+
+	wantURL := "https://github.com/k3s-io/k3s/releases/download/v1.30.2+k3s1/k3s${suffix}"
+	if !strings.Contains(got, wantURL) {
+		t.Errorf("want the command to download %s, got:\n%s", wantURL, got)
+	}
+	if !strings.Contains(got, "sudo systemctl restart k3s-agent\n") {
+		t.Errorf("want the command to restart k3s-agent, got:\n%s", got)
+	}
+	if strings.Contains(got, "%!") {
+		t.Errorf("unexpected formatting error in:\n%s", got)
+	}
+}
+
+func Test_splitHosts(t *testing.T) {
+	hosts := []Host{{IP: "10.0.0.1", User: "ubuntu"}, {IP: "10.0.0.2", SSHPort: 2222}, {IP: "10.0.0.3", SSHKey: "~/.ssh/agent"}}
+
+	servers, agents := splitHosts(hosts, 2)
+	if !reflect.DeepEqual(hosts[:2], servers) {
+		t.Errorf("unexpected servers: %v", servers)
+	}
+	if !reflect.DeepEqual(hosts[2:], agents) {
+		t.Errorf("unexpected agents: %v", agents)
+	}
+	if want := []string{"10.0.0.1", "10.0.0.2"}; !reflect.DeepEqual(want, hostAddresses(servers)) {
+		t.Errorf("want addresses %v, got %v", want, hostAddresses(servers))
+	}
+}
+
+func Test_nodesPendingUpgrade(t *testing.T) {
+	out := `server-1 v1.30.2+k3s1 True
+server-2 v1.29.6+k3s2 True
+agent-1 v1.30.2+k3s1 Unknown
+`
+	pending, total := nodesPendingUpgrade(out, "v1.30.2+k3s1")
+	if total != 3 {
+		t.Errorf("want 3 nodes, got %d", total)
+	}
+	if !reflect.DeepEqual([]string{"server-2", "agent-1"}, pending) {
+		t.Errorf("unexpected pending nodes: %v", pending)
+	}
+}
+
+func Test_makeUpgradePlans(t *testing.T) {
+	t.Run("version with drain", func(t *testing.T) {
+		got := makeUpgradePlans("v1.30.2+k3s1", "", 2, true)
+
+		for _, want := range []string{
+			"  name: server-plan\n",
+			"  name: agent-plan\n",
+			"  concurrency: 2\n",
+			"  version: v1.30.2+k3s1\n",
+			"    ignoreDaemonSets: true\n",
+		} {
+			if !strings.Contains(got, want) {
+				t.Errorf("want %q in:\n%s", want, got)
+			}
+		}
+		if strings.Contains(got, "channel:") {
+			t.Errorf("want no channel in:\n%s", got)
+		}
+	})
+
+	t.Run("channel without drain", func(t *testing.T) {
+		got := makeUpgradePlans("", "stable", 1, false)
+
+		want := "  channel: https://update.k3s.io/v1-release/channels/stable\n"
+		if strings.Count(got, want) != 2 {
+			t.Errorf("want %q in both plans, got:\n%s", want, got)
+		}
+		if strings.Contains(got, "drain:") {
+			t.Errorf("want no drain in:\n%s", got)
+		}
+	})
+}
+
+func Test_makeDownloadManifestCommand(t *testing.T) {
+	bin := t.TempDir()
+	manifests := filepath.Join(t.TempDir(), "server", "manifests")
+	manifest := filepath.Join(manifests, "system-upgrade-controller-crd.yaml")
+	command := makeDownloadManifestCommand("", "https://example.com/crd.yaml", manifest)
+
+	run := func(curl string) error {
+		if err := os.WriteFile(filepath.Join(bin, "curl"), []byte("#!/bin/sh\n"+curl), 0755); err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = append(os.Environ(), "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+		return cmd.Run()
+	}
+
+	// A failed download exits non-zero, and writes no manifest
+	if err := run("exit 22\n"); err == nil {
+		t.Fatal("want an error when curl fails")
+	}
+	if _, err := os.Stat(manifest); !os.IsNotExist(err) {
+		t.Fatalf("want no manifest after a failed download, got: %v", err)
+	}
+
+	if err := run(`while [ $# -gt 0 ]; do if [ "$1" = -o ]; then out="$2"; fi; shift; done; echo "kind: List" > "$out"` + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("want mode 0600, got %o", info.Mode().Perm())
+	}
+}
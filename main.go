@@ -16,8 +16,30 @@ func main() {
 	cmdUpdate := cmd.MakeUpdate()
 	cmdReady := cmd.MakeReady()
 	cmdPlan := cmd.MakePlan()
+	cmdApply := cmd.MakeApply()
+	cmdDiff := cmd.MakeDiff()
 	cmdNodeToken := cmd.MakeNodeToken()
 	cmdGetConfig := cmd.MakeGetConfig()
+	cmdForgetConfig := cmd.MakeForgetConfig()
+	cmdAddSAN := cmd.MakeAddSAN()
+	cmdPreflight := cmd.MakePreflight()
+	cmdCheckPorts := cmd.MakeCheckPorts()
+	cmdUninstall := cmd.MakeUninstall()
+	cmdUpgrade := cmd.MakeUpgrade()
+	cmdEtcdSnapshot := cmd.MakeEtcdSnapshot()
+	cmdEtcdSnapshotSave := cmd.MakeEtcdSnapshotSave()
+	cmdEtcdSnapshotList := cmd.MakeEtcdSnapshotList()
+	cmdEtcdSnapshotPrune := cmd.MakeEtcdSnapshotPrune()
+	cmdEtcdSnapshotDownload := cmd.MakeEtcdSnapshotDownload()
+	cmdEtcdSnapshotRestore := cmd.MakeEtcdSnapshotRestore()
+	cmdToken := cmd.MakeToken()
+	cmdTokenCreate := cmd.MakeTokenCreate()
+	cmdTokenList := cmd.MakeTokenList()
+	cmdTokenDelete := cmd.MakeTokenDelete()
+	cmdTokenRotate := cmd.MakeTokenRotate()
+	cmdCerts := cmd.MakeCerts()
+	cmdCertsCheck := cmd.MakeCertsCheck()
+	cmdCertsRotate := cmd.MakeCertsRotate()
 	cmdGet := cmd.MakeGet()
 	cmdGetPro := cmd.MakeGetPro()
 	cmdPro := cmd.MakePro()
@@ -39,8 +61,33 @@ func main() {
 	rootCmd.AddCommand(cmdUpdate)
 	rootCmd.AddCommand(cmdReady)
 	rootCmd.AddCommand(cmdPlan)
+	rootCmd.AddCommand(cmdApply)
+	rootCmd.AddCommand(cmdDiff)
 	rootCmd.AddCommand(cmdNodeToken)
 	rootCmd.AddCommand(cmdGetConfig)
+	rootCmd.AddCommand(cmdForgetConfig)
+	rootCmd.AddCommand(cmdAddSAN)
+	rootCmd.AddCommand(cmdPreflight)
+	rootCmd.AddCommand(cmdCheckPorts)
+	rootCmd.AddCommand(cmdUninstall)
+	rootCmd.AddCommand(cmdUpgrade)
+
+	cmdEtcdSnapshot.AddCommand(cmdEtcdSnapshotSave)
+	cmdEtcdSnapshot.AddCommand(cmdEtcdSnapshotList)
+	cmdEtcdSnapshot.AddCommand(cmdEtcdSnapshotPrune)
+	cmdEtcdSnapshot.AddCommand(cmdEtcdSnapshotDownload)
+	cmdEtcdSnapshot.AddCommand(cmdEtcdSnapshotRestore)
+	rootCmd.AddCommand(cmdEtcdSnapshot)
+
+	cmdToken.AddCommand(cmdTokenCreate)
+	cmdToken.AddCommand(cmdTokenList)
+	cmdToken.AddCommand(cmdTokenDelete)
+	cmdToken.AddCommand(cmdTokenRotate)
+	rootCmd.AddCommand(cmdToken)
+
+	cmdCerts.AddCommand(cmdCertsCheck)
+	cmdCerts.AddCommand(cmdCertsRotate)
+	rootCmd.AddCommand(cmdCerts)
 
 	cmdGet.AddCommand(cmdGetPro)
 	rootCmd.AddCommand(cmdGet)
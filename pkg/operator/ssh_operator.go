@@ -12,6 +12,9 @@ import (
 // SSHOperator executes commands on a remote machine over an SSH session
 type SSHOperator struct {
 	conn *ssh.Client
+
+	stdout io.Writer
+	stderr io.Writer
 }
 
 func NewSSHOperator(address string, config *ssh.ClientConfig) (*SSHOperator, error) {
@@ -27,6 +30,13 @@ func NewSSHOperator(address string, config *ssh.ClientConfig) (*SSHOperator, err
 	return &operator, nil
 }
 
+// SetOutput sets where the output of commands is streamed to, instead of
+// os.Stdout and os.Stderr
+func (s *SSHOperator) SetOutput(stdout, stderr io.Writer) {
+	s.stdout = stdout
+	s.stderr = stderr
+}
+
 func (s SSHOperator) ExecuteStdio(command string, stream bool) (CommandRes, error) {
 
 	sess, err := s.conn.NewSession()
@@ -46,7 +56,11 @@ func (s SSHOperator) ExecuteStdio(command string, stream bool) (CommandRes, erro
 
 	var stdOutWriter io.Writer
 	if stream {
-		stdOutWriter = io.MultiWriter(os.Stdout, &output)
+		stdout := s.stdout
+		if stdout == nil {
+			stdout = os.Stdout
+		}
+		stdOutWriter = io.MultiWriter(stdout, &output)
 	} else {
 		stdOutWriter = &output
 	}
@@ -65,7 +79,11 @@ func (s SSHOperator) ExecuteStdio(command string, stream bool) (CommandRes, erro
 	errorOutput := bytes.Buffer{}
 	var stdErrWriter io.Writer
 	if stream {
-		stdErrWriter = io.MultiWriter(os.Stderr, &errorOutput)
+		stderr := s.stderr
+		if stderr == nil {
+			stderr = os.Stderr
+		}
+		stdErrWriter = io.MultiWriter(stderr, &errorOutput)
 	} else {
 		stdErrWriter = &errorOutput
 	}